@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	buildActionPath    = "/actions/build"
+	tagBuildDialogPath = "/dialog/tag-build"
+
+	// actionKeyKey stores the key signing the context of build action buttons
+	actionKeyKey = "action_key"
+
+	buildActionCancel      = "cancel"
+	buildActionRerun       = "rerun"
+	buildActionRerunParams = "rerunParams"
+	buildActionPin         = "pin"
+	buildActionTag         = "tag"
+	buildActionLog         = "log"
+	buildActionInvestigate = "investigate"
+	buildActionMute        = "mute"
+
+	dialogElementTags = "tags"
+)
+
+var buildActionNames = map[string]string{
+	buildActionCancel:      "Cancel",
+	buildActionRerun:       "Re-run",
+	buildActionRerunParams: "Re-run with Same Parameters",
+	buildActionPin:         "Pin",
+	buildActionTag:         "Add Tag",
+	buildActionLog:         "Show log tail",
+	buildActionInvestigate: "Take investigation",
+	buildActionMute:        "Mute",
+}
+
+// signAction signs a build action so that the action endpoint only accepts actions of buttons
+// the plugin created. Mattermost never sends action contexts to clients, so users cannot copy
+// signatures into buttons of their own.
+func (p *Plugin) signAction(action, server string, buildID int64) (string, error) {
+	key, err := p.ensureKVKey(actionKeyKey)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s:%d", action, buildID)
+
+	// Buttons created before servers were named stay valid for the default server
+	if server = serverNameOrDefault(server); server != defaultServerName {
+		fmt.Fprintf(mac, ":%s", server)
+	}
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (p *Plugin) verifyAction(action, server string, buildID int64, signature string) bool {
+	expected, err := p.signAction(action, server, buildID)
+	if err != nil {
+		p.API.LogError("Could not verify build action", "error", err.Error())
+		return false
+	}
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// buildActions returns the buttons for the given actions on a build of a server
+func (p *Plugin) buildActions(server string, buildID int64, actions ...string) []*model.PostAction {
+	var buttons []*model.PostAction
+
+	for _, action := range actions {
+		signature, err := p.signAction(action, server, buildID)
+		if err != nil {
+			p.API.LogError("Could not sign build action", "error", err.Error())
+			return nil
+		}
+
+		buttons = append(buttons, &model.PostAction{
+			Name: buildActionNames[action],
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Integration: &model.PostActionIntegration{
+				URL: pluginURL(buildActionPath),
+				Context: map[string]interface{}{
+					"action":    action,
+					"build_id":  strconv.FormatInt(buildID, 10),
+					"server":    serverNameOrDefault(server),
+					"signature": signature,
+				},
+			},
+		})
+	}
+
+	return buttons
+}
+
+// startedBuildAttachments returns the buttons shown below the message of a started build
+func (p *Plugin) startedBuildAttachments(server string, build *tcBuild) []*model.SlackAttachment {
+	return []*model.SlackAttachment{{
+		Actions: p.buildActions(server, build.ID, buildActionCancel, buildActionRerun, buildActionRerunParams, buildActionPin, buildActionTag),
+	}}
+}
+
+// addBuildPostNote appends a note about an action to a build post, if not empty, and removes
+// the button of the action if it cannot be used again
+func addBuildPostNote(post *model.Post, note string, removeAction string) *model.Post {
+	updated := post.Clone()
+
+	attachments := post.Attachments()
+	if len(attachments) == 0 {
+		attachments = []*model.SlackAttachment{{}}
+	}
+
+	if note != "" {
+		last := attachments[len(attachments)-1]
+		if last.Text != "" {
+			last.Text += "\n"
+		}
+		last.Text += note
+	}
+
+	if removeAction != "" {
+		for _, attachment := range attachments {
+			var kept []*model.PostAction
+			for _, action := range attachment.Actions {
+				if action.Integration == nil || action.Integration.Context["action"] != removeAction {
+					kept = append(kept, action)
+				}
+			}
+			attachment.Actions = kept
+		}
+	}
+
+	model.ParseSlackAttachment(updated, attachments)
+
+	return updated
+}
+
+// addBuildPostActions adds the buttons of actions to a build post, skipping those it already has
+func (p *Plugin) addBuildPostActions(post *model.Post, server string, buildID int64, actions ...string) *model.Post {
+	updated := post.Clone()
+
+	attachments := post.Attachments()
+	if len(attachments) == 0 {
+		attachments = []*model.SlackAttachment{{}}
+	}
+
+	present := map[string]bool{}
+	for _, attachment := range attachments {
+		for _, action := range attachment.Actions {
+			if action.Integration != nil {
+				if name, ok := action.Integration.Context["action"].(string); ok {
+					present[name] = true
+				}
+			}
+		}
+	}
+
+	var missing []string
+	for _, action := range actions {
+		if !present[action] {
+			missing = append(missing, action)
+		}
+	}
+
+	last := attachments[len(attachments)-1]
+	last.Actions = append(last.Actions, p.buildActions(server, buildID, missing...)...)
+
+	model.ParseSlackAttachment(updated, attachments)
+
+	return updated
+}
+
+// handleBuildAction handles the buttons on build posts and updates the post in place, except for
+// showing the log, which is posted in the thread of the build post
+func (p *Plugin) handleBuildAction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserId != userID {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	action, _ := request.Context["action"].(string)
+	rawBuildID, _ := request.Context["build_id"].(string)
+	signature, _ := request.Context["signature"].(string)
+	serverName, _ := request.Context["server"].(string)
+
+	buildID, err := strconv.ParseInt(rawBuildID, 10, 64)
+	if err != nil || !p.verifyAction(action, serverName, buildID, signature) {
+		http.Error(w, "invalid action", http.StatusForbidden)
+		return
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+	defer writeJSON(w, response)
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		response.EphemeralText = "Could not get your user: `" + appErr.Error() + "`"
+		return
+	}
+
+	server := p.getConfiguration().GetServer(serverName)
+	if server == nil {
+		response.EphemeralText = "The TeamCity server `" + serverNameOrDefault(serverName) + "` of this build is not configured anymore"
+		return
+	}
+
+	// Showing the log only reads from TeamCity
+	client, err := p.clientFor(userID, server, action != buildActionLog)
+	if err == errNotConnected {
+		response.EphemeralText = errorNotConnected + p.connectServerHint(server.Name)
+		return
+	} else if err != nil {
+		response.EphemeralText = "Could not get your TeamCity token: `" + err.Error() + "`"
+		return
+	}
+
+	build, err := client.GetBuild(buildID)
+	if errors.Cause(err) == errNotFound {
+		response.EphemeralText = fmt.Sprintf("Build %d does not exist anymore", buildID)
+		return
+	}
+	if err != nil {
+		response.EphemeralText = "Could not get the build: `" + err.Error() + "`"
+		return
+	}
+
+	ctx := &permissionContext{UserID: userID, ChannelID: request.ChannelId, TeamID: request.TeamId, Server: server.Name}
+	switch action {
+	case buildActionCancel:
+		response.EphemeralText = p.checkPermission(ctx, permissionCancel, &build.BuildType)
+	case buildActionRerun, buildActionRerunParams:
+		response.EphemeralText = p.checkPermission(ctx, permissionStart, &build.BuildType)
+	}
+	if response.EphemeralText != "" {
+		return
+	}
+
+	var note, removeAction string
+
+	switch action {
+	case buildActionCancel:
+		if build.State == "finished" {
+			response.EphemeralText = fmt.Sprintf("Build %d already finished", buildID)
+			return
+		}
+
+		if err = client.CancelBuild(build, "Cancelled from Mattermost by @"+user.Username); err != nil {
+			response.EphemeralText = "Could not cancel the build: `" + err.Error() + "`"
+			return
+		}
+
+		note = "_Cancelled by @" + user.Username + "_"
+		removeAction = buildActionCancel
+
+	case buildActionRerun, buildActionRerunParams:
+		options := &queueBuildOptions{}
+		if !build.DefaultBranch {
+			options.Branch = build.BranchName
+		}
+
+		if action == buildActionRerunParams {
+			if options.Parameters, err = client.GetBuildParameters(buildID); err != nil {
+				response.EphemeralText = "Could not get the build parameters: `" + err.Error() + "`"
+				return
+			}
+		}
+
+		rerun, queueErr := client.QueueBuild(build.BuildTypeID, options)
+		if queueErr != nil {
+			response.EphemeralText = "Could not re-run the build: `" + queueErr.Error() + "`"
+			return
+		}
+
+		note = fmt.Sprintf("_Re-run by @%s as [build %d](%s)_", user.Username, rerun.ID, rerun.WebURL)
+
+	case buildActionPin:
+		if build.State != "finished" {
+			response.EphemeralText = "Only finished builds can be pinned"
+			return
+		}
+
+		if err = client.PinBuild(buildID, "Pinned from Mattermost by @"+user.Username); err != nil {
+			response.EphemeralText = "Could not pin the build: `" + err.Error() + "`"
+			return
+		}
+
+		note = "_Pinned by @" + user.Username + "_"
+		removeAction = buildActionPin
+
+	case buildActionTag:
+		if err = p.openTagBuildDialog(request.TriggerId, server.Name, buildID, request.PostId, request.ChannelId); err != nil {
+			response.EphemeralText = "Could not open the tag dialog: `" + err.Error() + "`"
+		}
+		return
+
+	case buildActionInvestigate:
+		tcUser, userErr := client.GetCurrentUser()
+		if userErr != nil {
+			response.EphemeralText = "Could not get your TeamCity user: `" + userErr.Error() + "`"
+			return
+		}
+
+		if err = client.TakeInvestigation(build.BuildTypeID, tcUser.Username, "Taken from Mattermost by @"+user.Username); err != nil {
+			response.EphemeralText = "Could not take the investigation: `" + err.Error() + "`"
+			return
+		}
+
+		note = "_Investigation taken by @" + user.Username + "_"
+		removeAction = buildActionInvestigate
+
+	case buildActionMute:
+		muted, muteErr := muteBuildFailures(client, build, "Muted from Mattermost by @"+user.Username)
+		if muteErr != nil {
+			response.EphemeralText = "Could not mute the failures: `" + muteErr.Error() + "`"
+			return
+		}
+		if muted == "" {
+			response.EphemeralText = fmt.Sprintf("Build %d has no failures to mute", buildID)
+			return
+		}
+
+		note = "_Muted " + muted + " by @" + user.Username + "_"
+		removeAction = buildActionMute
+
+	case buildActionLog:
+		response.EphemeralText = p.postBuildLogTail(client, build, request.ChannelId, request.PostId)
+		return
+
+	default:
+		response.EphemeralText = "Unknown action"
+		return
+	}
+
+	post, appErr := p.API.GetPost(request.PostId)
+	if appErr != nil {
+		p.API.LogWarn("Could not get build post", "post_id", request.PostId, "error", appErr.Error())
+		return
+	}
+
+	response.Update = addBuildPostNote(post, note, removeAction)
+}
+
+// postBuildLogTail posts the last lines of the log of a build in the thread of a build post,
+// returning a message for the user if that failed
+func (p *Plugin) postBuildLogTail(client TeamCityClient, build *tcBuild, channelID, postID string) string {
+	rootID := postID
+	if post, appErr := p.API.GetPost(postID); appErr == nil && post.RootId != "" {
+		rootID = post.RootId
+	}
+
+	options := &buildLogOptions{Tail: defaultLogTail}
+
+	excerpt, err := readBuildLog(client, build.ID, options)
+	if errors.Cause(err) == errNotFound {
+		return fmt.Sprintf("The log of build %d is not available", build.ID)
+	}
+	if err != nil {
+		return "Could not get the build log: `" + err.Error() + "`"
+	}
+
+	if problem := buildLogProblem(build.ID, options, excerpt); problem != "" {
+		return problem
+	}
+
+	if err = p.postBuildLog(channelID, rootID, client, build, options, excerpt); err != nil {
+		return "Could not post the build log: `" + err.Error() + "`"
+	}
+
+	return ""
+}
+
+// tagDialogAction is the signed action of the tag dialog. Unlike buttons, the dialog state goes
+// through the client, so the post to update and its channel are signed too.
+func tagDialogAction(postID, channelID string) string {
+	return buildActionTag + ":" + postID + ":" + channelID
+}
+
+// openTagBuildDialog asks for the tags to add to a build. The dialog state carries the build,
+// the post to update, a signature and the server, as the dialog submission is a separate
+// request.
+func (p *Plugin) openTagBuildDialog(triggerID, server string, buildID int64, postID, channelID string) error {
+	signature, err := p.signAction(tagDialogAction(postID, channelID), server, buildID)
+	if err != nil {
+		return err
+	}
+
+	appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: triggerID,
+		URL:       pluginURL(tagBuildDialogPath),
+		Dialog: model.Dialog{
+			CallbackId:  "tagBuild",
+			Title:       fmt.Sprintf("Tag Build %d", buildID),
+			SubmitLabel: "Add",
+			State:       fmt.Sprintf("%d:%s:%s:%s", buildID, postID, signature, serverNameOrDefault(server)),
+			Elements: []model.DialogElement{{
+				DisplayName: "Tags",
+				Name:        dialogElementTags,
+				Type:        "text",
+				HelpText:    "Separate tags with commas",
+			}},
+		},
+	})
+	if appErr != nil {
+		return errors.Wrap(appErr, "could not open dialog")
+	}
+
+	return nil
+}
+
+// handleTagBuildDialog adds the tags submitted with the tag dialog to the build
+func (p *Plugin) handleTagBuildDialog(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request model.SubmitDialogRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserId != userID {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	state := strings.SplitN(request.State, ":", 4)
+	if len(state) != 4 {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	// The signature covers the post and the channel the dialog was opened in, so the state
+	// cannot be reused to update another post
+	buildID, err := strconv.ParseInt(state[0], 10, 64)
+	if err != nil || !p.verifyAction(tagDialogAction(state[1], request.ChannelId), state[3], buildID, state[2]) {
+		http.Error(w, "invalid state", http.StatusForbidden)
+		return
+	}
+
+	if request.Cancelled {
+		writeJSON(w, &model.SubmitDialogResponse{})
+		return
+	}
+
+	text, _ := request.Submission[dialogElementTags].(string)
+
+	var tags []string
+	for _, tag := range strings.Split(text, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(tags) == 0 {
+		writeJSON(w, &model.SubmitDialogResponse{Errors: map[string]string{dialogElementTags: "Please enter a tag"}})
+		return
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "Could not get your user: " + appErr.Error()})
+		return
+	}
+
+	server := p.getConfiguration().GetServer(state[3])
+	if server == nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "The TeamCity server " + state[3] + " of this build is not configured anymore"})
+		return
+	}
+
+	client, err := p.clientFor(userID, server, true)
+	if err == errNotConnected {
+		writeJSON(w, &model.SubmitDialogResponse{Error: errorNotConnected + p.connectServerHint(server.Name)})
+		return
+	} else if err != nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "Could not get your TeamCity token: " + err.Error()})
+		return
+	}
+
+	if err = client.AddBuildTags(buildID, tags); err != nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "Could not tag the build: " + err.Error()})
+		return
+	}
+
+	if post, appErr := p.API.GetPost(state[1]); appErr == nil && post.ChannelId == request.ChannelId {
+		note := "_Tagged `" + strings.Join(tags, "`, `") + "` by @" + user.Username + "_"
+		if _, appErr = p.API.UpdatePost(addBuildPostNote(post, note, "")); appErr != nil {
+			p.API.LogWarn("Could not update build post", "post_id", post.Id, "error", appErr.Error())
+		}
+	}
+
+	writeJSON(w, &model.SubmitDialogResponse{})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestSignAction(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	signature, err := p.signAction(buildActionCancel, defaultServerName, 42)
+	assert.Nil(err)
+
+	assert.True(p.verifyAction(buildActionCancel, defaultServerName, 42, signature))
+	assert.True(p.verifyAction(buildActionCancel, "", 42, signature), "buttons without a server belong to the default server")
+	assert.False(p.verifyAction(buildActionCancel, defaultServerName, 43, signature), "the signature is bound to the build")
+	assert.False(p.verifyAction(buildActionPin, defaultServerName, 42, signature), "the signature is bound to the action")
+	assert.False(p.verifyAction(buildActionCancel, "infra", 42, signature), "the signature is bound to the server")
+	assert.False(p.verifyAction(buildActionCancel, defaultServerName, 42, ""))
+
+	// Another node shares the key through the KV store
+	other := &Plugin{}
+	other.SetAPI(api)
+	assert.True(other.verifyAction(buildActionCancel, defaultServerName, 42, signature))
+}
+
+func TestAddBuildPostNote(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	post := &model.Post{Message: "**TEAMCITY BUILD STARTED**"}
+	model.ParseSlackAttachment(post, p.startedBuildAttachments(defaultServerName, &tcBuild{ID: 42}))
+
+	updated := addBuildPostNote(post, "_Cancelled by @alice_", buildActionCancel)
+
+	attachments := updated.Attachments()
+	assert.Len(attachments, 1)
+	assert.Equal("_Cancelled by @alice_", attachments[0].Text)
+	assert.Len(attachments[0].Actions, 4)
+	for _, action := range attachments[0].Actions {
+		assert.NotEqual(buildActionCancel, action.Integration.Context["action"])
+	}
+
+	updated = addBuildPostNote(updated, "_Pinned by @bob_", "")
+	assert.Equal("_Cancelled by @alice_\n_Pinned by @bob_", updated.Attachments()[0].Text)
+	assert.Len(updated.Attachments()[0].Actions, 4)
+
+	updated = p.addBuildPostActions(updated, defaultServerName, 42, buildActionLog)
+	assert.Len(updated.Attachments()[0].Actions, 5)
+	assert.Equal(buildActionNames[buildActionLog], updated.Attachments()[0].Actions[4].Name)
+}
+
+func TestTagBuildDialog(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("")
+	api.On("GetUser", args.UserId).Return(&model.User{Id: args.UserId, Username: "jane"}, nil)
+
+	var dialog model.OpenDialogRequest
+	api.On("OpenInteractiveDialog", mock.AnythingOfType("model.OpenDialogRequest")).Return(func(request model.OpenDialogRequest) *model.AppError {
+		dialog = request
+		return nil
+	})
+
+	posts := map[string]*model.Post{
+		"post":  {Id: "post", ChannelId: "channel"},
+		"other": {Id: "other", ChannelId: "private"},
+	}
+	api.On("GetPost", mock.AnythingOfType("string")).Return(func(postID string) *model.Post { return posts[postID] }, nil)
+
+	var updated []string
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		updated = append(updated, post.Id)
+		return post
+	}, nil)
+
+	assert.Nil(plugin.openTagBuildDialog("trigger", defaultServerName, 1, "post", "channel"))
+
+	submit := func(state, channelID string) int {
+		body, _ := json.Marshal(&model.SubmitDialogRequest{
+			UserId:     args.UserId,
+			ChannelId:  channelID,
+			State:      state,
+			Submission: map[string]interface{}{dialogElementTags: "release"},
+		})
+
+		r := httptest.NewRequest(http.MethodPost, tagBuildDialogPath, bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-Id", args.UserId)
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, r)
+		return w.Code
+	}
+
+	// The signature of the state is bound to the post and the channel
+	assert.Equal(http.StatusForbidden, submit(strings.Replace(dialog.Dialog.State, ":post:", ":other:", 1), "private"))
+	assert.Equal(http.StatusForbidden, submit(dialog.Dialog.State, "private"))
+	assert.Empty(updated)
+
+	assert.Equal(http.StatusOK, submit(dialog.Dialog.State, "channel"))
+	assert.Equal([]string{"post"}, updated)
+}
@@ -5,9 +5,17 @@ import (
 
 	"github.com/blang/semver"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	botUsername    = "teamcity"
+	botDisplayName = "TeamCity"
+	botDescription = "Created by the TeamCity plugin."
 )
 
-const minimumServerVersion = "5.18.0"
+const minimumServerVersion = "5.24.0"
 
 func (p *Plugin) checkServerVersion() error {
 	serverVersion, err := semver.Parse(p.API.GetServerVersion())
@@ -36,6 +44,40 @@ func (p *Plugin) OnActivate() error {
 		return errors.Wrap(err, "failed to register commands")
 	}
 
+	botUserID, err := p.Helpers.EnsureBot(&model.Bot{
+		Username:    botUsername,
+		DisplayName: botDisplayName,
+		Description: botDescription,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to ensure bot user")
+	}
+	p.botUserID = botUserID
+
+	if err := p.ensureWebhookSecret(); err != nil {
+		return err
+	}
+
+	p.nodeID = model.NewId()
+	p.startWebhookWorker()
+	p.startPoller()
+	p.startTracker()
+	p.startHealthMonitor()
+
+	return nil
+}
+
+// ensureWebhookSecret generates the secret TeamCity must send with webhooks if the admin has
+// not generated one in the System Console yet
+func (p *Plugin) ensureWebhookSecret() error {
+	if p.getConfiguration().WebhookSecret != "" {
+		return nil
+	}
+
+	if err := p.savePluginConfigValue("WebhookSecret", model.NewId()); err != nil {
+		return errors.Wrap(err, "failed to generate webhook secret")
+	}
+
 	return nil
 }
 
@@ -44,5 +86,7 @@ func (p *Plugin) OnActivate() error {
 //
 // This demo implementation logs a message to the demo channel whenever the plugin is deactivated.
 func (p *Plugin) OnDeactivate() error {
+	p.stopJobs()
+
 	return nil
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// autocompletePath is followed by the kind of suggestions, as Mattermost replaces the query
+	// of dynamic argument URLs with the command typed so far
+	autocompletePath = "/autocomplete/"
+
+	autocompleteProjects   = "projects"
+	autocompleteBuildTypes = "buildtypes"
+	autocompleteTargets    = "targets"
+	autocompleteBuilds     = "builds"
+	autocompleteBranches   = "branches"
+	autocompleteServers    = "servers"
+
+	// maxAutocompleteItems limits the suggestions returned for an argument
+	maxAutocompleteItems = 25
+	// autocompleteCacheTTL is how long suggestions fetched from TeamCity are reused. Users type
+	// several characters per second, each of them asking for suggestions.
+	autocompleteCacheTTL        = time.Minute
+	maxAutocompleteCacheEntries = 1000
+)
+
+// autocompleteCache remembers suggestions fetched from TeamCity, keyed by user, server, kind
+// and scope, as users may see different projects
+type autocompleteCache struct {
+	sync.Mutex
+	entries map[string]*autocompleteCacheEntry
+}
+
+type autocompleteCacheEntry struct {
+	items   []model.AutocompleteListItem
+	expires time.Time
+}
+
+func (c *autocompleteCache) get(key string) ([]model.AutocompleteListItem, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.items, true
+}
+
+func (c *autocompleteCache) set(key string, items []model.AutocompleteListItem) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.entries == nil || len(c.entries) >= maxAutocompleteCacheEntries {
+		c.entries = map[string]*autocompleteCacheEntry{}
+	}
+
+	c.entries[key] = &autocompleteCacheEntry{items: items, expires: time.Now().Add(autocompleteCacheTTL)}
+}
+
+func autocompleteURL(kind string) string {
+	return autocompletePath + kind
+}
+
+// getAutocompleteData returns the autocomplete tree of the slash command, generated from
+// commandTree. Arguments taking project, build configuration and build IDs, branches and server
+// names are suggested by handleAutocomplete.
+func getAutocompleteData(trigger string) *model.AutocompleteData {
+	root := commandTree()
+
+	var names []string
+	for _, command := range root.SubCommands {
+		names = append(names, command.Name)
+	}
+	root.Help = "Available commands: " + strings.Join(names, ", ")
+
+	data := root.autocompleteData(trigger)
+	data.Hint = "[command]"
+
+	return data
+}
+
+// handleAutocomplete returns suggestions for a dynamic argument of the slash command. Mattermost
+// sends the command typed so far in the parsed and user_input query parameters. Suggestions are
+// fetched with the user's TeamCity token, and nothing is suggested to users who may not read
+// from TeamCity.
+func (p *Plugin) handleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	parsed := query.Get("parsed")
+
+	_, positional, flags := parseCommandLine(parsed)
+
+	// Newer Mattermost servers send the channel, so the server and project of the channel apply
+	args := &model.CommandArgs{
+		UserId:    userID,
+		ChannelId: query.Get("channel_id"),
+		TeamId:    query.Get("team_id"),
+		Command:   strings.TrimSpace(parsed),
+	}
+
+	typed := strings.TrimLeft(strings.TrimPrefix(query.Get("user_input"), parsed), " ")
+	if space := strings.Index(typed, " "); space >= 0 {
+		typed = typed[:space]
+	}
+
+	kind := strings.TrimPrefix(r.URL.Path, autocompletePath)
+
+	items, err := p.autocompleteItems(kind, args, positional, flags)
+	if err != nil {
+		p.API.LogDebug("Could not get autocomplete suggestions", "kind", kind, "user_id", userID, "error", err.Error())
+	}
+
+	writeJSON(w, filterAutocompleteItems(items, typed))
+}
+
+// filterAutocompleteItems returns the first items starting with what the user typed
+func filterAutocompleteItems(items []model.AutocompleteListItem, typed string) []model.AutocompleteListItem {
+	filtered := []model.AutocompleteListItem{}
+
+	for _, item := range items {
+		if len(filtered) == maxAutocompleteItems {
+			break
+		}
+
+		if strings.HasPrefix(strings.ToLower(item.Item), strings.ToLower(typed)) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
+}
+
+// autocompleteItems returns all suggestions of a kind. positional and flags are the arguments
+// typed before the argument to suggest.
+func (p *Plugin) autocompleteItems(kind string, args *model.CommandArgs, positional []string, flags commandFlags) ([]model.AutocompleteListItem, error) {
+	configuration := p.getConfiguration()
+
+	if kind == autocompleteServers {
+		var items []model.AutocompleteListItem
+		for _, server := range configuration.GetServers() {
+			items = append(items, model.AutocompleteListItem{Item: server.Name, HelpText: server.URL})
+		}
+		return items, nil
+	}
+
+	server := configuration.GetServer(p.commandServerName(args, flags))
+	if server == nil || !server.Installed() {
+		return nil, nil
+	}
+
+	client, err := p.clientFor(args.UserId, server, false)
+	if err != nil {
+		return nil, err
+	}
+
+	projectID := ""
+	if project := p.commandProject(args, server, flags); project != nil {
+		projectID = project.ProjectID
+	}
+
+	scope := projectID
+	if kind == autocompleteBranches {
+		// build start <build_type_id> --branch
+		if len(positional) < 1 {
+			return nil, nil
+		}
+		scope = positional[0]
+		if projectID != "" {
+			scope = p.projectBuildTypeID(client, projectID, scope)
+		}
+	}
+
+	cacheKey := strings.Join([]string{args.UserId, server.Name, kind, scope}, "\x00")
+	if items, ok := p.autocomplete.get(cacheKey); ok {
+		return items, nil
+	}
+
+	var items []model.AutocompleteListItem
+
+	switch kind {
+	case autocompleteProjects:
+		items, err = projectItems(client)
+	case autocompleteBuildTypes:
+		items, err = buildTypeItems(client, scope)
+	case autocompleteTargets:
+		if items, err = projectItems(client); err == nil {
+			var buildTypes []model.AutocompleteListItem
+			buildTypes, err = buildTypeItems(client, scope)
+			items = append(items, buildTypes...)
+		}
+	case autocompleteBuilds:
+		items, err = buildItems(client, scope)
+	case autocompleteBranches:
+		items, err = branchItems(client, scope)
+	default:
+		return nil, errors.Errorf("unknown autocomplete kind %s", kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.autocomplete.set(cacheKey, items)
+
+	return items, nil
+}
+
+func projectItems(client TeamCityClient) ([]model.AutocompleteListItem, error) {
+	projects, err := client.GetProjects()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get projects")
+	}
+
+	var items []model.AutocompleteListItem
+	for _, project := range projects {
+		if project.ID == "_Root" {
+			continue
+		}
+		items = append(items, model.AutocompleteListItem{Item: project.ID, HelpText: project.Name})
+	}
+
+	return items, nil
+}
+
+// buildTypeItems suggests the build configurations of the subtree of a project, or all of them
+func buildTypeItems(client TeamCityClient, projectID string) ([]model.AutocompleteListItem, error) {
+	buildTypes, err := client.GetBuildTypes(projectLocator(projectID))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get build configurations")
+	}
+
+	var items []model.AutocompleteListItem
+	for _, buildType := range buildTypes {
+		items = append(items, model.AutocompleteListItem{Item: buildType.ID, HelpText: buildType.ProjectName + " / " + buildType.Name})
+	}
+
+	return items, nil
+}
+
+// buildItems suggests the latest builds of a project, or of all projects, including running ones
+func buildItems(client TeamCityClient, projectID string) ([]model.AutocompleteListItem, error) {
+	locator := fmt.Sprintf("running:any,count:%d", maxAutocompleteItems)
+	if projectID != "" {
+		locator = projectLocator(projectID) + "," + locator
+	}
+
+	builds, err := client.GetBuilds(locator)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get builds")
+	}
+
+	var items []model.AutocompleteListItem
+	for _, build := range builds {
+		status := build.Status
+		if build.State != "finished" {
+			status = build.State
+		}
+
+		items = append(items, model.AutocompleteListItem{
+			Item:     strconv.FormatInt(build.ID, 10),
+			HelpText: fmt.Sprintf("%s #%s - %s", build.BuildTypeID, build.Number, strings.ToLower(status)),
+		})
+	}
+
+	return items, nil
+}
+
+// branchItems suggests the branches of a build configuration, the default branch first
+func branchItems(client TeamCityClient, buildTypeID string) ([]model.AutocompleteListItem, error) {
+	branches, err := client.GetBranches(buildTypeID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get branches")
+	}
+
+	sort.SliceStable(branches, func(i, j int) bool { return branches[i].Default && !branches[j].Default })
+
+	var items []model.AutocompleteListItem
+	for _, branch := range branches {
+		item := model.AutocompleteListItem{Item: branch.Name}
+		if branch.Default {
+			item.HelpText = "Default branch"
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
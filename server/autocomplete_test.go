@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestAutocompleteData(t *testing.T) {
+	assert := assert.New(t)
+
+	data := getAutocompleteData(commandTriggerHooks)
+	assert.Nil(data.IsValid())
+
+	var triggers []string
+	for _, command := range data.SubCommands {
+		triggers = append(triggers, command.Trigger)
+	}
+
+	for _, trigger := range []string{commandTriggerInstall, commandTriggerServers, commandTriggerConnect, commandTriggerChannel, commandTriggerList, commandTriggerBuild, commandTriggerStats, commandTriggerSubscribe, commandTriggerUnsubscribe} {
+		assert.Contains(triggers, trigger)
+	}
+}
+
+// autocomplete requests suggestions like the Mattermost server does while the user types
+func autocomplete(plugin *Plugin, userID, kind, parsed, typed string) (int, []model.AutocompleteListItem) {
+	query := url.Values{"parsed": {parsed}, "user_input": {parsed + typed}}
+
+	r := httptest.NewRequest(http.MethodGet, autocompletePath+kind+"?"+query.Encode(), nil)
+	if userID != "" {
+		r.Header.Set("Mattermost-User-Id", userID)
+	}
+
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, r)
+
+	var items []model.AutocompleteListItem
+	_ = json.NewDecoder(w.Body).Decode(&items)
+
+	return w.Code, items
+}
+
+func TestAutocomplete(t *testing.T) {
+	assert := assert.New(t)
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	userID := generateArgs("").UserId
+
+	code, _ := autocomplete(plugin, "", autocompleteProjects, "/teamcity channel link ", "")
+	assert.Equal(http.StatusUnauthorized, code)
+
+	_, items := autocomplete(plugin, userID, autocompleteProjects, "/teamcity channel link ", "web")
+	assert.Equal([]model.AutocompleteListItem{{Item: "Website", HelpText: "Website"}}, items)
+
+	_, items = autocomplete(plugin, userID, autocompleteBuildTypes, "/teamcity build start ", "")
+	assert.Equal([]model.AutocompleteListItem{
+		{Item: "MattermostTeamcityPlugin_TestBuild", HelpText: "Mattermost TeamCity Plugin / Test Build"},
+		{Item: "Website_Deploy", HelpText: "Website / Deploy"},
+	}, items)
+
+	_, items = autocomplete(plugin, userID, autocompleteBranches, "/teamcity build start MattermostTeamcityPlugin_TestBuild --branch ", "")
+	assert.Equal([]model.AutocompleteListItem{{Item: "main", HelpText: "Default branch"}, {Item: "feature/x"}}, items)
+
+	_, items = autocomplete(plugin, userID, autocompleteBuilds, "/teamcity build cancel ", "")
+	if assert.Len(items, 3, "running builds are suggested too") {
+		assert.Equal("MattermostTeamcityPlugin_TestBuild #3 - running", items[0].HelpText)
+		assert.Equal("2", items[1].Item)
+		assert.Equal("MattermostTeamcityPlugin_TestBuild #2 - failure", items[1].HelpText)
+	}
+
+	_, items = autocomplete(plugin, userID, autocompleteServers, "/teamcity build cancel 2 --server ", "")
+	assert.Equal([]model.AutocompleteListItem{{Item: defaultServerName, HelpText: teamCity.URL}}, items)
+
+	// Suggestions are cached
+	teamCity.Close()
+	_, items = autocomplete(plugin, userID, autocompleteProjects, "/teamcity channel link ", "")
+	assert.Len(items, 2)
+
+	// Users who did not connect their account get no suggestions
+	_, items = autocomplete(plugin, "other-user", autocompleteProjects, "/teamcity channel link ", "")
+	assert.Empty(items)
+}
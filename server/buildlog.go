@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	commandTriggerBuildLog = "log"
+
+	defaultLogTail    = 50
+	maxLogTail        = 10000
+	defaultLogContext = 2
+	maxLogContext     = 20
+	// maxLogMatches limits the matching lines posted when searching a build log
+	maxLogMatches = 500
+	// maxLogLineLength truncates the lines of a build log, e.g. base64 encoded output
+	maxLogLineLength = 2000
+
+	// Excerpts of build logs longer than this are attached as a file instead of a code block
+	maxInlineLogLines  = 50
+	maxInlineLogLength = 8000
+)
+
+// buildLogOptions select the lines of a build log to post: the last Tail lines, or the lines
+// matching Grep with Context lines around them
+type buildLogOptions struct {
+	Tail    int
+	Grep    *regexp.Regexp
+	Pattern string
+	Context int
+}
+
+// logExcerpt are the selected lines of a build log
+type logExcerpt struct {
+	Lines []string
+	// Matches is the number of lines matching the pattern, if searching
+	Matches int
+	// Truncated is set if only the first maxLogMatches matches are included
+	Truncated bool
+}
+
+// parseBuildLogOptions reads the options of `/teamcity build log`, returning a message for the
+// user if they are invalid
+func parseBuildLogOptions(flags commandFlags) (*buildLogOptions, string) {
+	options := &buildLogOptions{Tail: defaultLogTail, Context: defaultLogContext}
+
+	var problem string
+	if options.Tail, problem = logLineCount(flags, "tail", defaultLogTail, 1, maxLogTail); problem != "" {
+		return nil, problem
+	}
+	if options.Context, problem = logLineCount(flags, "context", defaultLogContext, 0, maxLogContext); problem != "" {
+		return nil, problem
+	}
+
+	if options.Pattern = flags.String("grep"); options.Pattern != "" {
+		re, err := regexp.Compile("(?i)" + options.Pattern)
+		if err != nil {
+			return nil, "Invalid pattern `" + options.Pattern + "`: " + err.Error()
+		}
+		options.Grep = re
+	}
+
+	return options, ""
+}
+
+// logLineCount reads a flag giving a number of lines between min and max
+func logLineCount(flags commandFlags, name string, defaultValue, min, max int) (int, string) {
+	value := flags.String(name)
+	if value == "" {
+		return defaultValue, ""
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < min || count > max {
+		return 0, fmt.Sprintf("Invalid number of lines for `--%s`: `%s`, use %d to %d", name, value, min, max)
+	}
+
+	return count, ""
+}
+
+// readLogLines calls fn with each line of a build log, without line endings and truncated to
+// maxLogLineLength, so that lines of any length are read without keeping them in memory
+func readLogLines(r io.Reader, fn func(line string)) error {
+	reader := bufio.NewReader(r)
+	var line []byte
+
+	for {
+		fragment, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			if len(line) > 0 {
+				fn(string(line))
+			}
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not read build log")
+		}
+
+		if room := maxLogLineLength - len(line); room > 0 {
+			if len(fragment) > room {
+				fragment = fragment[:room]
+			}
+			line = append(line, fragment...)
+		}
+
+		if !isPrefix {
+			fn(string(bytes.TrimRight(line, "\r")))
+			line = line[:0]
+		}
+	}
+}
+
+// tailLog returns the last n lines of a build log
+func tailLog(r io.Reader, n int) (*logExcerpt, error) {
+	ring := make([]string, 0, n)
+	next := 0
+
+	err := readLogLines(r, func(line string) {
+		if len(ring) < n {
+			ring = append(ring, line)
+			return
+		}
+		ring[next] = line
+		next = (next + 1) % n
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &logExcerpt{Lines: append(ring[next:], ring[:next]...)}, nil
+}
+
+// grepLog returns the lines of a build log matching re with context lines before and after
+// them, numbered like `grep -n`: matches as `12: line`, context as `11- line`, and groups
+// that are not adjacent separated by `--`
+func grepLog(r io.Reader, re *regexp.Regexp, context int) (*logExcerpt, error) {
+	excerpt := &logExcerpt{}
+
+	var before []string
+	number, last, after := 0, 0, 0
+
+	err := readLogLines(r, func(line string) {
+		number++
+
+		if !re.MatchString(line) {
+			if after > 0 {
+				excerpt.Lines = append(excerpt.Lines, fmt.Sprintf("%d- %s", number, line))
+				last = number
+				after--
+			} else if context > 0 {
+				before = append(before, line)
+				if len(before) > context {
+					before = before[1:]
+				}
+			}
+			return
+		}
+
+		excerpt.Matches++
+		if excerpt.Matches > maxLogMatches {
+			excerpt.Truncated = true
+			after = 0
+			return
+		}
+
+		first := number - len(before)
+		if last > 0 && first > last+1 {
+			excerpt.Lines = append(excerpt.Lines, "--")
+		}
+		for i, line := range before {
+			excerpt.Lines = append(excerpt.Lines, fmt.Sprintf("%d- %s", first+i, line))
+		}
+		before = before[:0]
+
+		excerpt.Lines = append(excerpt.Lines, fmt.Sprintf("%d: %s", number, line))
+		last = number
+		after = context
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return excerpt, nil
+}
+
+// readBuildLog downloads the log of a build and selects the lines to post
+func readBuildLog(client TeamCityClient, buildID int64, options *buildLogOptions) (*logExcerpt, error) {
+	log, err := client.GetBuildLog(buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+
+	if options.Grep != nil {
+		return grepLog(log, options.Grep, options.Context)
+	}
+
+	return tailLog(log, options.Tail)
+}
+
+// postBuildLog posts an excerpt of the log of a build as the plugin bot, in a code block or,
+// if it is too long for one, as an attached file
+func (p *Plugin) postBuildLog(channelID, rootID string, client TeamCityClient, build *tcBuild, options *buildLogOptions, excerpt *logExcerpt) error {
+	title := fmt.Sprintf("[%s #%s](%s)", build.BuildType.Name, build.Number, build.WebURL)
+	if options.Grep != nil {
+		title = fmt.Sprintf("Lines of the log of %s matching `%s`", title, options.Pattern)
+	} else {
+		title = fmt.Sprintf("Last %d lines of the log of %s", len(excerpt.Lines), title)
+	}
+	title += fmt.Sprintf(" ([full log](%s))", client.BuildLogURL(build.ID))
+
+	if excerpt.Truncated {
+		title += fmt.Sprintf("\n_Showing the first %d of %d matching lines_", maxLogMatches, excerpt.Matches)
+	}
+
+	text := strings.Join(excerpt.Lines, "\n")
+
+	post := &model.Post{
+		UserId:    p.botUserID,
+		ChannelId: channelID,
+		RootId:    rootID,
+	}
+
+	if len(excerpt.Lines) <= maxInlineLogLines && len(text) <= maxInlineLogLength {
+		// Code blocks end at the first line starting with a fence
+		post.Message = title + "\n```\n" + strings.Replace(text, "```", "` ` `", -1) + "\n```"
+	} else {
+		info, appErr := p.API.UploadFile([]byte(text+"\n"), channelID, fmt.Sprintf("build-%d-log.txt", build.ID))
+		if appErr != nil {
+			return errors.Wrap(appErr, "could not upload the build log")
+		}
+
+		post.Message = title
+		post.FileIds = []string{info.Id}
+	}
+
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return errors.Wrap(appErr, "could not post the build log")
+	}
+
+	return nil
+}
+
+// buildLogProblem returns the message for a build log excerpt with no lines, or "" if there are
+func buildLogProblem(buildID int64, options *buildLogOptions, excerpt *logExcerpt) string {
+	if len(excerpt.Lines) > 0 {
+		return ""
+	}
+
+	if options.Grep != nil {
+		return fmt.Sprintf("No lines of the log of build %d match `%s`", buildID, options.Pattern)
+	}
+
+	return fmt.Sprintf("The log of build %d is empty", buildID)
+}
+
+func (p *Plugin) executeCommandTriggerBuildLog(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	options, problem := parseBuildLogOptions(input.Flags)
+	if problem != "" {
+		return p.postEphemeral(problem)
+	}
+
+	client, _, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	buildID := input.Int("build_id")
+
+	build, err := client.GetBuild(buildID)
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral(fmt.Sprintf("Build not found: %d", buildID))
+	}
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting build: `%s`", err.Error()))
+	}
+
+	excerpt, err := readBuildLog(client, buildID, options)
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral(fmt.Sprintf("The log of build %d is not available", buildID))
+	}
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting the build log: `%s`", err.Error()))
+	}
+
+	if problem = buildLogProblem(buildID, options, excerpt); problem != "" {
+		return p.postEphemeral(problem)
+	}
+
+	if err = p.postBuildLog(args.ChannelId, args.RootId, client, build, options, excerpt); err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error posting the build log: `%s`", err.Error()))
+	}
+
+	return &model.CommandResponse{}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestTailLog(t *testing.T) {
+	assert := assert.New(t)
+
+	excerpt, err := tailLog(strings.NewReader("one\r\ntwo\nthree\nfour"), 2)
+	assert.Nil(err)
+	assert.Equal([]string{"three", "four"}, excerpt.Lines)
+
+	excerpt, err = tailLog(strings.NewReader("one\r\ntwo\n"), 5)
+	assert.Nil(err)
+	assert.Equal([]string{"one", "two"}, excerpt.Lines)
+
+	excerpt, err = tailLog(strings.NewReader(strings.Repeat("x", 10000)+"\nlast\n"), 5)
+	assert.Nil(err)
+	assert.Len(excerpt.Lines, 2)
+	assert.Len(excerpt.Lines[0], maxLogLineLength, "long lines are truncated")
+	assert.Equal("last", excerpt.Lines[1])
+}
+
+func TestGrepLog(t *testing.T) {
+	assert := assert.New(t)
+
+	log := "a\nb\nerror 1\nc\nd\ne\nf\ng\nERROR 2\nerror 3\nh\n"
+
+	excerpt, err := grepLog(strings.NewReader(log), regexp.MustCompile("(?i)error"), 1)
+	assert.Nil(err)
+	assert.Equal(3, excerpt.Matches)
+	assert.False(excerpt.Truncated)
+	assert.Equal([]string{
+		"2- b",
+		"3: error 1",
+		"4- c",
+		"--",
+		"8- g",
+		"9: ERROR 2",
+		"10: error 3",
+		"11- h",
+	}, excerpt.Lines)
+
+	excerpt, err = grepLog(strings.NewReader(log), regexp.MustCompile("error"), 0)
+	assert.Nil(err)
+	assert.Equal([]string{"3: error 1", "--", "10: error 3"}, excerpt.Lines)
+
+	excerpt, err = grepLog(strings.NewReader(strings.Repeat("error\n", maxLogMatches+10)), regexp.MustCompile("error"), 2)
+	assert.Nil(err)
+	assert.Equal(maxLogMatches+10, excerpt.Matches)
+	assert.True(excerpt.Truncated)
+	assert.Len(excerpt.Lines, maxLogMatches)
+}
+
+func TestBuildLogCommand(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	var posted *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		posted = post
+		return post
+	}, nil)
+	api.On("UploadFile", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(&model.FileInfo{Id: "file"}, nil)
+
+	response := plugin.executeCommandHooks(generateArgs("build log 2 --tail=3"))
+	assert.Empty(response.Text)
+	assert.Contains(posted.Message, "Last 3 lines of the log of [Test Build #2](http://teamcity/viewLog.html?buildId=2)")
+	assert.Contains(posted.Message, "([full log]("+teamCity.URL+"/viewLog.html?buildId=2&tab=buildLog))")
+	assert.True(strings.HasSuffix(posted.Message, "```\n[10:00:23]E: [Step 2/2] Process exited with code 1\n[10:00:24]E: Step Test (Command Line) failed\n[10:00:25] : Publishing artifacts\n```"))
+	assert.Empty(posted.FileIds)
+
+	response = plugin.executeCommandHooks(generateArgs("build log 2 --grep fail --context=0"))
+	assert.Empty(response.Text)
+	assert.Contains(posted.Message, "Lines of the log of [Test Build #2](http://teamcity/viewLog.html?buildId=2) matching `fail`")
+	assert.Contains(posted.Message, "9: [10:00:22] : [Step 2/2] --- FAIL: TestBuildLog (0.01s)\n--\n11: [10:00:23] : [Step 2/2] FAIL\n--\n13: [10:00:24]E: Step Test (Command Line) failed\n```")
+
+	response = plugin.executeCommandHooks(generateArgs("build log 2 --grep=segfault"))
+	assert.Equal("No lines of the log of build 2 match `segfault`", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("build log 2 --grep=(fail"))
+	assert.Contains(response.Text, "Invalid pattern `(fail`")
+
+	response = plugin.executeCommandHooks(generateArgs("build log 2 --tail=0"))
+	assert.Equal(fmt.Sprintf("Invalid number of lines for `--tail`: `0`, use 1 to %d", maxLogTail), response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("build log 1"))
+	assert.Equal("The log of build 1 is not available", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("build log 99"))
+	assert.Equal("Build not found: 99", response.Text)
+
+	// Long excerpts are attached as a file
+	var log, tail bytes.Buffer
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&log, "line %d\n", i)
+		if i > 100 {
+			fmt.Fprintf(&tail, "line %d\n", i)
+		}
+	}
+	teamCity.logs[1] = log.String()
+
+	response = plugin.executeCommandHooks(generateArgs("build log 1 --tail=100"))
+	assert.Empty(response.Text)
+	assert.Equal(model.StringArray{"file"}, posted.FileIds)
+	assert.NotContains(posted.Message, "```")
+	api.AssertCalled(t, "UploadFile", tail.Bytes(), generateArgs("").ChannelId, "build-1-log.txt")
+}
+
+func TestShowLogTailAction(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("")
+	api.On("GetUser", args.UserId).Return(&model.User{Id: args.UserId, Username: "alice"}, nil)
+	api.On("GetPost", "post").Return(&model.Post{Id: "post", ChannelId: args.ChannelId}, nil)
+
+	var posted *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		posted = post
+		return post
+	}, nil)
+
+	failed := plugin.buildEventActions(&buildEvent{Kind: eventFailed, BuildID: 2})
+	assert.Equal(buildActionNames[buildActionLog], failed[len(failed)-1].Name)
+
+	for _, action := range plugin.buildEventActions(&buildEvent{Kind: eventSucceeded, BuildID: 1}) {
+		assert.NotEqual(buildActionLog, action.Integration.Context["action"], "only failed builds offer the log")
+	}
+
+	body, _ := json.Marshal(&model.PostActionIntegrationRequest{
+		UserId:    args.UserId,
+		ChannelId: args.ChannelId,
+		PostId:    "post",
+		Context:   failed[len(failed)-1].Integration.Context,
+	})
+
+	r := httptest.NewRequest(http.MethodPost, buildActionPath, bytes.NewReader(body))
+	r.Header.Set("Mattermost-User-Id", args.UserId)
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(nil, w, r)
+
+	var response model.PostActionIntegrationResponse
+	assert.Nil(json.NewDecoder(w.Body).Decode(&response))
+	assert.Empty(response.EphemeralText)
+	assert.Nil(response.Update, "the build post is not changed")
+
+	assert.Equal("post", posted.RootId, "the log is posted in the thread of the build post")
+	assert.Contains(posted.Message, "Last 14 lines of the log of [Test Build #2]")
+}
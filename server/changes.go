@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	commandTriggerBuildChanges = "changes"
+
+	// maxChangesBuilds limits the failed builds whose changes are collected since the last
+	// successful build
+	maxChangesBuilds = 20
+	// maxNotificationChanges limits the changes listed in failure notifications, and
+	// maxCommandChanges the changes listed by /teamcity build changes
+	maxNotificationChanges = 10
+	maxCommandChanges      = 50
+	// maxChangeCommentLength truncates the first line of change comments
+	maxChangeCommentLength = 100
+)
+
+// buildChange is a VCS change with the Mattermost user of its author, if known
+type buildChange struct {
+	*tcChange
+	AuthorID       string
+	AuthorUsername string
+}
+
+// changeSummary are VCS changes of builds, up to a limit
+type changeSummary struct {
+	Changes []*buildChange
+	// More is the number of changes left out, which URL lists
+	More int
+	URL  string
+}
+
+// branchLocator returns the branch dimension of the builds of the branch of a build
+func branchLocator(build *tcBuild) string {
+	if build.DefaultBranch || build.BranchName == "" {
+		return "(default:true)"
+	}
+
+	return "(name:" + locatorValue(build.BranchName) + ")"
+}
+
+// changesSinceLastSuccess returns the changes of a build and of the builds of its configuration
+// and branch since the last successful one, newest first
+func changesSinceLastSuccess(client TeamCityClient, build *tcBuild) ([]*tcChange, error) {
+	buildTypeID := build.BuildTypeID
+	if buildTypeID == "" {
+		buildTypeID = build.BuildType.ID
+	}
+	scope := fmt.Sprintf("buildType:(id:%s),branch:%s", buildTypeID, branchLocator(build))
+
+	buildIDs := []int64{build.ID}
+
+	lastSuccess, err := client.GetBuilds(fmt.Sprintf("%s,status:SUCCESS,untilBuild:(id:%d),count:1", scope, build.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get the last successful build")
+	}
+
+	if len(lastSuccess) > 0 {
+		failed, err := client.GetBuilds(fmt.Sprintf("%s,sinceBuild:(id:%d),untilBuild:(id:%d),count:%d", scope, lastSuccess[0].ID, build.ID, maxChangesBuilds))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get the builds since the last successful one")
+		}
+
+		for _, failedBuild := range failed {
+			if failedBuild.ID != build.ID {
+				buildIDs = append(buildIDs, failedBuild.ID)
+			}
+		}
+	}
+
+	var changes []*tcChange
+	seen := map[int64]bool{}
+	for _, buildID := range buildIDs {
+		buildChanges, err := client.GetChanges(fmt.Sprintf("build:(id:%d)", buildID))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get the changes of build %d", buildID)
+		}
+
+		for _, change := range buildChanges {
+			if !seen[change.ID] {
+				seen[change.ID] = true
+				changes = append(changes, change)
+			}
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].ID > changes[j].ID })
+
+	return changes, nil
+}
+
+// parseVCSUsername splits a VCS username like "Jane Doe <jane@example.com>" into the name and
+// the email address
+func parseVCSUsername(username string) (string, string) {
+	if address, err := mail.ParseAddress(username); err == nil {
+		return address.Name, address.Address
+	}
+
+	return strings.TrimSpace(username), ""
+}
+
+// changeAuthor returns the Mattermost user who authored a change, or nil if unknown. Authors are
+// found by the TeamCity account they connected, then by email address. Anyone who can push a
+// commit chooses its author name, so matching usernames is left to the administrator to enable.
+func (p *Plugin) changeAuthor(server string, change *tcChange) *model.User {
+	name, email := parseVCSUsername(change.Username)
+
+	var emails, usernames []string
+	if change.User != nil {
+		if userID := p.connectedUser(server, change.User.Username); userID != "" {
+			if user, appErr := p.API.GetUser(userID); appErr == nil && user.DeleteAt == 0 {
+				return user
+			}
+		}
+
+		emails = append(emails, change.User.Email)
+		usernames = append(usernames, change.User.Username)
+	}
+	emails = append(emails, email)
+	if !strings.ContainsAny(name, " @") {
+		usernames = append(usernames, name)
+	}
+
+	for _, email := range emails {
+		if email == "" {
+			continue
+		}
+		if user, appErr := p.API.GetUserByEmail(email); appErr == nil && user.DeleteAt == 0 {
+			return user
+		}
+	}
+
+	if !p.getConfiguration().MatchChangeAuthorsByUsername {
+		return nil
+	}
+
+	for _, username := range usernames {
+		if username == "" {
+			continue
+		}
+		if user, appErr := p.API.GetUserByUsername(strings.ToLower(username)); appErr == nil && user.DeleteAt == 0 {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// resolveChangeAuthors finds the Mattermost users of the authors of changes
+func (p *Plugin) resolveChangeAuthors(server string, changes []*tcChange) []*buildChange {
+	authors := map[string]*model.User{}
+
+	var resolved []*buildChange
+	for _, change := range changes {
+		key := change.Username
+		if change.User != nil {
+			key += "\x00" + change.User.Username
+		}
+
+		user, found := authors[key]
+		if !found {
+			user = p.changeAuthor(server, change)
+			authors[key] = user
+		}
+
+		resolvedChange := &buildChange{tcChange: change}
+		if user != nil {
+			resolvedChange.AuthorID, resolvedChange.AuthorUsername = user.Id, user.Username
+		}
+		resolved = append(resolved, resolvedChange)
+	}
+
+	return resolved
+}
+
+// newChangeSummary keeps the first limit changes and finds the Mattermost users of their
+// authors. url lists all changes.
+func (p *Plugin) newChangeSummary(server string, changes []*tcChange, limit int, url string) *changeSummary {
+	summary := &changeSummary{URL: url}
+
+	if len(changes) > limit {
+		summary.More = len(changes) - limit
+		changes = changes[:limit]
+	}
+
+	summary.Changes = p.resolveChangeAuthors(server, changes)
+
+	return summary
+}
+
+// Markdown lists the changes with their revision, author, comment and number of files,
+// followed by a link to all changes if some were left out
+func (s *changeSummary) Markdown() string {
+	var lines []string
+	for _, change := range s.Changes {
+		lines = append(lines, " - "+change.Markdown())
+	}
+
+	if s.More > 0 {
+		lines = append(lines, fmt.Sprintf("_and %d more._ [All changes](%s)", s.More, s.URL))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Markdown describes a change, e.g. "[`1a2b3c4`](url) @jane: Fix the build (2 files)"
+func (c *buildChange) Markdown() string {
+	revision := "`" + shortRevision(c.Version) + "`"
+	if c.WebURL != "" {
+		revision = "[" + revision + "](" + c.WebURL + ")"
+	}
+
+	return fmt.Sprintf("%s %s: %s (%s)", revision, c.Author(), changeComment(c.Comment), pluralize(c.Files.Count, "file"))
+}
+
+// Author returns the @mention of the Mattermost user of the author if known, or the name
+// from TeamCity
+func (c *buildChange) Author() string {
+	if c.AuthorUsername != "" {
+		return "@" + c.AuthorUsername
+	}
+
+	if c.User != nil && c.User.Name != "" {
+		return c.User.Name
+	}
+
+	if name, email := parseVCSUsername(c.Username); name != "" {
+		return name
+	} else if email != "" {
+		return email
+	}
+
+	return "Unknown author"
+}
+
+// shortRevision abbreviates Git and Mercurial hashes, keeping short revisions like Subversion's
+func shortRevision(version string) string {
+	if len(version) > 12 {
+		return version[:7]
+	}
+
+	return version
+}
+
+// changeComment returns the first line of a change comment
+func changeComment(comment string) string {
+	comment = strings.TrimSpace(comment)
+
+	truncated := false
+	if newline := strings.Index(comment, "\n"); newline >= 0 {
+		comment, truncated = strings.TrimSpace(comment[:newline]), true
+	}
+	if runes := []rune(comment); len(runes) > maxChangeCommentLength {
+		comment, truncated = string(runes[:maxChangeCommentLength]), true
+	}
+
+	if comment == "" {
+		return "_No comment_"
+	}
+	if truncated {
+		comment += " …"
+	}
+
+	return comment
+}
+
+func pluralize(count int, noun string) string {
+	if count == 1 {
+		return "1 " + noun
+	}
+
+	return fmt.Sprintf("%d %ss", count, noun)
+}
+
+// fillBuildChanges adds the changes since the last successful build to the event of a failed
+// build
+func (p *Plugin) fillBuildChanges(event *buildEvent) {
+	if event.Kind != eventFailed || event.BuildID == 0 {
+		return
+	}
+
+	client, err := p.serverClient(event.Server)
+	if err != nil {
+		p.API.LogWarn("Could not get build changes", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	build, err := client.GetBuild(event.BuildID)
+	if err != nil {
+		p.API.LogWarn("Could not get build changes", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	changes, err := changesSinceLastSuccess(client, build)
+	if err != nil {
+		p.API.LogWarn("Could not get build changes", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	event.Changes = p.newChangeSummary(event.Server, changes, maxNotificationChanges, client.BuildChangesURL(build.ID))
+}
+
+func (p *Plugin) executeCommandTriggerBuildChanges(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	client, server, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	buildID := input.Int("build_id")
+
+	build, err := client.GetBuild(buildID)
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral(fmt.Sprintf("Build not found: %d", buildID))
+	}
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting build: `%s`", err.Error()))
+	}
+
+	changes, err := client.GetChanges(fmt.Sprintf("build:(id:%d)", buildID))
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting build changes: `%s`", err.Error()))
+	}
+
+	title := fmt.Sprintf("[%s #%s](%s)", build.BuildType.Name, build.Number, build.WebURL)
+	if len(changes) == 0 {
+		return p.postEphemeral(title + " has no changes")
+	}
+
+	summary := p.newChangeSummary(server.Name, changes, maxCommandChanges, client.BuildChangesURL(buildID))
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_IN_CHANNEL,
+		Text:         fmt.Sprintf("**Changes of %s** (%s):\n%s", title, pluralize(len(changes), "change"), summary.Markdown()),
+	}
+}
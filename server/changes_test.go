@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestParseVCSUsername(t *testing.T) {
+	assert := assert.New(t)
+
+	for username, expected := range map[string][2]string{
+		"Jane Doe <jane@example.com>": {"Jane Doe", "jane@example.com"},
+		"jane@example.com":            {"", "jane@example.com"},
+		"jdoe":                        {"jdoe", ""},
+		" DOMAIN\\jdoe ":              {"DOMAIN\\jdoe", ""},
+	} {
+		name, email := parseVCSUsername(username)
+		assert.Equal(expected, [2]string{name, email}, username)
+	}
+}
+
+func TestChangeAuthor(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("")
+	api.On("GetUser", args.UserId).Return(&model.User{Id: args.UserId, Username: "admin.user"}, nil)
+
+	author := func(change *tcChange) string {
+		if user := plugin.changeAuthor(defaultServerName, change); user != nil {
+			return user.Username
+		}
+		return ""
+	}
+
+	// The user of generateArgs connected the TeamCity account admin
+	assert.Equal("admin.user", author(&tcChange{Username: "root", User: &tcUser{Username: "admin"}}))
+	assert.Equal("jane", author(&tcChange{Username: "Jane Doe <jane@example.com>"}))
+
+	// Anyone can commit as bob
+	assert.Empty(author(&tcChange{Username: "bob"}), "usernames are not matched by default")
+	assert.Empty(author(&tcChange{Username: "root", User: &tcUser{Username: "bob"}}))
+
+	configuration := plugin.getConfiguration().Clone()
+	configuration.MatchChangeAuthorsByUsername = true
+	plugin.setConfiguration(configuration)
+
+	assert.Equal("bob", author(&tcChange{Username: "bob"}))
+	assert.Equal("bob", author(&tcChange{Username: "root", User: &tcUser{Username: "bob"}}))
+}
+
+func TestBuildChangeMarkdown(t *testing.T) {
+	assert := assert.New(t)
+
+	change := &buildChange{tcChange: &tcChange{Version: "9b2e7d1c4a5f6e8d0c1b2a3f4e5d6c7b8a9f0e1d", Username: "Jane Doe <jane@example.com>", Comment: "Fix\nthe build", WebURL: "http://teamcity/change/1"}}
+	change.Files.Count = 1
+	assert.Equal("[`9b2e7d1`](http://teamcity/change/1) Jane Doe: Fix … (1 file)", change.Markdown())
+
+	change.AuthorUsername = "jane"
+	assert.Equal("[`9b2e7d1`](http://teamcity/change/1) @jane: Fix … (1 file)", change.Markdown())
+
+	svn := &buildChange{tcChange: &tcChange{Version: "1234", Username: "jdoe"}}
+	assert.Equal("`1234` jdoe: _No comment_ (0 files)", svn.Markdown())
+
+	summary := &changeSummary{Changes: []*buildChange{svn}, More: 3, URL: "http://teamcity/changes"}
+	assert.Equal(" - `1234` jdoe: _No comment_ (0 files)\n_and 3 more._ [All changes](http://teamcity/changes)", summary.Markdown())
+}
+
+func TestLocators(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("(default:true)", branchLocator(&tcBuild{BranchName: "main", DefaultBranch: true}))
+	assert.Equal("(name:$base64:ZmVhdHVyZS8oeCksZGVmYXVsdDp0cnVl)", branchLocator(&tcBuild{BranchName: "feature/(x),default:true"}))
+
+	_, err := idLocator("Backend_Build")
+	assert.Nil(err)
+	_, err = idLocator("X,project:(id:Other)")
+	assert.Equal(errNotFound, errors.Cause(err))
+}
+
+func TestChangesSinceLastSuccess(t *testing.T) {
+	assert := assert.New(t)
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	client := plugin.systemClient(plugin.getConfiguration().GetDefaultServer())
+
+	changes, err := changesSinceLastSuccess(client, teamCity.builds[2])
+	assert.Nil(err)
+	var ids []int64
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	assert.Equal([]int64{12, 11}, ids, "the changes of the last successful build are left out")
+
+	failedAgain := teamCity.addBuild("finished", "FAILURE", "Tests failed: 2")
+	teamCity.changes[failedAgain.ID] = []*tcChange{{ID: 13, Version: "13", Username: "bob"}}
+
+	changes, err = changesSinceLastSuccess(client, failedAgain)
+	assert.Nil(err)
+	ids = nil
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	assert.Equal([]int64{13, 12, 11}, ids, "the changes of earlier failed builds are included")
+}
+
+func TestBuildChangesCommand(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("build changes 2")
+	api.On("GetUser", args.UserId).Return(&model.User{Id: args.UserId, Username: "admin.user"}, nil)
+
+	// The user of generateArgs connected the TeamCity account admin
+	teamCity.changes[2] = append(teamCity.changes[2], &tcChange{ID: 9, Version: "9", Username: "root", User: &tcUser{Username: "admin"}})
+
+	response := plugin.executeCommandHooks(args)
+	assert.Equal(model.COMMAND_RESPONSE_TYPE_IN_CHANNEL, response.ResponseType)
+	assert.Equal("**Changes of [Test Build #2](http://teamcity/viewLog.html?buildId=2)** (3 changes):\n"+
+		" - [`9b2e7d1`](http://teamcity/change/12) @jane: Tail the build log … (3 files)\n"+
+		" - [`4d5e6f7`](http://teamcity/change/11) Carl: Fix typo (1 file)\n"+
+		" - `9` @admin.user: _No comment_ (0 files)", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("build changes 3"))
+	assert.Equal("[Test Build #3](http://teamcity/viewLog.html?buildId=3) has no changes", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("build changes 99"))
+	assert.Equal("Build not found: 99", response.Text)
+}
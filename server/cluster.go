@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const leaseKeyPrefix = "lease_"
+
+// leaseValue is stored under a lease key by the node currently holding the lease
+type leaseValue struct {
+	NodeID    string
+	ExpiresAt int64
+}
+
+// acquireLease makes sure this node holds the named lease for at least ttl, returning false if
+// another node holds it. Every node of a Mattermost cluster runs the plugin, so background
+// jobs take a lease before each run to make sure only one node runs them. The holder renews
+// the lease on every run; if it dies, another node takes over once the lease expired.
+func (p *Plugin) acquireLease(name string, ttl time.Duration) (bool, error) {
+	key := leaseKeyPrefix + name
+	now := time.Now()
+
+	current, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "could not load lease")
+	}
+
+	if current != nil {
+		var held leaseValue
+		if err := json.Unmarshal(current, &held); err != nil {
+			return false, errors.Wrap(err, "could not decode lease")
+		}
+
+		if held.NodeID != p.nodeID && held.ExpiresAt > model.GetMillisForTime(now) {
+			return false, nil
+		}
+	}
+
+	newValue, err := json.Marshal(&leaseValue{
+		NodeID:    p.nodeID,
+		ExpiresAt: model.GetMillisForTime(now.Add(ttl)),
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "could not encode lease")
+	}
+
+	// Leases are not given a KV store expiry: expired rows are hidden from KVGet but still
+	// block the insert until the server cleans them up. Expired leases are taken over by
+	// comparing their value instead, and the insert only fails if another node took the free
+	// lease first.
+	options := model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: current,
+	}
+
+	acquired, appErr := p.API.KVSetWithOptions(key, newValue, options)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "could not save lease")
+	}
+
+	return acquired, nil
+}
+
+// releaseLease gives up the named lease if this node holds it, so another node can take over
+// without waiting for it to expire
+func (p *Plugin) releaseLease(name string) {
+	key := leaseKeyPrefix + name
+
+	current, appErr := p.API.KVGet(key)
+	if appErr != nil || current == nil {
+		return
+	}
+
+	var held leaseValue
+	if err := json.Unmarshal(current, &held); err != nil || held.NodeID != p.nodeID {
+		return
+	}
+
+	if _, appErr := p.API.KVCompareAndDelete(key, current); appErr != nil {
+		p.API.LogWarn("Could not release lease", "lease", name, "error", appErr.Error())
+	}
+}
+
+// backgroundJob periodically runs a function on a single node of the cluster
+type backgroundJob struct {
+	name     string
+	interval func() time.Duration
+	run      func() error
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startJob starts running the job every interval on whichever node holds the job's lease. The
+// interval is read before every run so configuration changes apply without a restart.
+func (p *Plugin) startJob(name string, interval func() time.Duration, run func() error) {
+	job := &backgroundJob{
+		name:     name,
+		interval: interval,
+		run:      run,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	p.jobs = append(p.jobs, job)
+
+	go p.runJob(job)
+}
+
+// stopJobs stops all background jobs and the webhook worker, waiting for running ones to
+// finish, and releases the leases of the jobs
+func (p *Plugin) stopJobs() {
+	p.stopWebhookWorker()
+
+	for _, job := range p.jobs {
+		close(job.stop)
+	}
+
+	for _, job := range p.jobs {
+		<-job.done
+		p.releaseLease(job.name)
+	}
+
+	p.jobs = nil
+}
+
+func (p *Plugin) runJob(job *backgroundJob) {
+	defer close(job.done)
+
+	for {
+		interval := job.interval()
+
+		select {
+		case <-job.stop:
+			return
+		case <-time.After(interval):
+		}
+
+		// Give the leader a few missed runs before another node takes over
+		leader, err := p.acquireLease(job.name, 3*interval)
+		if err != nil {
+			p.API.LogError("Could not acquire lease", "job", job.name, "error", err.Error())
+			continue
+		}
+
+		if !leader {
+			continue
+		}
+
+		if err := job.run(); err != nil {
+			p.API.LogError("Background job failed", "job", job.name, "error", err.Error())
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+// testKVStore is an in-memory plugin KV store backing a plugintest.API mock
+type testKVStore struct {
+	sync.Mutex
+	values map[string][]byte
+}
+
+func newTestKVStore(api *plugintest.API) *testKVStore {
+	store := &testKVStore{values: map[string][]byte{}}
+
+	api.On("KVGet", mock.AnythingOfType("string")).Return(func(key string) []byte {
+		store.Lock()
+		defer store.Unlock()
+		return store.values[key]
+	}, nil)
+
+	api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		store.Lock()
+		defer store.Unlock()
+		store.values[key] = value
+		return nil
+	})
+
+	api.On("KVDelete", mock.AnythingOfType("string")).Return(func(key string) *model.AppError {
+		store.Lock()
+		defer store.Unlock()
+		delete(store.values, key)
+		return nil
+	})
+
+	compareAndSet := func(key string, oldValue, newValue []byte) bool {
+		store.Lock()
+		defer store.Unlock()
+
+		current, exists := store.values[key]
+		if (oldValue == nil && exists) || (oldValue != nil && !bytes.Equal(current, oldValue)) {
+			return false
+		}
+
+		if newValue == nil {
+			delete(store.values, key)
+		} else {
+			store.values[key] = newValue
+		}
+		return true
+	}
+
+	api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(compareAndSet, nil)
+
+	api.On("KVCompareAndDelete", mock.AnythingOfType("string"), mock.Anything).Return(func(key string, oldValue []byte) bool {
+		if oldValue == nil {
+			return false
+		}
+		return compareAndSet(key, oldValue, nil)
+	}, nil)
+
+	api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("model.PluginKVSetOptions")).Return(
+		func(key string, value []byte, options model.PluginKVSetOptions) bool {
+			if options.Atomic {
+				return compareAndSet(key, options.OldValue, value)
+			}
+
+			store.Lock()
+			defer store.Unlock()
+			store.values[key] = value
+			return true
+		}, nil)
+
+	return store
+}
+
+func TestLeaseFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	store := newTestKVStore(api)
+
+	first := &Plugin{nodeID: "first"}
+	first.SetAPI(api)
+	second := &Plugin{nodeID: "second"}
+	second.SetAPI(api)
+
+	acquired, err := first.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.True(acquired, "the first node should get the free lease")
+
+	acquired, err = second.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.False(acquired, "the second node should not get a lease held by the first")
+
+	acquired, err = first.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.True(acquired, "the holder should be able to renew its lease")
+
+	// The first node dies and its lease expires
+	expired, _ := json.Marshal(&leaseValue{NodeID: "first", ExpiresAt: model.GetMillisForTime(time.Now().Add(-time.Second))})
+	store.values[leaseKeyPrefix+"poller"] = expired
+
+	acquired, err = second.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.True(acquired, "the second node should take over an expired lease")
+
+	acquired, err = first.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.False(acquired, "the first node should not get the lease back")
+
+	second.releaseLease("poller")
+
+	acquired, err = first.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.True(acquired, "a released lease should be free")
+}
+
+func TestLeaseRace(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+
+	// The second node inserts its lease right after the first node found the lease free
+	var store *testKVStore
+	competing, _ := json.Marshal(&leaseValue{NodeID: "second", ExpiresAt: model.GetMillisForTime(time.Now().Add(time.Minute))})
+	api.On("KVGet", leaseKeyPrefix+"poller").Return(func(key string) []byte {
+		store.Lock()
+		defer store.Unlock()
+		current := store.values[key]
+		store.values[key] = competing
+		return current
+	}, nil).Once()
+	store = newTestKVStore(api)
+
+	first := &Plugin{nodeID: "first"}
+	first.SetAPI(api)
+
+	acquired, err := first.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.False(acquired, "the node losing the race should not get the lease")
+	assert.Equal(competing, store.values[leaseKeyPrefix+"poller"], "the lease of the winner should be kept")
+
+	acquired, err = first.acquireLease("poller", time.Minute)
+	assert.Nil(err)
+	assert.False(acquired, "the lease of the winner should still be held")
+}
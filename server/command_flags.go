@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// commandFlags holds the flags given to a slash command, by name without the leading dashes
+type commandFlags map[string][]string
+
+// splitCommand splits a slash command into words like a shell does. Words are separated by any
+// whitespace, and quotes group words: "a b" and 'a b' are a single word. Single quotes only
+// start a quote at the beginning of a word, so apostrophes in comments need no escaping, and the
+// typographic quotes some clients replace double quotes with are accepted too. A backslash
+// escapes a quote, a backslash or a space, and is kept before other characters so Windows paths
+// keep working.
+func splitCommand(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\\' && quote != '\'' && i+1 < len(runes) && (isQuote(runes[i+1]) || runes[i+1] == '\\' || (quote == 0 && unicode.IsSpace(runes[i+1]))):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case quote != 0:
+			if closesQuote(quote, r) {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case isQuote(r) && (r != '\'' || !inWord):
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated quote %c", quote)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+func isQuote(r rune) bool {
+	return r == '"' || r == '\'' || r == '“' || r == '”'
+}
+
+func closesQuote(quote, r rune) bool {
+	if quote == '“' || quote == '”' {
+		return r == '”' || r == '“' || r == '"'
+	}
+
+	return r == quote
+}
+
+// String returns the last value given for the flag, or "" if it was not given
+func (f commandFlags) String(name string) string {
+	values := f[name]
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[len(values)-1]
+}
+
+// Bool returns true if the flag was given without a value or with a true value
+func (f commandFlags) Bool(name string) bool {
+	switch strings.ToLower(f.String(name)) {
+	case "true", "yes", "1":
+		return true
+	}
+
+	return false
+}
+
+// List returns the comma separated values given for the flag
+func (f commandFlags) List(name string) []string {
+	var list []string
+
+	for _, value := range f[name] {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+
+	return list
+}
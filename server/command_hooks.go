@@ -2,20 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
 	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 
-	"github.com/icelander/teamcity-sdk-go/teamcity"
-	"github.com/icelander/teamcity-sdk-go/types"
-
 	"github.com/olekukonko/tablewriter"
 )
 
@@ -34,13 +31,24 @@ const (
 	commandTriggerBuild        = "build"
 	commandTriggerBuildStart   = "start"
 	commandTriggerBuildCancel  = "cancel"
+	commandTriggerBuildStatus  = "status"
 	commandTriggerStats        = "stats"
-
-	errorNotInstalled   = "To use the TeamCity Plugin first install it with `/teamcity install <teamcity url> <token>`"
-	errorDisabled       = "TeamCity Plugin disabled. First enable it with `/teamcity enable`"
-	errorWhatList       = "Try `/teamcity list builds` or `/teamcity list projects`"
-	errorNoBuildID      = "Please provide a build ID, `/teamcity build start <build_id>`"
-	errorNoBuildCommand = "Please provide a build command, e.g. `/teamcity build start <build_id>`"
+	commandTriggerConnect      = "connect"
+	commandTriggerDisconnect   = "disconnect"
+	commandTriggerHealth       = "health"
+
+	commandTriggerSubscribe         = "subscribe"
+	commandTriggerUnsubscribe       = "unsubscribe"
+	commandTriggerSubscriptions     = "subscriptions"
+	commandTriggerSubscriptionsList = "list"
+	commandTriggerInstallStatus     = "status"
+
+	errorNotInstalled = "To use the TeamCity Plugin first install it with `/teamcity install <teamcity url> <token>`"
+	errorDisabled     = "TeamCity Plugin disabled. First enable it with `/teamcity enable`"
+	errorDisabledTeam = "TeamCity Plugin disabled in this team. A team administrator can enable it with `/teamcity enable --team`"
+	errorDisabledChan = "TeamCity Plugin disabled in this channel. A channel administrator can enable it with `/teamcity enable --channel`"
+	errorNotConnected = "Please connect your TeamCity account first with `/teamcity connect <token>`. " +
+		"Create an access token in your TeamCity profile under **Access Tokens**."
 
 	msgInstalled = "TeamCity Plugin Installed!"
 	msgEnabled   = "TeamCity Plugin Enabled"
@@ -48,38 +56,23 @@ const (
 
 	iconGood = ":white_check_mark:"
 	iconBad  = ":x:"
-
-	commandDialogHelp = "Use one of the following slash commands to interact with TeamCity from within Mattermost\n" +
-		"- `/teamcity install <teamcity url> <token>` - Set up the TeamCity plugin\n" +
-		"- `/teamcity list projects` - List projects with description and project id\n" +
-		"- `/teamcity list builds` - List builds with description, project, and build id\n" +
-		"- `/teamcity build status <build_id>` - Get the status of a specific build\n" +
-		"- `/teamcity build start <project>` - Trigger a build on a specific project\n" +
-		"- `/teamcity build cancel <build_id>` - Cancel a build\n" +
-		"- `/teamcity stats` - Basic build statistics (Project Level and Build Configuration level)"
 )
 
 func (p *Plugin) registerCommands() error {
-	if err := p.API.RegisterCommand(&model.Command{
-		Trigger:          commandTriggerHooks,
-		DisplayName:      "TeamCity",
-		Description:      "Integration with JetBeans TeamCity",
-		AutoComplete:     true,
-		AutoCompleteHint: "[command]",
-		AutoCompleteDesc: "Available commands: install, list, build, stats",
-	}); err != nil {
-		return errors.Wrapf(err, "failed to register %s command", commandTriggerHooks)
-	}
-
-	if err := p.API.RegisterCommand(&model.Command{
-		Trigger:          "/" + commandTriggerHooks,
-		DisplayName:      "TeamCity",
-		Description:      "Integration with JetBeans TeamCity",
-		AutoComplete:     true,
-		AutoCompleteHint: "[command]",
-		AutoCompleteDesc: "Available commands: install, list, build, stats",
-	}); err != nil {
-		return errors.Wrapf(err, "failed to register %s command", commandTriggerHooks)
+	for _, trigger := range []string{commandTriggerHooks, "/" + commandTriggerHooks} {
+		autocompleteData := getAutocompleteData(trigger)
+
+		if err := p.API.RegisterCommand(&model.Command{
+			Trigger:          trigger,
+			DisplayName:      "TeamCity",
+			Description:      "Integration with JetBeans TeamCity",
+			AutoComplete:     true,
+			AutoCompleteHint: autocompleteData.Hint,
+			AutoCompleteDesc: autocompleteData.HelpText,
+			AutocompleteData: autocompleteData,
+		}); err != nil {
+			return errors.Wrapf(err, "failed to register %s command", commandTriggerHooks)
+		}
 	}
 
 	return nil
@@ -87,15 +80,17 @@ func (p *Plugin) registerCommands() error {
 
 // ExecuteCommand executes the slash commands
 func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-
-	cArgs, err := p.extractCommandArgs(args.Command)
-
-	if err != nil {
-		return p.postEphemeral("Could not extract command arguments"), nil
-	}
-
-	if cArgs[0] == "/"+commandTriggerHooks {
-		return p.executeCommandHooks(args), nil
+	words := strings.Fields(args.Command)
+
+	if len(words) > 0 && strings.EqualFold(words[0], "/"+commandTriggerHooks) {
+		response := p.executeCommandHooks(args)
+		if len(words) > 1 && !strings.EqualFold(words[1], commandTriggerHealth) && !strings.EqualFold(words[1], commandTriggerInstall) && !strings.EqualFold(words[1], commandTriggerHelp) {
+			_, _, flags := parseCommandLine(args.Command)
+			if server := p.getConfiguration().GetServer(p.commandServerName(args, flags)); server != nil {
+				p.addDegradedNotice(server, response)
+			}
+		}
+		return response, nil
 	}
 
 	return &model.CommandResponse{
@@ -104,184 +99,173 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 	}, nil
 }
 
-func (p *Plugin) extractCommandArgs(cArgs string) ([]string, error) {
-	r := csv.NewReader(strings.NewReader(cArgs))
-	r.Comma = ' ' // space
-	fields, err := r.Read()
-
-	return fields, err
-}
-
-func (p *Plugin) invalidCommand(args *model.CommandArgs) *model.CommandResponse {
+func (p *Plugin) postEphemeral(text string) *model.CommandResponse {
 	return &model.CommandResponse{
 		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
-		Text:         commandDialogHelp,
+		Text:         text,
 	}
 }
 
-func (p *Plugin) executeCommandHooks(args *model.CommandArgs) *model.CommandResponse {
-	configuration := p.getConfiguration()
+func (p *Plugin) executeCommandTriggerInstall(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	if errResponse := p.requireSystemAdmin(args, commandTriggerInstall); errResponse != nil {
+		return errResponse
+	}
 
-	cArgs, err := p.extractCommandArgs(args.Command)
+	configuration := p.getConfiguration()
+	flags := input.Flags
+	token := input.Arg("token")
+
+	name := defaultServerName
+	if flags.String("server") != "" {
+		name = strings.ToLower(flags.String("server"))
+		if err := validateServerName(name); err != nil {
+			return p.postEphemeral("Invalid server name: " + err.Error())
+		}
+	}
 
+	// Validate URL
+	u, err := url.ParseRequestURI(input.Arg("teamcity url"))
 	if err != nil {
-		return &model.CommandResponse{
-			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
-			Text:         commandDialogHelp,
-		}
+		return p.postEphemeral("Invalid URL: `" + err.Error() + "`\n")
 	}
 
-	if !strings.HasPrefix(args.Command, "/"+commandTriggerHooks) {
-		return &model.CommandResponse{
-			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
-			Text:         commandDialogHelp,
-		}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return p.postEphemeral("Invalid URL: the TeamCity URL must start with `http://` or `https://`")
 	}
 
-	if !configuration.Installed() && cArgs[1] != commandTriggerInstall {
-		return p.postEphemeral(errorNotInstalled)
+	// Check the server can be reached and accepts the token before saving them
+	client := p.teamCityClient(u.String(), token)
+	start := time.Now()
+	info, err := client.GetServer()
+	latency := time.Since(start)
+	if err != nil {
+		return p.postEphemeral("Could not connect to server.\nError: `" + err.Error() + "`")
 	}
 
-	switch cArgs[1] {
-	case commandTriggerDisable:
-		return p.executeCommandTriggerDisable(args)
-	case commandTriggerEnable:
-		return p.executeCommandTriggerEnable(args)
-	case commandTriggerInstall:
-		return p.executeCommandTriggerInstall(args)
-	case commandTriggerList:
-		if configuration.disabled {
-			return p.postEphemeral(errorDisabled)
-		}
-		if len(cArgs) == 2 {
-			return p.postEphemeral(errorWhatList)
-		}
-		switch cArgs[2] {
-		case commandTriggerListBuilds:
-			return p.executeCommandTriggerListBuilds(args)
-		case commandTriggerListProjects:
-			return p.executeCommandTriggerListProjects(args)
-		default:
-			return p.invalidCommand(args)
-		}
+	user, err := client.GetCurrentUser()
+	if err != nil {
+		return p.postEphemeral("TeamCity did not accept the access token.\nError: `" + err.Error() + "`")
+	}
 
-	case commandTriggerBuild:
-		if configuration.disabled {
-			return p.postEphemeral(errorDisabled)
-		}
-		if len(cArgs) == 3 {
-			return p.postEphemeral(errorNoBuildCommand)
-		}
-		switch cArgs[2] {
-		case commandTriggerBuildStart:
-			return p.executeCommandTriggerBuildStart(cArgs[3])
-		case commandTriggerBuildCancel:
-			return p.executeCommandTriggerBuildCancel(args)
-		default:
-			return p.invalidCommand(args)
+	encryptedToken, err := p.encryptSecret(token)
+	if err != nil {
+		return p.postEphemeral("Could not encrypt the access token.\nError: `" + err.Error() + "`")
+	}
+
+	server := &teamCityServer{
+		Name:    name,
+		URL:     u.String(),
+		Token:   encryptedToken,
+		Default: flags.Bool("default"),
+		token:   token,
+	}
+
+	// OnConfigurationChange applies the saved configuration too, but the following commands
+	// should not depend on when it runs
+	configuration = configuration.Clone()
+	values := map[string]interface{}{}
+
+	if name == defaultServerName {
+		values["TeamCityURL"] = server.URL
+		values["TeamCityToken"] = server.Token
+		configuration.TeamCityURL = server.URL
+		configuration.TeamCityToken = server.Token
+		configuration.teamCityToken = server.token
+	}
+
+	// Named servers are replaced, and only one server may be the default one
+	if name != defaultServerName || server.Default {
+		servers := []*teamCityServer{}
+		for _, existing := range configuration.TeamCityServers {
+			if existing.Name == name {
+				continue
+			}
+
+			if server.Default && existing.Default {
+				unflagged := *existing
+				unflagged.Default = false
+				existing = &unflagged
+			}
+			servers = append(servers, existing)
 		}
 
-	case commandTriggerStats:
-		if configuration.disabled {
-			return p.postEphemeral(errorDisabled)
+		if name != defaultServerName {
+			servers = append(servers, server)
 		}
-		return p.executeCommandTriggerStats(args)
 
-	default:
-		return &model.CommandResponse{
-			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
-			Text:         commandDialogHelp,
+		value, valueErr := serverConfigValue(servers)
+		if valueErr != nil {
+			return p.postEphemeral("Could not save the configuration.\nError: `" + valueErr.Error() + "`")
 		}
+		values["TeamCityServers"] = value
+		configuration.TeamCityServers = servers
 	}
-}
 
-func (p *Plugin) postEphemeral(text string) *model.CommandResponse {
-	return &model.CommandResponse{
-		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
-		Text:         text,
+	if err = p.savePluginConfigValues(values); err != nil {
+		return p.postEphemeral("Could not save the configuration.\nError: `" + err.Error() + "`")
 	}
-}
 
-func (p *Plugin) executeCommandTriggerInstall(args *model.CommandArgs) *model.CommandResponse {
-
-	configuration := p.getConfiguration()
+	p.setConfiguration(configuration)
 
-	cArgs, err := p.extractCommandArgs(args.Command)
+	if _, err = p.recordHealth(server, info, latency, nil); err != nil {
+		p.API.LogWarn("Could not record the server health", "server", name, "error", err.Error())
+	}
 
-	if err != nil {
-		p.API.LogError(
-			"Could not extract arguments",
-			"error", err.Error(),
-		)
-		return p.postEphemeral("Could not read arguments")
+	message := "TeamCity Installed! Here are the server details:\n"
+	if name != defaultServerName {
+		message += "**Name:** " + name + "\n"
 	}
 
-	// Install command is like this:
-	//  - [0] : /teamcity
-	//  - [1] : install
-	//  - [2] : url
-	//  - [3] : token
+	return p.postEphemeral(message +
+		"**Server:** " + u.String() + "\n" +
+		"**Server Version:** " + info.Version + "\n" +
+		"**Build Number:** " + info.BuildNumber + "\n" +
+		"**Access Token User:** " + user.Username)
+}
 
-	// TODO: Write test for not enough arguments
-	if len(cArgs) != 4 {
-		return p.postEphemeral(errorNotInstalled)
+// executeCommandTriggerInstallStatus shows the stored server and checks that it can still be
+// reached with the stored token
+func (p *Plugin) executeCommandTriggerInstallStatus(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	server, errResponse := p.commandServer(args, input.Flags)
+	if errResponse != nil {
+		return errResponse
 	}
 
-	// Validate URL
-	// TODO: Write invalid URL test
-	u, err := url.ParseRequestURI(cArgs[2])
-	if err != nil {
-		// p.API.LogError("Invalid TeamCity URL: " + u.String())
-		return p.postEphemeral("Invalid URL: `" + err.Error() + "`\n")
+	client := p.systemClient(server)
+	message := "**Server:** " + server.URL + "\n"
+	if server.Name != defaultServerName {
+		message = "**Name:** " + server.Name + "\n" + message
+	}
+	if server.tokenError != "" {
+		message += "**Stored Access Token:** " + iconBad + " " + server.tokenError + "\n"
 	}
 
-	// Attempt a test command
-	// TODO: Write "could not connect" test
-	client := teamcity.New(u.String(), cArgs[3])
-	server, err := client.Server()
-
+	info, err := client.GetServer()
 	if err != nil {
-		return p.postEphemeral("Could not connect to server.\nError: `" + err.Error() + "`")
+		message += "**Connection:** " + iconBad + " `" + err.Error() + "`\n"
+	} else {
+		message += "**Connection:** " + iconGood + "\n" +
+			"**Server Version:** " + info.Version + "\n" +
+			"**Build Number:** " + info.BuildNumber + "\n"
 	}
 
-	configuration.TeamCityURL = u.String()
-	configuration.TeamCityToken = cArgs[3]
-
-	p.setConfiguration(configuration)
-
-	return p.postEphemeral("TeamCity Installed! Here are the server details:\n" +
-		"**Server:** " + u.String() + "\n" +
-		"**Server Version:** " + server.Version + "\n" +
-		"**Build Number:** " + server.BuildNumber)
-}
-
-func (p *Plugin) executeCommandTriggerEnable(args *model.CommandArgs) *model.CommandResponse {
-	configuration := p.getConfiguration()
-
-	if configuration.disabled {
-		configuration.disabled = false
-		p.setConfiguration(configuration)
+	user, err := client.GetCurrentUser()
+	if err != nil {
+		message += "**Access Token:** " + iconBad + " `" + err.Error() + "`"
+	} else {
+		message += "**Access Token:** " + iconGood + " authenticates as " + user.Username
 	}
 
-	return p.postEphemeral(msgEnabled)
+	return p.postEphemeral("TeamCity installation status:\n" + message)
 }
 
-func (p *Plugin) executeCommandTriggerDisable(args *model.CommandArgs) *model.CommandResponse {
-	configuration := p.getConfiguration()
-	if !configuration.disabled {
-		configuration.disabled = true
-		p.setConfiguration(configuration)
+func (p *Plugin) executeCommandTriggerListProjects(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	client, _, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
 	}
 
-	return p.postEphemeral(msgDisabled)
-}
-
-func (p *Plugin) executeCommandTriggerListProjects(args *model.CommandArgs) *model.CommandResponse {
-	configuration := p.getConfiguration()
-	client := teamcity.New(configuration.TeamCityURL,
-		configuration.TeamCityToken)
-
-	projects, err := client.GetShortProjects()
+	projects, err := client.GetProjects()
 
 	if err != nil {
 		return p.postEphemeral(fmt.Sprintf("Error listing projects: %s", err.Error()))
@@ -306,12 +290,23 @@ func (p *Plugin) executeCommandTriggerListProjects(args *model.CommandArgs) *mod
 	}
 }
 
-func (p *Plugin) executeCommandTriggerListBuilds(args *model.CommandArgs) *model.CommandResponse {
+func (p *Plugin) executeCommandTriggerListBuilds(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
 	configuration := p.getConfiguration()
-	client := teamcity.New(configuration.TeamCityURL,
-		configuration.TeamCityToken)
 
-	builds, err := client.GetBuilds()
+	client, server, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	maxBuilds := configuration.GetMaxBuilds()
+
+	locator := fmt.Sprintf("count:%d", maxBuilds)
+	project := p.commandProject(args, server, input.Flags)
+	if project != nil {
+		locator = projectLocator(project.ProjectID) + "," + locator
+	}
+
+	builds, err := client.GetBuilds(locator)
 
 	if err != nil {
 		return p.postEphemeral("Error listing builds: `" + err.Error() + "`")
@@ -322,6 +317,9 @@ func (p *Plugin) executeCommandTriggerListBuilds(args *model.CommandArgs) *model
 	}
 
 	message := "**TeamCity Builds:**\n\n"
+	if project != nil {
+		message = fmt.Sprintf("**TeamCity Builds of %s:**\n\n", project.ProjectName)
+	}
 
 	buf := new(bytes.Buffer)
 	buildTable := tablewriter.NewWriter(buf)
@@ -332,15 +330,7 @@ func (p *Plugin) executeCommandTriggerListBuilds(args *model.CommandArgs) *model
 	buildTable.SetAutoFormatHeaders(false)
 	buildTable.SetHeaderAlignment(tablewriter.ALIGN_CENTER)
 
-	maxBuilds := configuration.GetMaxBuilds()
-
-	if len(builds)-1 < maxBuilds {
-		maxBuilds = len(builds) - 1
-	}
-
-	for i := 0; i < maxBuilds; i++ {
-		build := builds[i]
-
+	for _, build := range builds {
 		nameLink := fmt.Sprintf("[%s #%s](%s)", build.BuildTypeID, build.Number, build.WebURL)
 		buildStartDate := build.StartDate.Time().Format(fmtDateTime)
 		buildFinishDate := build.FinishDate.Time().Format(fmtDateTime)
@@ -362,83 +352,153 @@ func (p *Plugin) executeCommandTriggerListBuilds(args *model.CommandArgs) *model
 	}
 }
 
-func (p *Plugin) executeCommandTriggerBuildStart(buildTypeID string) *model.CommandResponse {
-	configuration := p.getConfiguration()
-	client := teamcity.New(configuration.TeamCityURL,
-		configuration.TeamCityToken)
+// executeCommandTriggerBuildStart queues a build. Without a build type, or with --dialog, it
+// opens the start build dialog instead. In a channel linked to a project, build types may be
+// given without the project ID prefix.
+func (p *Plugin) executeCommandTriggerBuildStart(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	flags := input.Flags
+	buildTypeID := input.Arg("build_type_id")
+
+	if buildTypeID == "" || flags.Bool("dialog") {
+		if args.TriggerId == "" {
+			return p.postEphemeral(input.UsageError(missingArgument("build_type_id")))
+		}
+
+		client, server, errResponse := p.commandClient(args, input.Flags, false)
+		if errResponse != nil {
+			return errResponse
+		}
 
-	var emptyMap = make(map[string]string)
+		projectID := ""
+		if project := p.commandProject(args, server, flags); project != nil {
+			projectID = project.ProjectID
+			if buildTypeID != "" {
+				buildTypeID = p.projectBuildTypeID(client, projectID, buildTypeID)
+			}
+		}
+
+		if err := p.openStartBuildDialog(client, server.Name, args.TriggerId, projectID, buildTypeID); errors.Cause(err) == errNotFound {
+			return p.postEphemeral("Invalid Build ID: `" + buildTypeID + "`")
+		} else if err != nil {
+			return p.postEphemeral("Could not open the start build dialog: `" + err.Error() + "`")
+		}
+
+		return &model.CommandResponse{}
+	}
+
+	client, server, errResponse := p.commandClient(args, input.Flags, true)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	if project := p.commandProject(args, server, flags); project != nil {
+		buildTypeID = p.projectBuildTypeID(client, project.ProjectID, buildTypeID)
+	}
+
+	options := &queueBuildOptions{
+		Branch:     flags.String("branch"),
+		Comment:    flags.String("comment"),
+		QueueAtTop: flags.Bool("top"),
+	}
+
+	parameters, invalid := parseParameterAssignments(flags["param"])
+	if invalid != "" {
+		return p.postEphemeral("Invalid parameter `" + invalid + "`, use `-p name=value`")
+	}
+	options.Parameters = parameters
 
 	// Check BuildTypeID is correct
-	var emptyBuildType *types.BuildType
 	buildType, err := client.GetBuildType(buildTypeID)
 
-	if emptyBuildType == buildType {
+	if errors.Cause(err) == errNotFound {
 		return p.postEphemeral("Invalid Build ID: `" + buildTypeID + "`")
 	}
 
-	build, err := client.QueueBuild(buildTypeID, "", emptyMap)
-
 	if err != nil {
 		return p.postEphemeral("Error starting build: `" + err.Error() + "`")
 	}
 
-	message := "**TEAMCITY BUILD STARTED**\n\n" +
-		" - Build Type: [%s](%s)\n" +
-		" - [Build ID: %d](%s)\n" +
-		" - State: %s\n\n" +
-		" Stop this build with this slash command: `/teamcity build cancel %d`"
+	if errResponse := p.commandPermission(args, server.Name, permissionStart, buildType); errResponse != nil {
+		return errResponse
+	}
 
-	respText := fmt.Sprintf(message, build.BuildType.Name, build.BuildType.WebURL, build.ID, build.WebURL, build.State, build.ID)
+	if agent := flags.String("agent"); agent != "" {
+		locator := "name:" + locatorValue(agent)
+		if _, parseErr := strconv.ParseInt(agent, 10, 64); parseErr == nil {
+			locator = "id:" + agent
+		}
 
-	return &model.CommandResponse{
-		ResponseType: model.COMMAND_RESPONSE_TYPE_IN_CHANNEL,
-		Text:         respText,
+		tcAgent, agentErr := client.GetAgent(locator)
+		if agentErr != nil {
+			return p.postEphemeral("Invalid agent: `" + agent + "`")
+		}
+		options.AgentID = tcAgent.ID
 	}
-}
 
-func (p *Plugin) executeCommandTriggerBuildCancel(args *model.CommandArgs) *model.CommandResponse {
-	configuration := p.getConfiguration()
-	client := teamcity.New(configuration.TeamCityURL,
-		configuration.TeamCityToken)
-
-	cArgs, err := p.extractCommandArgs(args.Command)
+	build, err := client.QueueBuild(buildTypeID, options)
 
 	if err != nil {
-		return p.postEphemeral(fmt.Sprintf("Error parsing arguments: `%s`", err.Error()))
+		return p.postEphemeral("Error starting build: `" + err.Error() + "`")
 	}
 
-	// Cancel command is like this:
-	//  - [0] : /teamcity
-	//  - [1] : build
-	//  - [2] : cancel
-	//  - [3] : buildID
-	//  - [4] : Comments
+	if _, err = p.postStartedBuild(args.UserId, args.ChannelId, args.RootId, server.Name, build, options); err != nil {
+		p.API.LogWarn("Could not post started build", "build_id", build.ID, "error", err.Error())
 
-	// Verify the buildID
-	buildID, err := strconv.ParseInt(cArgs[3], 10, 64)
-
-	if buildID == 0 {
-		return p.postEphemeral(fmt.Sprintf("Invalid Build ID: %s", cArgs[3]))
+		return &model.CommandResponse{
+			ResponseType: model.COMMAND_RESPONSE_TYPE_IN_CHANNEL,
+			Text:         buildProgressMessage(server.Name, build, options),
+			Attachments:  p.startedBuildAttachments(server.Name, build),
+		}
 	}
 
-	if err != nil {
-		return p.postEphemeral(fmt.Sprintf("Error Cancelling Build: %s", err.Error()))
+	return &model.CommandResponse{}
+}
+
+// parseParameterAssignments parses build parameters written name=value, returning the first
+// invalid one if any
+func parseParameterAssignments(assignments []string) (map[string]string, string) {
+	parameters := map[string]string{}
+
+	for _, assignment := range assignments {
+		eq := strings.Index(assignment, "=")
+		if eq <= 0 {
+			return nil, assignment
+		}
+		parameters[strings.TrimSpace(assignment[:eq])] = assignment[eq+1:]
 	}
 
-	buildComment := ""
+	return parameters, ""
+}
 
-	if len(cArgs) >= 5 {
-		var commentSlice []string = cArgs[4:]
-		buildComment = strings.Join(commentSlice, " ")
+func (p *Plugin) executeCommandTriggerBuildCancel(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	client, server, errResponse := p.commandClient(args, input.Flags, true)
+	if errResponse != nil {
+		return errResponse
 	}
 
-	build, err := client.CancelBuild(buildID, buildComment)
+	buildID := input.Int("build_id")
 
+	build, err := client.GetBuild(buildID)
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral(fmt.Sprintf("Invalid Build ID: %d", buildID))
+	}
 	if err != nil {
 		return p.postEphemeral(fmt.Sprintf("Error Cancelling Build: %s", err.Error()))
 	}
 
+	if errResponse := p.commandPermission(args, server.Name, permissionCancel, &build.BuildType); errResponse != nil {
+		return errResponse
+	}
+
+	if err = client.CancelBuild(build, input.Arg("comment")); err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error Cancelling Build: %s", err.Error()))
+	}
+
+	// Show the build as TeamCity reports it after the cancellation
+	if cancelled, getErr := client.GetBuild(buildID); getErr == nil {
+		build = cancelled
+	}
+
 	message := "**TEAMCITY BUILD CANCELLED**\n"
 
 	message += "----\n"
@@ -461,18 +521,93 @@ func (p *Plugin) executeCommandTriggerBuildCancel(args *model.CommandArgs) *mode
 	}
 }
 
-func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs) *model.CommandResponse {
-	configuration := p.getConfiguration()
-	client := teamcity.New(configuration.TeamCityURL,
-		configuration.TeamCityToken)
+func (p *Plugin) executeCommandTriggerBuildStatus(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	client, _, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
 
-	agents, err := client.GetAgentStats()
+	buildID := input.Int("build_id")
+
+	build, err := client.GetBuild(buildID)
+
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral(fmt.Sprintf("Build not found: %d", buildID))
+	}
+
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting build status: `%s`", err.Error()))
+	}
+
+	message := "**TEAMCITY BUILD STATUS**\n"
+
+	message += "----\n"
+	message += fmt.Sprintf(" - Build : [%s #%s](%s)\n", build.BuildType.Name, build.Number, build.WebURL) +
+		"\t - Project: " + build.BuildType.ProjectName + "\n" +
+		"\t - Build Type: " + build.BuildTypeID + "\n"
+
+	if build.BranchName != "" {
+		message += "\t - Branch: " + build.BranchName + "\n"
+	}
+
+	if build.Status == "SUCCESS" {
+		message += "\t - Status: " + build.StatusText + "\n"
+	} else {
+		message += "\t - Status: **" + build.StatusText + "**\n"
+	}
+
+	message += "\t - State: " + build.State + "\n"
+
+	if build.Agent.Name != "" {
+		message += "\t - Agent: " + build.Agent.Name + "\n"
+	}
+
+	if triggeredBy := build.TriggeredBy(); triggeredBy != "" {
+		message += "\t - Triggered By: " + triggeredBy + "\n"
+	}
+
+	startDate := build.StartDate.Time()
+	finishDate := build.FinishDate.Time()
+
+	if startDate.IsZero() {
+		message += "\t - Queued: " + build.QueuedDate.Time().Format(fmtDateTime) + "\n"
+	} else {
+		message += "\t - Build Start: " + startDate.Format(fmtDateTime) + "\n"
+
+		if !finishDate.IsZero() {
+			message += "\t - Build Finish: " + finishDate.Format(fmtDateTime) + "\n"
+			message += "\t - Duration: " + fmtDuration(finishDate.Sub(startDate)) + "\n"
+		} else {
+			message += "\t - Running For: " + fmtDuration(time.Since(startDate)) + "\n"
+		}
+	}
+
+	message += fmt.Sprintf("\t - [Build Log](%s)\n", client.BuildLogURL(build.ID))
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_IN_CHANNEL,
+		Text:         message,
+	}
+}
+
+func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	client, server, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	queueLocator, queueTitle := "", "Build Queue"
+	if project := p.commandProject(args, server, input.Flags); project != nil {
+		queueLocator, queueTitle = projectLocator(project.ProjectID), "Build Queue of "+project.ProjectName
+	}
+
+	agents, err := client.GetAgents()
 
 	if err != nil {
 		return p.postEphemeral(fmt.Sprintf("Error getting agent stats: %s", err.Error()))
 	}
 
-	builds, err := client.GetBuildQueue()
+	builds, err := client.GetBuildQueue(queueLocator)
 
 	if err != nil {
 		return p.postEphemeral(fmt.Sprintf("Error getting build queue: %s", err.Error()))
@@ -497,7 +632,7 @@ func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs) *model.Comm
 	})
 
 	for _, agent := range agents {
-		working := (agent.ActiveBuild.BuildTypeID != "")
+		working := agent.Build != nil
 		nameLink := fmt.Sprintf("[%s](%s)", agent.Name, agent.WebURL)
 
 		agentTable.Append([]string{nameLink,
@@ -513,7 +648,7 @@ func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs) *model.Comm
 	message += buf.String()
 
 	if len(builds) != 0 {
-		message += fmt.Sprintf("\n---\n**Build Queue** - Total Builds: %d\n\n", len(builds))
+		message += fmt.Sprintf("\n---\n**%s** - Total Builds: %d\n\n", queueTitle, len(builds))
 
 		buf := new(bytes.Buffer)
 		buildTable := tablewriter.NewWriter(buf)
@@ -524,7 +659,7 @@ func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs) *model.Comm
 		buildTable.SetAutoFormatHeaders(false)
 		buildTable.SetHeaderAlignment(tablewriter.ALIGN_CENTER)
 
-		for _, build := range builds {
+		for i, build := range builds {
 			nameLink := fmt.Sprintf("[%s](%s)", build.BuildType.Name, build.WebURL)
 			queuedTime := build.QueuedDate.Time().Format(fmtDateTime)
 
@@ -532,7 +667,7 @@ func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs) *model.Comm
 				build.BuildType.ProjectName,
 				nameLink,
 				queuedTime,
-				fmt.Sprintf("%d", build.QueuePosition),
+				fmt.Sprintf("%d", i+1),
 			})
 		}
 
@@ -546,6 +681,24 @@ func (p *Plugin) executeCommandTriggerStats(args *model.CommandArgs) *model.Comm
 	}
 }
 
+// fmtDuration formats a duration like TeamCity does, e.g. "1h 5m 12s"
+func fmtDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+
+	hours := d / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+
+	switch {
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm %ds", hours, minutes, seconds)
+	case minutes > 0:
+		return fmt.Sprintf("%dm %ds", minutes, seconds)
+	}
+
+	return fmt.Sprintf("%ds", seconds)
+}
+
 func (p *Plugin) redOrGreen(t bool) string {
 	if t {
 		return iconGood
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestInstall(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good-token" {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/app/rest/server":
+			_ = json.NewEncoder(w).Encode(&tcServer{Version: "2023.11", BuildNumber: "147412"})
+		case "/app/rest/users/current":
+			_ = json.NewEncoder(w).Encode(&tcUser{Username: "mattermost"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	api.On("GetPluginConfig").Return(map[string]interface{}{"teamcitymaxbuilds": "10", "teamcityurl": "http://old"})
+
+	var saved map[string]interface{}
+	api.On("SavePluginConfig", mock.Anything).Return(func(config map[string]interface{}) *model.AppError {
+		saved = config
+		return nil
+	})
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	command := func(command string) *model.CommandArgs {
+		return &model.CommandArgs{UserId: "admin", Command: "/teamcity " + command}
+	}
+
+	response := p.executeCommandHooks(command("install " + server.URL + " bad-token"))
+	assert.Contains(response.Text, "Could not connect to server")
+	assert.Nil(saved, "nothing is saved when the connection check fails")
+
+	response = p.executeCommandHooks(command("install ftp://teamcity good-token"))
+	assert.Contains(response.Text, "must start with `http://` or `https://`")
+
+	response = p.executeCommandHooks(command("install " + server.URL + " good-token"))
+	assert.Contains(response.Text, "TeamCity Installed!")
+	assert.Contains(response.Text, "**Server Version:** 2023.11")
+	assert.Contains(response.Text, "**Access Token User:** mattermost")
+
+	// The settings are stored durably, keeping the others
+	assert.Equal("10", saved["teamcitymaxbuilds"])
+	assert.Equal(server.URL, saved["TeamCityURL"])
+	assert.NotContains(saved, "teamcityurl")
+	assert.True(strings.HasPrefix(saved["TeamCityToken"].(string), encryptedPrefix))
+	assert.Equal("good-token", p.getConfiguration().GetTeamCityToken())
+
+	response = p.executeCommandHooks(command("install status"))
+	assert.Contains(response.Text, "**Server:** "+server.URL)
+	assert.Contains(response.Text, "**Connection:** "+iconGood)
+	assert.Contains(response.Text, "**Access Token:** "+iconGood+" authenticates as mattermost")
+
+	configuration := p.getConfiguration().Clone()
+	configuration.teamCityToken = "revoked-token"
+	p.setConfiguration(configuration)
+
+	response = p.executeCommandHooks(command("install status"))
+	assert.Contains(response.Text, "**Access Token:** "+iconBad)
+
+	configuration = p.getConfiguration().Clone()
+	configuration.teamCityTokenError = "Could not decrypt the access token"
+	p.setConfiguration(configuration)
+
+	response = p.executeCommandHooks(command("install status"))
+	assert.Contains(response.Text, "**Stored Access Token:** "+iconBad+" Could not decrypt the access token")
+}
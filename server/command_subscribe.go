@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// resolveSubscriptionTarget looks up whether targetID is a build configuration or a project of
+// a server
+func (p *Plugin) resolveSubscriptionTarget(server *teamCityServer, targetID string) (*subscription, error) {
+	client := p.systemClient(server)
+
+	buildType, err := client.GetBuildType(targetID)
+	if err == nil {
+		return &subscription{
+			Server:     server.Name,
+			TargetID:   buildType.ID,
+			TargetType: subscriptionTargetBuildType,
+			TargetName: buildType.ProjectName + " / " + buildType.Name,
+			WebURL:     buildType.WebURL,
+		}, nil
+	}
+	if errors.Cause(err) != errNotFound {
+		return nil, err
+	}
+
+	project, err := client.GetProject(targetID)
+	if err == nil {
+		return &subscription{
+			Server:     server.Name,
+			TargetID:   project.ID,
+			TargetType: subscriptionTargetProject,
+			TargetName: project.Name,
+			WebURL:     project.WebURL,
+		}, nil
+	}
+	if errors.Cause(err) != errNotFound {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (p *Plugin) executeCommandTriggerSubscribe(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	flags := input.Flags
+	targetID := input.Arg(targetArg.Name)
+
+	events, err := parseSubscriptionEvents(strings.Join(append(strings.Fields(input.Arg("events")), flags.List("events")...), ","))
+	if err != nil {
+		return p.postEphemeral("Invalid events: " + err.Error())
+	}
+
+	branches := flags.List("branch")
+	if err = validateBranchPatterns(branches); err != nil {
+		return p.postEphemeral("Invalid branches: " + err.Error())
+	}
+
+	server, errResponse := p.commandServer(args, input.Flags)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	sub, err := p.resolveSubscriptionTarget(server, targetID)
+	if err != nil {
+		return p.postEphemeral("Error looking up `" + targetID + "`: `" + err.Error() + "`")
+	}
+
+	if sub == nil {
+		return p.postEphemeral("Invalid project or build configuration ID" + p.serverNote(server.Name) + ": `" + targetID + "`")
+	}
+
+	sub.ChannelID = args.ChannelId
+	sub.CreatorID = args.UserId
+	sub.Filter = subscriptionFilter{
+		Events:          events,
+		Branches:        branches,
+		ExcludePersonal: flags.Bool("exclude-personal"),
+	}
+
+	if err := p.addSubscription(sub); err != nil {
+		return p.postEphemeral("Error saving subscription: `" + err.Error() + "`")
+	}
+
+	return p.postEphemeral(fmt.Sprintf("This channel is now subscribed to %s [%s](%s)%s (%s)",
+		sub.describeTargetType(), sub.TargetName, sub.WebURL, p.serverNote(server.Name), sub.Filter.String()))
+}
+
+func (p *Plugin) executeCommandTriggerUnsubscribe(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	targetID := input.Arg(targetArg.Name)
+
+	// The server may have been removed since the channel subscribed
+	server := p.commandServerName(args, input.Flags)
+
+	removed, err := p.removeSubscription(args.ChannelId, server, targetID)
+	if err != nil {
+		return p.postEphemeral("Error removing subscription: `" + err.Error() + "`")
+	}
+
+	if !removed {
+		return p.postEphemeral("This channel is not subscribed to `" + targetID + "`" + p.serverNote(server))
+	}
+
+	return p.postEphemeral("This channel is no longer subscribed to `" + targetID + "`" + p.serverNote(server))
+}
+
+func (p *Plugin) executeCommandTriggerListSubscriptions(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	subs, err := p.channelSubscriptions(args.ChannelId)
+	if err != nil {
+		return p.postEphemeral("Error listing subscriptions: `" + err.Error() + "`")
+	}
+
+	if len(subs) == 0 {
+		return p.postEphemeral("This channel has no TeamCity subscriptions")
+	}
+
+	message := "**TeamCity Subscriptions:**\n\n"
+
+	for _, sub := range subs {
+		message += fmt.Sprintf(" - [%s (ID: %s)](%s)%s - %s - %s\n",
+			sub.TargetName, sub.TargetID, sub.WebURL, p.serverNote(sub.ServerName()), sub.describeTargetType(), sub.Filter.String())
+	}
+
+	return p.postEphemeral(message)
+}
+
+func (s *subscription) describeTargetType() string {
+	if s.TargetType == subscriptionTargetProject {
+		return "project"
+	}
+
+	return "build configuration"
+}
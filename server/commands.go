@@ -0,0 +1,813 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	commandTriggerHelp = "help"
+
+	commandHelpIntro  = "Use one of the following slash commands to interact with TeamCity from within Mattermost\n"
+	commandHelpFooter = "Add `--server=<name>` to a command to use another TeamCity server than the one of the channel, and `--all` to show all projects in a channel linked to a project. " +
+		"See `/teamcity help <command>` for the arguments and options of a command"
+)
+
+// argType is the type of a positional argument of a slash command
+type argType int
+
+const (
+	// argText is a single word, or several words in quotes
+	argText argType = iota
+	// argInt is a positive integer, e.g. a build ID
+	argInt
+	// argRest takes all the remaining words, e.g. a comment
+	argRest
+	// argID is the ID of a TeamCity project or build configuration
+	argID
+)
+
+// commandArg is a positional argument of a slash command
+type commandArg struct {
+	// Name is shown in the usage, e.g. <build_id>
+	Name string
+	// Help describes the argument. It is also used in error messages, e.g. "Invalid Build ID".
+	Help     string
+	Type     argType
+	Optional bool
+	// Suggest is the kind of autocomplete suggestions for the argument, if any
+	Suggest string
+}
+
+// commandFlag is an option of a slash command, written `--name=value`, `--name value` or `--name`
+// for boolean flags
+type commandFlag struct {
+	Name string
+	// Short is a single letter alias taking the next word as value, e.g. -p
+	Short string
+	// Value is the placeholder of the value shown in the usage, or "" for boolean flags
+	Value   string
+	Help    string
+	Suggest string
+}
+
+// command is a slash command or a group of subcommands. Commands are declared in commandTree,
+// which drives the parsing, the help and the autocomplete of /teamcity.
+type command struct {
+	Name        string
+	Help        string
+	Args        []*commandArg
+	Flags       []*commandFlag
+	SubCommands []*command
+	// RoleID hides the command from the autocomplete of other users
+	RoleID string
+	// BeforeInstall commands may run before the plugin is installed
+	BeforeInstall bool
+	// WhenDisabled commands may run where the plugin is disabled
+	WhenDisabled bool
+	// Execute runs the command. Groups without it show their subcommands.
+	Execute func(p *Plugin, args *model.CommandArgs, input *commandInput) *model.CommandResponse
+
+	// path is the full command, e.g. "/teamcity build start"
+	path string
+}
+
+// commandInput is the input of a slash command, parsed according to its definition
+type commandInput struct {
+	// Flags are the flags given, by name. Short aliases are stored under the name of the flag.
+	Flags commandFlags
+
+	command *command
+	args    map[string]string
+	ints    map[string]int64
+}
+
+// UsageError returns a message for the user, followed by the usage of the command
+func (in *commandInput) UsageError(message string) string {
+	return in.command.usageError(message)
+}
+
+// Arg returns the value of a positional argument, or "" if it was not given
+func (in *commandInput) Arg(name string) string {
+	return in.args[name]
+}
+
+// Int returns the value of an argInt argument, or 0 if it was not given
+func (in *commandInput) Int(name string) int64 {
+	return in.ints[name]
+}
+
+var (
+	// serverFlag is accepted by the commands talking to a TeamCity server
+	serverFlag = &commandFlag{Name: "server", Value: "name", Help: "TeamCity server to use instead of the one of the channel", Suggest: autocompleteServers}
+	// allFlag is accepted by the commands limited to the project linked to the channel
+	allFlag = &commandFlag{Name: "all", Help: "Show all projects, not only the project linked to the channel"}
+
+	buildIDArg = &commandArg{Name: "build_id", Help: "Build ID", Type: argInt, Suggest: autocompleteBuilds}
+	targetArg  = &commandArg{Name: "project_id|build_type_id", Help: "Project or build configuration ID", Type: argID, Suggest: autocompleteTargets}
+)
+
+// commandTree returns the definition of the /teamcity slash command
+func commandTree() *command {
+	root := &command{
+		Name: "/" + commandTriggerHooks,
+		SubCommands: []*command{
+			{
+				Name: commandTriggerInstall,
+				Help: "Set up the TeamCity plugin, or add another TeamCity server with a name (system administrators only)",
+				Args: []*commandArg{
+					{Name: "teamcity url", Help: "URL of the TeamCity server"},
+					{Name: "token", Help: "Access token of a TeamCity user"},
+				},
+				Flags: []*commandFlag{
+					{Name: "server", Value: "name", Help: "Name of an additional TeamCity server"},
+					{Name: "default", Help: "Use the server when commands do not name one"},
+				},
+				SubCommands: []*command{
+					{
+						Name:    commandTriggerInstallStatus,
+						Help:    "Show the configured TeamCity server and check the connection (system administrators only)",
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerInstallStatus,
+					},
+				},
+				RoleID:        model.SYSTEM_ADMIN_ROLE_ID,
+				BeforeInstall: true,
+				WhenDisabled:  true,
+				Execute:       (*Plugin).executeCommandTriggerInstall,
+			},
+			{
+				Name: commandTriggerServers,
+				Help: "List the TeamCity servers",
+				SubCommands: []*command{
+					{
+						Name:    commandTriggerServersUse,
+						Help:    "Use another TeamCity server than the default one in this channel (channel administrators only)",
+						Args:    []*commandArg{{Name: "name", Help: "Name of the TeamCity server", Suggest: autocompleteServers}},
+						Execute: (*Plugin).executeCommandTriggerUseServer,
+					},
+					{
+						Name:    commandTriggerServersReset,
+						Help:    "Use the default TeamCity server in this channel again (channel administrators only)",
+						Execute: (*Plugin).executeCommandTriggerUseServer,
+					},
+					{
+						Name:    commandTriggerServersRm,
+						Help:    "Remove a TeamCity server (system administrators only)",
+						Args:    []*commandArg{{Name: "name", Help: "Name of the TeamCity server", Suggest: autocompleteServers}},
+						RoleID:  model.SYSTEM_ADMIN_ROLE_ID,
+						Execute: (*Plugin).executeCommandTriggerRemoveServer,
+					},
+				},
+				Execute: (*Plugin).executeCommandTriggerListServers,
+			},
+			{
+				Name:    commandTriggerHealth,
+				Help:    "Show whether the TeamCity servers could be reached during the last checks",
+				Execute: (*Plugin).executeCommandTriggerHealth,
+			},
+			{
+				Name:         commandTriggerConnect,
+				Help:         "Connect your TeamCity account with one of your TeamCity access tokens",
+				Args:         []*commandArg{{Name: "token", Help: "Access token created in your TeamCity profile"}},
+				Flags:        []*commandFlag{serverFlag},
+				WhenDisabled: true,
+				Execute:      (*Plugin).executeCommandTriggerConnect,
+			},
+			{
+				Name:         commandTriggerDisconnect,
+				Help:         "Disconnect your TeamCity account",
+				Flags:        []*commandFlag{serverFlag},
+				WhenDisabled: true,
+				Execute:      (*Plugin).executeCommandTriggerDisconnect,
+			},
+			{
+				Name: commandTriggerChannel,
+				Help: "Show the project, server and subscriptions of this channel",
+				SubCommands: []*command{
+					{
+						Name:    commandTriggerChannelLink,
+						Help:    "Make list builds, build start and stats show the builds of a project in this channel, or in this team (channel or team administrators only)",
+						Args:    []*commandArg{{Name: "project_id", Help: "Project ID", Type: argID, Suggest: autocompleteProjects}},
+						Flags:   []*commandFlag{{Name: scopeTeam, Help: "Link the project to the whole team"}, serverFlag},
+						Execute: (*Plugin).executeCommandTriggerChannelLink,
+					},
+					{
+						Name:    commandTriggerChannelUnlink,
+						Help:    "Remove the project of this channel or team",
+						Flags:   []*commandFlag{{Name: scopeTeam, Help: "Remove the project of the team"}},
+						Execute: (*Plugin).executeCommandTriggerChannelUnlink,
+					},
+					{
+						Name:    commandTriggerChannelInfo,
+						Help:    "Show the project, server and subscriptions of this channel",
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerChannelInfo,
+					},
+				},
+				Flags:   []*commandFlag{serverFlag},
+				Execute: (*Plugin).executeCommandTriggerChannelInfo,
+			},
+			{
+				Name: commandTriggerList,
+				Help: "List projects or builds",
+				SubCommands: []*command{
+					{
+						Name:    commandTriggerListProjects,
+						Help:    "List projects with description and project id",
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerListProjects,
+					},
+					{
+						Name:    commandTriggerListBuilds,
+						Help:    "List builds with description, project, and build id",
+						Flags:   []*commandFlag{allFlag, serverFlag},
+						Execute: (*Plugin).executeCommandTriggerListBuilds,
+					},
+				},
+			},
+			{
+				Name: commandTriggerBuild,
+				Help: "Start, cancel or show builds, their logs, failed tests and changes",
+				SubCommands: []*command{
+					{
+						Name: commandTriggerBuildStart,
+						Help: "Trigger a build on a specific build configuration. Without a build configuration, or with `--dialog`, a form asks for the parameters declared by the build configuration",
+						Args: []*commandArg{
+							{Name: "build_type_id", Help: "Build configuration ID", Type: argID, Optional: true, Suggest: autocompleteBuildTypes},
+						},
+						Flags: []*commandFlag{
+							{Name: "branch", Value: "branch", Help: "Branch to build", Suggest: autocompleteBranches},
+							{Name: "param", Short: "p", Value: "name=value", Help: "Build parameter, may be repeated"},
+							{Name: "comment", Value: "comment", Help: "Comment of the build"},
+							{Name: "agent", Value: "agent", Help: "ID or name of the agent to run the build on"},
+							{Name: "top", Help: "Put the build at the top of the queue"},
+							{Name: "dialog", Help: "Open the start build form"},
+							allFlag,
+							serverFlag,
+						},
+						Execute: (*Plugin).executeCommandTriggerBuildStart,
+					},
+					{
+						Name: commandTriggerBuildCancel,
+						Help: "Cancel a build",
+						Args: []*commandArg{
+							buildIDArg,
+							{Name: "comment", Help: "Comment of the cancellation", Type: argRest, Optional: true},
+						},
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerBuildCancel,
+					},
+					{
+						Name:    commandTriggerBuildStatus,
+						Help:    "Get the status of a specific build",
+						Args:    []*commandArg{buildIDArg},
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerBuildStatus,
+					},
+					{
+						Name: commandTriggerBuildLog,
+						Help: "Post the last lines of the log of a build, or the lines matching a pattern, as a code block or an attached file",
+						Args: []*commandArg{buildIDArg},
+						Flags: []*commandFlag{
+							{Name: "tail", Value: "lines", Help: fmt.Sprintf("Number of lines to post, %d by default", defaultLogTail)},
+							{Name: "grep", Value: "pattern", Help: "Post the lines matching a regular expression instead, ignoring case"},
+							{Name: "context", Value: "lines", Help: fmt.Sprintf("Number of lines to post before and after each matching line, %d by default", defaultLogContext)},
+							serverFlag,
+						},
+						Execute: (*Plugin).executeCommandTriggerBuildLog,
+					},
+					{
+						Name:    commandTriggerBuildTests,
+						Help:    "List the build problems and failed tests of a finished build, with whether they are new, the build they first failed in and their duration",
+						Args:    []*commandArg{buildIDArg},
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerBuildTests,
+					},
+					{
+						Name:    commandTriggerBuildChanges,
+						Help:    "List the VCS changes of a build with their revision, author, comment and number of files",
+						Args:    []*commandArg{buildIDArg},
+						Flags:   []*commandFlag{serverFlag},
+						Execute: (*Plugin).executeCommandTriggerBuildChanges,
+					},
+				},
+			},
+			{
+				Name: commandTriggerNotifications,
+				Help: "Show whether the bot sends you a direct message when your changes are in the first failing build of a build configuration",
+				SubCommands: []*command{
+					{
+						Name:         commandTriggerNotificationsOn,
+						Help:         "Receive direct messages about builds your changes broke",
+						WhenDisabled: true,
+						Execute:      (*Plugin).executeCommandTriggerNotificationsOn,
+					},
+					{
+						Name:         commandTriggerNotificationsOff,
+						Help:         "Stop the direct messages about builds your changes broke",
+						WhenDisabled: true,
+						Execute:      (*Plugin).executeCommandTriggerNotificationsOff,
+					},
+				},
+				WhenDisabled: true,
+				Execute:      (*Plugin).executeCommandTriggerNotifications,
+			},
+			{
+				Name:    commandTriggerStats,
+				Help:    "Basic build statistics (Project Level and Build Configuration level)",
+				Flags:   []*commandFlag{allFlag, serverFlag},
+				Execute: (*Plugin).executeCommandTriggerStats,
+			},
+			{
+				Name: commandTriggerSubscribe,
+				Help: "Post build events of a project or build configuration to this channel. Events: queued, started, succeeded, failed, fixed, broken, cancelled",
+				Args: []*commandArg{
+					targetArg,
+					{Name: "events", Help: "Comma separated events to post", Type: argRest, Optional: true},
+				},
+				Flags: []*commandFlag{
+					{Name: "events", Value: "events", Help: "Events to post: queued, started, succeeded, failed, fixed, broken, cancelled"},
+					{Name: "branch", Value: "branches", Help: "Comma separated branches to post builds of, e.g. main,release/*"},
+					{Name: "exclude-personal", Help: "Do not post personal builds"},
+					serverFlag,
+				},
+				Execute: (*Plugin).executeCommandTriggerSubscribe,
+			},
+			{
+				Name:    commandTriggerUnsubscribe,
+				Help:    "Stop posting build events to this channel",
+				Args:    []*commandArg{targetArg},
+				Flags:   []*commandFlag{serverFlag},
+				Execute: (*Plugin).executeCommandTriggerUnsubscribe,
+			},
+			{
+				Name: commandTriggerSubscriptions,
+				Help: "List the subscriptions of this channel",
+				SubCommands: []*command{
+					{
+						Name:    commandTriggerSubscriptionsList,
+						Help:    "List the subscriptions of this channel",
+						Execute: (*Plugin).executeCommandTriggerListSubscriptions,
+					},
+				},
+				Execute: (*Plugin).executeCommandTriggerListSubscriptions,
+			},
+			{
+				Name: commandTriggerDisable,
+				Help: "Disable the plugin everywhere (system administrators), in this team (team administrators) or in this channel (channel administrators)",
+				Flags: []*commandFlag{
+					{Name: scopeTeam, Help: "Disable the plugin in this team"},
+					{Name: scopeChannel, Help: "Disable the plugin in this channel"},
+				},
+				WhenDisabled: true,
+				Execute:      (*Plugin).executeCommandTriggerDisable,
+			},
+			{
+				Name: commandTriggerEnable,
+				Help: "Enable the plugin again",
+				Flags: []*commandFlag{
+					{Name: scopeTeam, Help: "Enable the plugin in this team"},
+					{Name: scopeChannel, Help: "Enable the plugin in this channel"},
+				},
+				WhenDisabled: true,
+				Execute:      (*Plugin).executeCommandTriggerEnable,
+			},
+			{
+				Name:          commandTriggerHelp,
+				Help:          "Show the commands, or the arguments and options of a command",
+				Args:          []*commandArg{{Name: "command", Help: "Command to describe, e.g. build start", Type: argRest, Optional: true}},
+				BeforeInstall: true,
+				WhenDisabled:  true,
+				Execute:       (*Plugin).executeCommandTriggerHelp,
+			},
+		},
+	}
+
+	root.setPaths("")
+
+	return root
+}
+
+func (c *command) setPaths(parent string) {
+	c.path = strings.TrimSpace(parent + " " + c.Name)
+
+	for _, sub := range c.SubCommands {
+		sub.setPaths(c.path)
+	}
+}
+
+// find returns the commands named by the leading words, from the top level command to the most
+// specific one, and the words left
+func (c *command) find(words []string) ([]*command, []string) {
+	var found []*command
+
+	current := c
+	for len(words) > 0 {
+		sub := current.subCommand(words[0])
+		if sub == nil {
+			break
+		}
+
+		found = append(found, sub)
+		current = sub
+		words = words[1:]
+	}
+
+	return found, words
+}
+
+func (c *command) subCommand(name string) *command {
+	for _, sub := range c.SubCommands {
+		if strings.EqualFold(sub.Name, name) {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+func (c *command) flag(name string) *commandFlag {
+	for _, flag := range c.Flags {
+		if strings.EqualFold(flag.Name, name) || (flag.Short != "" && strings.EqualFold(flag.Short, name)) {
+			return flag
+		}
+	}
+
+	return nil
+}
+
+// scan splits the words following the command into positional arguments and flags, according
+// to the flags of the command. It also returns the unknown flags, and the flag given last without
+// its value, if any, for parse to report. Words after `--` are positional.
+func (c *command) scan(words []string) ([]string, commandFlags, []string, *commandFlag) {
+	flags := commandFlags{}
+	var positional, unknown []string
+
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+
+		if word == "--" {
+			positional = append(positional, words[i+1:]...)
+			break
+		}
+
+		name, value, hasValue := "", "", false
+
+		switch {
+		case strings.HasPrefix(word, "--") && len(word) > 2:
+			name = word[2:]
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value, hasValue = name[:eq], name[eq+1:], true
+			}
+		case len(word) == 2 && word[0] == '-' && (word[1] >= 'a' && word[1] <= 'z' || word[1] >= 'A' && word[1] <= 'Z'):
+			name = word[1:]
+		default:
+			positional = append(positional, word)
+			continue
+		}
+
+		flag := c.flag(name)
+		if flag == nil || (len(name) == 1 && flag.Short == "") {
+			unknown = append(unknown, strings.SplitN(word, "=", 2)[0])
+			continue
+		}
+
+		switch {
+		case flag.Value == "" && !hasValue:
+			value = "true"
+		case flag.Value != "" && !hasValue:
+			if i+1 == len(words) {
+				return positional, flags, unknown, flag
+			}
+			i++
+			value = words[i]
+		}
+
+		flags[flag.Name] = append(flags[flag.Name], value)
+	}
+
+	return positional, flags, unknown, nil
+}
+
+// parse reads the arguments and flags of the command from the words following it. It returns a
+// message for the user if they do not match the definition of the command.
+func (c *command) parse(words []string) (*commandInput, string) {
+	positional, flags, unknown, missing := c.scan(words)
+
+	if missing != nil {
+		return nil, fmt.Sprintf("Please provide a value for `--%s`, e.g. `--%s=<%s>`", missing.Name, missing.Name, missing.Value)
+	}
+
+	if len(unknown) > 0 {
+		return nil, "Unknown options: `" + strings.Join(unknown, "`, `") + "`"
+	}
+
+	input := &commandInput{
+		Flags:   flags,
+		command: c,
+		args:    map[string]string{},
+		ints:    map[string]int64{},
+	}
+
+	for _, arg := range c.Args {
+		if arg.Type == argRest {
+			input.args[arg.Name] = strings.Join(positional, " ")
+			positional = nil
+		} else if len(positional) > 0 {
+			input.args[arg.Name] = positional[0]
+			positional = positional[1:]
+		}
+
+		value := input.args[arg.Name]
+		if value == "" {
+			if !arg.Optional {
+				return nil, missingArgument(arg.Name)
+			}
+			continue
+		}
+
+		if arg.Type == argInt {
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || number <= 0 {
+				return nil, "Invalid " + arg.Help + ": `" + value + "`"
+			}
+			input.ints[arg.Name] = number
+		}
+
+		if arg.Type == argID && !validTeamCityID(value) {
+			return nil, "Invalid " + arg.Help + ": `" + value + "`"
+		}
+	}
+
+	if len(positional) > 0 {
+		if len(c.SubCommands) > 0 {
+			return nil, "Unknown command `" + c.path + " " + positional[0] + "`"
+		}
+		return nil, "Too many arguments: `" + strings.Join(positional, "`, `") + "`"
+	}
+
+	return input, ""
+}
+
+// synopsis returns the command with its arguments, e.g. `/teamcity build cancel <build_id>
+// [<comment>]`. The flags shared by most commands are left out unless all is true.
+func (c *command) synopsis(all bool) string {
+	parts := []string{c.path}
+
+	for _, arg := range c.Args {
+		if arg.Optional {
+			parts = append(parts, "[<"+arg.Name+">]")
+		} else {
+			parts = append(parts, "<"+arg.Name+">")
+		}
+	}
+
+	for _, flag := range c.Flags {
+		if !all && (flag == serverFlag || flag == allFlag) {
+			continue
+		}
+		parts = append(parts, "["+flag.usage()+"]")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (f *commandFlag) usage() string {
+	if f.Value == "" {
+		return "--" + f.Name
+	}
+
+	if f.Short != "" {
+		return "-" + f.Short + " <" + f.Value + ">"
+	}
+
+	return "--" + f.Name + "=<" + f.Value + ">"
+}
+
+// usageError returns a message about invalid input followed by the usage of the command
+// missingArgument returns the message for a positional argument that was not given
+func missingArgument(name string) string {
+	return "Please provide `<" + name + ">`"
+}
+
+func (c *command) usageError(message string) string {
+	return message + "\nUsage: `" + c.synopsis(true) + "`, see `/" + commandTriggerHooks + " " + commandTriggerHelp + strings.TrimPrefix(c.path, "/"+commandTriggerHooks) + "`"
+}
+
+// overview lists the commands and their subcommands
+func (c *command) overview() string {
+	var lines []string
+
+	var walk func(*command)
+	walk = func(current *command) {
+		if current.Execute != nil && current != c {
+			lines = append(lines, "- `"+current.synopsis(false)+"` - "+current.Help+"\n")
+		}
+		for _, sub := range current.SubCommands {
+			walk(sub)
+		}
+	}
+	walk(c)
+
+	return strings.Join(lines, "")
+}
+
+// helpText describes the command, its arguments and its options, or lists its subcommands
+func (c *command) helpText() string {
+	if c.Name == "/"+commandTriggerHooks {
+		return commandHelpIntro + c.overview() + commandHelpFooter
+	}
+
+	message := "**`" + c.synopsis(true) + "`**\n" + c.Help + "\n"
+
+	if len(c.Args) > 0 {
+		message += "\nArguments:\n"
+		for _, arg := range c.Args {
+			message += "- `<" + arg.Name + ">` - " + arg.Help
+			if arg.Optional {
+				message += " (optional)"
+			}
+			message += "\n"
+		}
+	}
+
+	if len(c.Flags) > 0 {
+		message += "\nOptions:\n"
+		for _, flag := range c.Flags {
+			message += "- `" + flag.usage() + "`"
+			if flag.Short != "" {
+				message += ", `--" + flag.Name + "=<" + flag.Value + ">`"
+			}
+			message += " - " + flag.Help + "\n"
+		}
+	}
+
+	if len(c.SubCommands) > 0 {
+		message += "\nCommands:\n" + c.overview()
+	}
+
+	return message
+}
+
+// parseCommandLine reads a slash command with the definition of the command it names, like
+// executeCommandHooks does, but accepts partial commands such as the ones the autocomplete
+// sends. It returns the command, its positional arguments and its flags, ignoring the problems
+// parse reports.
+func parseCommandLine(line string) (*command, []string, commandFlags) {
+	root := commandTree()
+
+	words, err := splitCommand(line)
+	if err != nil {
+		words = strings.Fields(line)
+	}
+
+	if len(words) == 0 || !strings.EqualFold(words[0], root.Name) {
+		return root, nil, commandFlags{}
+	}
+
+	found, rest := root.find(words[1:])
+
+	cmd := root
+	if len(found) > 0 {
+		cmd = found[len(found)-1]
+	}
+
+	positional, flags, _, _ := cmd.scan(rest)
+
+	return cmd, positional, flags
+}
+
+func (p *Plugin) executeCommandHooks(args *model.CommandArgs) *model.CommandResponse {
+	root := commandTree()
+
+	words, err := splitCommand(args.Command)
+	if err != nil {
+		return p.postEphemeral("Could not read the command: " + err.Error())
+	}
+
+	if len(words) == 0 || !strings.EqualFold(words[0], root.Name) {
+		return p.postEphemeral(root.helpText())
+	}
+
+	found, rest := root.find(words[1:])
+	if len(found) == 0 {
+		if len(rest) > 0 {
+			return p.postEphemeral("Unknown command `" + root.Name + " " + rest[0] + "`\n" + root.helpText())
+		}
+		return p.postEphemeral(root.helpText())
+	}
+
+	top, cmd := found[0], found[len(found)-1]
+
+	if !top.BeforeInstall && !p.getConfiguration().Installed() {
+		return p.postEphemeral(errorNotInstalled)
+	}
+
+	if !top.WhenDisabled {
+		if errResponse := p.checkEnabled(args); errResponse != nil {
+			return errResponse
+		}
+	}
+
+	for _, word := range rest {
+		if word == "--help" {
+			return p.postEphemeral(cmd.helpText())
+		}
+	}
+
+	if cmd.Execute == nil {
+		if len(rest) > 0 {
+			return p.postEphemeral("Unknown command `" + cmd.path + " " + rest[0] + "`\n" + cmd.helpText())
+		}
+		return p.postEphemeral(cmd.helpText())
+	}
+
+	input, problem := cmd.parse(rest)
+	if problem != "" {
+		return p.postEphemeral(cmd.usageError(problem))
+	}
+
+	return cmd.Execute(p, args, input)
+}
+
+func (p *Plugin) executeCommandTriggerHelp(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	root := commandTree()
+
+	words, err := splitCommand(input.Arg("command"))
+	if err != nil {
+		return p.postEphemeral("Could not read the command: " + err.Error())
+	}
+
+	found, rest := root.find(words)
+	if len(rest) > 0 {
+		return p.postEphemeral("Unknown command `" + strings.Join(words, " ") + "`\n" + root.helpText())
+	}
+
+	if len(found) == 0 {
+		return p.postEphemeral(root.helpText())
+	}
+
+	return p.postEphemeral(found[len(found)-1].helpText())
+}
+
+// autocompleteData returns the autocomplete tree of the command. Arguments with suggestions are
+// completed by handleAutocomplete. Boolean flags are only shown in the hint, as the autocomplete
+// gives every named argument a value. Commands taking arguments do not list their subcommands.
+func (c *command) autocompleteData(trigger string) *model.AutocompleteData {
+	var hint []string
+	for _, arg := range c.Args {
+		if arg.Optional {
+			hint = append(hint, "["+arg.Name+"]")
+		} else {
+			hint = append(hint, "<"+arg.Name+">")
+		}
+	}
+
+	if len(c.Args) == 0 && len(c.SubCommands) > 0 {
+		var names []string
+		for _, sub := range c.SubCommands {
+			names = append(names, sub.Name)
+		}
+		hint = append(hint, "["+strings.Join(names, "|")+"]")
+	}
+
+	for _, flag := range c.Flags {
+		if flag.Value == "" {
+			hint = append(hint, "[--"+flag.Name+"]")
+		}
+	}
+
+	data := model.NewAutocompleteData(trigger, strings.Join(hint, " "), c.Help)
+	data.RoleID = c.RoleID
+
+	if len(c.Args) == 0 && len(c.SubCommands) > 0 {
+		for _, sub := range c.SubCommands {
+			data.AddCommand(sub.autocompleteData(sub.Name))
+		}
+		return data
+	}
+
+	for _, arg := range c.Args {
+		if arg.Suggest != "" {
+			data.AddDynamicListArgument(arg.Help, autocompleteURL(arg.Suggest), !arg.Optional)
+		} else {
+			data.AddTextArgument(arg.Help, "<"+arg.Name+">", "")
+		}
+	}
+
+	for _, flag := range c.Flags {
+		switch {
+		case flag.Value == "":
+		case flag.Suggest != "":
+			data.AddNamedDynamicListArgument(flag.Name, flag.Help, autocompleteURL(flag.Suggest), false)
+		default:
+			data.AddNamedTextArgument(flag.Name, flag.Help, "<"+flag.Value+">", "", false)
+		}
+	}
+
+	return data
+}
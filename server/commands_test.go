@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	for command, expected := range map[string][]string{
+		"/teamcity  build\tstart   Backend_Build ":           {"/teamcity", "build", "start", "Backend_Build"},
+		`/teamcity build cancel 12 "flaky test, retrying"`:   {"/teamcity", "build", "cancel", "12", "flaky test, retrying"},
+		`/teamcity build start X --comment="a b" -p 'c=d e'`: {"/teamcity", "build", "start", "X", "--comment=a b", "-p", "c=d e"},
+		"/teamcity build cancel 12 it's broken":              {"/teamcity", "build", "cancel", "12", "it's", "broken"},
+		`/teamcity build cancel 12 say \"hi\" C:\path`:       {"/teamcity", "build", "cancel", "12", `say`, `"hi"`, `C:\path`},
+		"/teamcity build cancel 12 “smart quotes”":           {"/teamcity", "build", "cancel", "12", "smart quotes"},
+		`/teamcity build start X --comment ""`:               {"/teamcity", "build", "start", "X", "--comment", ""},
+		"":                                                   nil,
+	} {
+		words, err := splitCommand(command)
+		assert.Nil(err, command)
+		assert.Equal(expected, words, command)
+	}
+
+	_, err := splitCommand(`/teamcity build cancel 12 "unbalanced`)
+	assert.NotNil(err)
+}
+
+func TestCommandRouter(t *testing.T) {
+	assert := assert.New(t)
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	response := plugin.executeCommandHooks(generateArgs("build cancel"))
+	assert.Contains(response.Text, "Please provide `<build_id>`")
+	assert.Contains(response.Text, "Usage: `/teamcity build cancel <build_id> [<comment>] [--server=<name>]`")
+
+	response = plugin.executeCommandHooks(generateArgs("build status 1 2"))
+	assert.Contains(response.Text, "Too many arguments: `2`")
+
+	response = plugin.executeCommandHooks(generateArgs("build status 1 --verbose"))
+	assert.Contains(response.Text, "Unknown options: `--verbose`")
+
+	// IDs cannot add dimensions to the locators they are put in
+	response = plugin.executeCommandHooks(generateArgs(`build start "X,project:(id:Other)"`))
+	assert.Contains(response.Text, "Invalid Build configuration ID: `X,project:(id:Other)`")
+
+	response = plugin.executeCommandHooks(generateArgs("build start Backend_Build --branch"))
+	assert.Contains(response.Text, "Please provide a value for `--branch`")
+
+	response = plugin.executeCommandHooks(generateArgs(`build cancel 2 "unbalanced`))
+	assert.Contains(response.Text, "Could not read the command: unterminated quote")
+
+	response = plugin.executeCommandHooks(generateArgs("build deploy"))
+	assert.Contains(response.Text, "Unknown command `/teamcity build deploy`")
+
+	response = plugin.executeCommandHooks(generateArgs("deploy"))
+	assert.Contains(response.Text, "Unknown command `/teamcity deploy`")
+
+	response = plugin.executeCommandHooks(generateArgs("build\t status  1"))
+	assert.Contains(response.Text, "TEAMCITY BUILD STATUS")
+
+	// Without a trigger, e.g. from the API, build start cannot open the dialog
+	args := generateArgs("build start")
+	args.TriggerId = ""
+	response = plugin.executeCommandHooks(args)
+	assert.True(strings.HasPrefix(response.Text, "Please provide `<build_type_id>`\nUsage: `/teamcity build start [<build_type_id>] "), response.Text)
+	assert.True(strings.HasSuffix(response.Text, "`, see `/teamcity help build start`"), response.Text)
+
+	// The trigger is matched regardless of case, as by the router
+	args = generateArgs("help")
+	args.Command = "/TeamCity help"
+	response, appErr := plugin.ExecuteCommand(nil, args)
+	assert.Nil(appErr)
+	assert.Contains(response.Text, "/teamcity build start")
+
+	response = plugin.executeCommandHooks(generateArgs("help build start"))
+	assert.Contains(response.Text, "**`/teamcity build start [<build_type_id>]")
+	assert.Contains(response.Text, "- `-p <name=value>`, `--param=<name=value>` - Build parameter, may be repeated")
+
+	response = plugin.executeCommandHooks(generateArgs("build start --help"))
+	assert.Contains(response.Text, "**`/teamcity build start [<build_type_id>]")
+
+	response = plugin.executeCommandHooks(generateArgs("help build"))
+	assert.Contains(response.Text, "- `/teamcity build cancel <build_id> [<comment>]` - Cancel a build")
+
+	response = plugin.executeCommandHooks(generateArgs("help deploy"))
+	assert.Contains(response.Text, "Unknown command `deploy`")
+}
+
+func TestCommandParse(t *testing.T) {
+	assert := assert.New(t)
+
+	_, found := commandTree().find([]string{"build", "start", "Backend_Build"})
+	assert.Equal([]string{"Backend_Build"}, found)
+
+	commands, _ := commandTree().find([]string{"build", "start"})
+	start := commands[len(commands)-1]
+
+	input, problem := start.parse([]string{"Backend_Build", "-p", "env.FOO=bar", "--param=env.BAZ=1", "--BRANCH", "feature/x", "--top", "--comment=a b"})
+	assert.Empty(problem)
+	assert.Equal("Backend_Build", input.Arg("build_type_id"))
+	assert.Equal([]string{"env.FOO=bar", "env.BAZ=1"}, input.Flags["param"])
+	assert.Equal("feature/x", input.Flags.String("branch"))
+	assert.Equal("a b", input.Flags.String("comment"))
+	assert.True(input.Flags.Bool("top"))
+
+	input, problem = start.parse([]string{"--dialog", "Backend_Build"})
+	assert.Empty(problem)
+	assert.Equal("Backend_Build", input.Arg("build_type_id"), "boolean flags take no value")
+
+	commands, _ = commandTree().find([]string{"build", "cancel"})
+	cancel := commands[len(commands)-1]
+
+	input, problem = cancel.parse([]string{"12", "flaky", "test", "--server", "infra"})
+	assert.Empty(problem)
+	assert.Equal(int64(12), input.Int("build_id"))
+	assert.Equal("flaky test", input.Arg("comment"))
+	assert.Equal("infra", input.Flags.String("server"))
+
+	_, problem = cancel.parse([]string{"-5"})
+	assert.Equal("Invalid Build ID: `-5`", problem)
+
+	_, problem = cancel.parse([]string{"--", "--5"})
+	assert.Equal("Invalid Build ID: `--5`", problem)
+}
@@ -2,20 +2,57 @@ package main
 
 import (
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
-	"net/url"
 
-	"github.com/icelander/teamcity-sdk-go/teamcity"
+	"github.com/mattermost/mattermost-server/v5/model"
 )
 
-const defaultListBuildsMax = 5
+const (
+	defaultListBuildsMax = 5
+
+	defaultPollingInterval = 60 * time.Second
+	minPollingInterval     = 10 * time.Second
+
+	defaultFailureSummaryCount = 10
+)
 
 type configuration struct {
-	disabled          bool
 	TeamCityURL       string
 	TeamCityToken     string
 	TeamCityMaxBuilds int
+	WebhookSecret     string
+	EnablePolling     bool
+	PollingInterval   string
+	PollingScope      string
+
+	FailureSummaryCount string
+
+	AllowSystemTokenForReads     bool
+	Permissions                  string
+	MatchChangeAuthorsByUsername bool
+
+	// TeamCityServers are the servers added with /teamcity install --server, besides the server
+	// of TeamCityURL and TeamCityToken
+	TeamCityServers []*teamCityServer
+
+	// teamCityToken is TeamCityToken decrypted, and teamCityTokenError explains why TeamCityToken
+	// could not be decrypted or saved encrypted
+	teamCityToken      string
+	teamCityTokenError string
+}
+
+// GetTeamCityToken returns the decrypted system access token
+func (c *configuration) GetTeamCityToken() string {
+	if c.teamCityToken != "" || strings.HasPrefix(c.TeamCityToken, encryptedPrefix) {
+		return c.teamCityToken
+	}
+
+	return c.TeamCityToken
 }
 
 func (c *configuration) GetMaxBuilds() int {
@@ -26,26 +63,80 @@ func (c *configuration) GetMaxBuilds() int {
 	return c.TeamCityMaxBuilds
 }
 
-// Installed returns true if the plugin is configured and can connect to the server
-func (c *configuration) Installed() bool {
-	if c.TeamCityToken == "" || c.TeamCityURL == "" {
-		return false
+// GetPollingInterval returns how often the poller queries TeamCity
+func (c *configuration) GetPollingInterval() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(c.PollingInterval))
+	if err != nil || seconds <= 0 {
+		return defaultPollingInterval
+	}
+
+	interval := time.Duration(seconds) * time.Second
+	if interval < minPollingInterval {
+		return minPollingInterval
+	}
+
+	return interval
+}
+
+// GetFailureSummaryCount returns how many failed tests and build problems are listed. 0 leaves
+// them out of failure notifications.
+func (c *configuration) GetFailureSummaryCount() int {
+	count, err := strconv.Atoi(strings.TrimSpace(c.FailureSummaryCount))
+	if err != nil || count < 0 {
+		return defaultFailureSummaryCount
 	}
 
-	_, err := url.ParseRequestURI(c.TeamCityURL)
+	return count
+}
+
+// GetPollingScope returns the project and build configuration IDs the poller is limited to on a
+// server. The IDs of other servers than the default one are written "<server>:<id>".
+func (c *configuration) GetPollingScope(server string) []string {
+	var scope []string
+
+	for _, value := range strings.Split(c.PollingScope, ",") {
+		idServer, id := splitScopedID(value)
+		if validTeamCityID(id) && c.scopeMatchesServer(idServer, server) {
+			scope = append(scope, id)
+		}
+	}
+
+	return scope
+}
+
+// splitScopedID splits a project or build configuration ID written "<server>:<id>" into the
+// server and the ID. The server is "" if the ID has none.
+func splitScopedID(value string) (string, string) {
+	value = strings.TrimSpace(value)
+
+	if colon := strings.Index(value, ":"); colon >= 0 {
+		return strings.TrimSpace(value[:colon]), strings.TrimSpace(value[colon+1:])
+	}
+
+	return "", value
+}
 
-	if err != nil {
-		return false
+// scopeMatchesServer returns true if an ID split by splitScopedID with the server scopeServer
+// belongs to server. IDs without a server belong to the default server.
+func (c *configuration) scopeMatchesServer(scopeServer, server string) bool {
+	if scopeServer != "" {
+		return strings.EqualFold(scopeServer, server)
 	}
 
-	client := teamcity.New(c.TeamCityURL, c.TeamCityToken)
-	_, err = client.Server()
+	defaultServer := c.GetDefaultServer()
+	return defaultServer != nil && strings.EqualFold(defaultServer.Name, server)
+}
 
-	if err != nil {
-		return false
+// Installed returns true if at least one server is configured with a URL and a token. Whether
+// the servers can be reached is tracked by the health monitor.
+func (c *configuration) Installed() bool {
+	for _, server := range c.GetServers() {
+		if server.Installed() {
+			return true
+		}
 	}
 
-	return true
+	return false
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -103,7 +194,120 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	if strings.HasPrefix(configuration.TeamCityToken, encryptedPrefix) {
+		token, err := p.decryptSecret(configuration.TeamCityToken)
+		if err != nil {
+			p.API.LogError("Could not decrypt the TeamCity access token, install the plugin again", "error", err.Error())
+			configuration.teamCityTokenError = "Could not decrypt the access token: `" + err.Error() + "`. Enter it again in the System Console or with `/teamcity install`."
+		}
+		configuration.teamCityToken = token
+	} else if configuration.TeamCityToken != "" {
+		// The token was entered in the System Console. Encrypt it before the configuration is
+		// applied, so only the encrypted token is ever held or read by the plugin.
+		encrypted, err := p.encryptSecret(configuration.TeamCityToken)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt the TeamCity access token")
+		}
+
+		if err := p.saveEncryptedToken(configuration.TeamCityToken, encrypted); err != nil {
+			p.API.LogError("Could not save the encrypted TeamCity access token", "error", err.Error())
+			configuration.teamCityTokenError = "The access token is stored in plain text, saving it encrypted failed: `" + err.Error() + "`. Save the plugin settings again."
+		}
+
+		configuration.teamCityToken = configuration.TeamCityToken
+		configuration.TeamCityToken = encrypted
+	}
+
+	for _, server := range configuration.TeamCityServers {
+		if !strings.HasPrefix(server.Token, encryptedPrefix) {
+			continue
+		}
+
+		token, err := p.decryptSecret(server.Token)
+		if err != nil {
+			p.API.LogError("Could not decrypt the TeamCity access token, install the server again", "server", server.Name, "error", err.Error())
+			server.tokenError = "Could not decrypt the access token: `" + err.Error() + "`. Enter it again with `/teamcity install --server=" + server.Name + "`."
+		}
+		server.token = token
+	}
+
 	p.setConfiguration(configuration)
 
 	return nil
 }
+
+// saveEncryptedToken replaces the plain text system access token in the plugin configuration
+// with the encrypted token. Every node of a cluster is handed the plain text token, so only the
+// node holding savingTokenKey saves it, and only while the stored token is still token. Saving
+// calls OnConfigurationChange again, with the encrypted token.
+func (p *Plugin) saveEncryptedToken(token, encrypted string) error {
+	locked, appErr := p.API.KVSetWithOptions(savingTokenKey, []byte(encrypted), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(savingTokenTTL / time.Second),
+	})
+	if appErr != nil {
+		return errors.Wrap(appErr, "could not lock the access token")
+	}
+	if !locked {
+		// Another node is saving it
+		return nil
+	}
+	defer func() {
+		if appErr := p.API.KVDelete(savingTokenKey); appErr != nil {
+			p.API.LogWarn("Could not unlock the access token", "error", appErr.Error())
+		}
+	}()
+
+	if stored, _ := pluginConfigValue(p.API.GetPluginConfig(), "TeamCityToken").(string); stored != token {
+		return nil
+	}
+
+	return p.savePluginConfigValue("TeamCityToken", encrypted)
+}
+
+// pluginConfigValue returns a setting of the stored plugin configuration, whose keys the server
+// may have lower-cased
+func pluginConfigValue(pluginConfig map[string]interface{}, key string) interface{} {
+	for k, v := range pluginConfig {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// savePluginConfigValue durably stores a single setting in the plugin's server configuration,
+// leaving the other settings untouched. OnConfigurationChange picks up the new value.
+func (p *Plugin) savePluginConfigValue(key string, value interface{}) error {
+	return p.savePluginConfigValues(map[string]interface{}{key: value})
+}
+
+// savePluginConfigValues is savePluginConfigValue for several settings at once
+func (p *Plugin) savePluginConfigValues(values map[string]interface{}) error {
+	pluginConfig := map[string]interface{}{}
+	for k, v := range p.API.GetPluginConfig() {
+		pluginConfig[k] = v
+	}
+
+	var keys []string
+	for key, value := range values {
+		// The server may have lower-cased the stored keys
+		for k := range pluginConfig {
+			if strings.EqualFold(k, key) {
+				delete(pluginConfig, k)
+			}
+		}
+
+		pluginConfig[key] = value
+		keys = append(keys, key)
+	}
+
+	if appErr := p.API.SavePluginConfig(pluginConfig); appErr != nil {
+		sort.Strings(keys)
+		return errors.Wrapf(appErr, "failed to save %s", strings.Join(keys, ", "))
+	}
+
+	return nil
+}
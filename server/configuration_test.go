@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPollingInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(defaultPollingInterval, (&configuration{}).GetPollingInterval())
+	assert.Equal(defaultPollingInterval, (&configuration{PollingInterval: "soon"}).GetPollingInterval())
+	assert.Equal(minPollingInterval, (&configuration{PollingInterval: "1"}).GetPollingInterval())
+	assert.Equal(5*time.Minute, (&configuration{PollingInterval: " 300 "}).GetPollingInterval())
+}
+
+func TestGetFailureSummaryCount(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(defaultFailureSummaryCount, (&configuration{}).GetFailureSummaryCount())
+	assert.Equal(defaultFailureSummaryCount, (&configuration{FailureSummaryCount: "-1"}).GetFailureSummaryCount())
+	assert.Equal(0, (&configuration{FailureSummaryCount: "0"}).GetFailureSummaryCount())
+	assert.Equal(25, (&configuration{FailureSummaryCount: " 25 "}).GetFailureSummaryCount())
+}
+
+func TestGetPollingScope(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil((&configuration{}).GetPollingScope(defaultServerName))
+
+	c := &configuration{
+		TeamCityURL:     "http://teamcity",
+		TeamCityServers: []*teamCityServer{{Name: "infra", URL: "http://infra"}},
+		PollingScope:    "Backend, ,Frontend_Build, infra:Terraform",
+	}
+	assert.Equal([]string{"Backend", "Frontend_Build"}, c.GetPollingScope(defaultServerName))
+	assert.Equal([]string{"Terraform"}, c.GetPollingScope("infra"))
+}
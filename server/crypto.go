@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// encryptionKeyKey stores the key encrypting TeamCity tokens
+	encryptionKeyKey = "encryption_key"
+
+	// encryptedPrefix marks encrypted values in the plugin configuration
+	encryptedPrefix = "encrypted:"
+
+	// savingTokenKey is held by the node saving the encrypted system access token, and
+	// savingTokenTTL releases it if the node stops while saving
+	savingTokenKey = "saving_token"
+	savingTokenTTL = time.Minute
+)
+
+// ensureKVKey returns the random 32 byte key stored under name, generating it on first use.
+// All nodes of a cluster share the key through the KV store.
+func (p *Plugin) ensureKVKey(name string) ([]byte, error) {
+	key, appErr := p.API.KVGet(name)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not load key")
+	}
+
+	if key != nil {
+		return key, nil
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "could not generate key")
+	}
+
+	saved, appErr := p.API.KVSetWithOptions(name, key, model.PluginKVSetOptions{Atomic: true})
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not save key")
+	}
+
+	if !saved {
+		// Another node generated the key first
+		if key, appErr = p.API.KVGet(name); appErr != nil || key == nil {
+			return nil, errors.New("could not load key")
+		}
+	}
+
+	return key, nil
+}
+
+// encrypt encrypts text with AES-GCM, returning the nonce and cipher text base64 encoded
+func encrypt(key []byte, text string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create cipher")
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "could not generate nonce")
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(text), nil)
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts text encrypted with encrypt
+func decrypt(key []byte, encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode encrypted text")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create cipher")
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted text is too short")
+	}
+
+	text, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrap(err, "could not decrypt")
+	}
+
+	return string(text), nil
+}
+
+// encryptSecret encrypts a TeamCity token with the key generated in the KV store. Keeping the key
+// out of the plugin configuration means configuration exports and the System Console never hold
+// both the key and the tokens it encrypts. The result starts with encryptedPrefix.
+func (p *Plugin) encryptSecret(text string) (string, error) {
+	key, err := p.ensureKVKey(encryptionKeyKey)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := encrypt(key, text)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + encrypted, nil
+}
+
+// decryptSecret decrypts a value encrypted with encryptSecret
+func (p *Plugin) decryptSecret(encrypted string) (string, error) {
+	key, appErr := p.API.KVGet(encryptionKeyKey)
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "could not load key")
+	}
+	if key == nil {
+		return "", errors.New("no key to decrypt with, the key value store may have been reset")
+	}
+
+	return decrypt(key, strings.TrimPrefix(encrypted, encryptedPrefix))
+}
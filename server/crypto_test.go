@@ -0,0 +1,211 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	assert := assert.New(t)
+
+	key := make([]byte, 32)
+
+	encrypted, err := encrypt(key, "secret token")
+	assert.Nil(err)
+	assert.NotContains(encrypted, "secret token")
+
+	decrypted, err := decrypt(key, encrypted)
+	assert.Nil(err)
+	assert.Equal("secret token", decrypted)
+
+	other, err := encrypt(key, "secret token")
+	assert.Nil(err)
+	assert.NotEqual(encrypted, other, "every encryption uses a new nonce")
+
+	wrongKey := make([]byte, 32)
+	wrongKey[0] = 1
+	_, err = decrypt(wrongKey, encrypted)
+	assert.NotNil(err)
+
+	_, err = decrypt(key, "dG9vIHNob3J0")
+	assert.NotNil(err)
+}
+
+func TestTokenFor(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	store := newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{TeamCityURL: "http://teamcity", TeamCityToken: "system"})
+
+	server := p.getConfiguration().GetServer(defaultServerName)
+
+	_, err := p.tokenFor("user", server, false)
+	assert.Equal(errNotConnected, err, "reads need a user token unless the system token is allowed")
+
+	p.setConfiguration(&configuration{TeamCityURL: "http://teamcity", TeamCityToken: "system", AllowSystemTokenForReads: true})
+
+	token, err := p.tokenFor("user", server, false)
+	assert.Nil(err)
+	assert.Equal("system", token)
+
+	_, err = p.tokenFor("user", server, true)
+	assert.Equal(errNotConnected, err, "writes never use the system token")
+
+	assert.Nil(p.storeUserToken("user", defaultServerName, &userToken{Token: "personal", Username: "alice"}))
+	assert.NotContains(string(store.values[kvKey(userTokenKey, "user")]), "personal", "tokens are stored encrypted")
+
+	token, err = p.tokenFor("user", server, true)
+	assert.Nil(err)
+	assert.Equal("personal", token)
+
+	infra := &teamCityServer{Name: "infra", URL: "http://infra", Token: "infra-system"}
+	_, err = p.tokenFor("user", infra, true)
+	assert.Equal(errNotConnected, err, "user tokens are stored per server")
+
+	assert.Equal("user", p.connectedUser(defaultServerName, "Alice"), "connected accounts are mapped back to their user")
+	assert.Empty(p.connectedUser("infra", "alice"))
+
+	assert.Nil(p.deleteUserToken("user", defaultServerName))
+	_, err = p.tokenFor("user", server, true)
+	assert.Equal(errNotConnected, err)
+	assert.Empty(p.connectedUser(defaultServerName, "alice"))
+}
+
+func TestEncryptSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	store := newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	encrypted, err := p.encryptSecret("token")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(encrypted, encryptedPrefix))
+	assert.NotNil(store.values[encryptionKeyKey], "the key is generated in the KV store")
+
+	decrypted, err := p.decryptSecret(encrypted)
+	assert.Nil(err)
+	assert.Equal("token", decrypted)
+
+	delete(store.values, encryptionKeyKey)
+
+	_, err = p.decryptSecret(encrypted)
+	assert.NotNil(err)
+}
+
+func TestOnConfigurationChangeDecryptsToken(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	store := newTestKVStore(api)
+	allowLogs(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	encrypted, err := p.encryptSecret("token")
+	assert.Nil(err)
+
+	api.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Return(func(dest interface{}) error {
+		*dest.(*configuration) = configuration{TeamCityToken: encrypted}
+		return nil
+	})
+
+	assert.Nil(p.OnConfigurationChange())
+	assert.Equal("token", p.getConfiguration().GetTeamCityToken())
+	assert.Empty(p.getConfiguration().teamCityTokenError)
+
+	// Tokens that cannot be decrypted are reported until they are entered again
+	delete(store.values, encryptionKeyKey)
+
+	assert.Nil(p.OnConfigurationChange())
+	assert.Empty(p.getConfiguration().GetTeamCityToken())
+	assert.Contains(p.getConfiguration().teamCityTokenError, "Could not decrypt the access token")
+}
+
+func TestOnConfigurationChangeEncryptsToken(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	store := newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	api.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Return(func(dest interface{}) error {
+		*dest.(*configuration) = configuration{TeamCityToken: "token"}
+		return nil
+	})
+	api.On("GetPluginConfig").Return(map[string]interface{}{"teamcitytoken": "token"})
+
+	saved := make(chan map[string]interface{}, 1)
+	api.On("SavePluginConfig", mock.Anything).Return(func(config map[string]interface{}) *model.AppError {
+		saved <- config
+		return nil
+	})
+
+	assert.Nil(p.OnConfigurationChange())
+
+	configuration := p.getConfiguration()
+	assert.Equal("token", configuration.GetTeamCityToken())
+	assert.True(strings.HasPrefix(configuration.TeamCityToken, encryptedPrefix), "the plain text token is never applied")
+	assert.NotNil(store.values[encryptionKeyKey])
+
+	config := <-saved
+	assert.Equal(configuration.TeamCityToken, config["TeamCityToken"], "the encrypted token replaces the plain text token")
+	assert.Len(config, 1)
+	assert.Nil(store.values[savingTokenKey])
+
+	// Only one node of a cluster saves the token
+	store.values[savingTokenKey] = []byte("other node")
+	assert.Nil(p.OnConfigurationChange())
+	assert.Len(saved, 0)
+	delete(store.values, savingTokenKey)
+}
+
+func TestOnConfigurationChangeSavesTokenOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+	allowLogs(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	api.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Return(func(dest interface{}) error {
+		*dest.(*configuration) = configuration{TeamCityToken: "token"}
+		return nil
+	})
+
+	// The token was already saved encrypted by another node
+	stored := map[string]interface{}{"TeamCityToken": "encrypted:other"}
+	api.On("GetPluginConfig").Return(func() map[string]interface{} {
+		return stored
+	})
+	api.On("SavePluginConfig", mock.Anything).Return(model.NewAppError("SavePluginConfig", "save_failed", nil, "", 500)).Once()
+
+	assert.Nil(p.OnConfigurationChange())
+	assert.Equal("token", p.getConfiguration().GetTeamCityToken())
+	assert.Empty(p.getConfiguration().teamCityTokenError)
+	api.AssertNotCalled(t, "SavePluginConfig", mock.Anything)
+
+	// Failing to save the token is reported
+	stored = map[string]interface{}{"TeamCityToken": "token"}
+
+	assert.Nil(p.OnConfigurationChange())
+	assert.Equal("token", p.getConfiguration().GetTeamCityToken())
+	assert.Contains(p.getConfiguration().teamCityTokenError, "stored in plain text")
+}
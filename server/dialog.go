@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	startBuildActionPath = "/actions/start-build"
+	startBuildDialogPath = "/dialog/start-build"
+
+	dialogElementBuildType  = "buildType"
+	dialogElementBranch     = "branch"
+	dialogElementComment    = "comment"
+	dialogElementParameters = "parameters"
+
+	// Dialog elements of declared build parameters are named after the parameter with this prefix
+	dialogParameterPrefix = "param:"
+)
+
+// parameterSpec is a parsed TeamCity parameter specification, e.g.
+// "select display='prompt' label='Environment' data_1='staging' data_2='production'"
+type parameterSpec struct {
+	Type       string
+	Attributes map[string]string
+}
+
+// parseParameterSpec parses the raw type of a declared build parameter. Attribute values are
+// quoted with single quotes and use TeamCity's escaping with a leading "|".
+func parseParameterSpec(raw string) *parameterSpec {
+	raw = strings.TrimSpace(raw)
+
+	spec := &parameterSpec{Attributes: map[string]string{}}
+
+	end := strings.IndexAny(raw, " \t\n")
+	if end < 0 {
+		spec.Type = raw
+		return spec
+	}
+	spec.Type = raw[:end]
+	rest := raw[end:]
+
+	for {
+		rest = strings.TrimLeft(rest, " \t\n")
+
+		eq := strings.Index(rest, "='")
+		if eq <= 0 {
+			return spec
+		}
+		name := rest[:eq]
+		rest = rest[eq+2:]
+
+		var value strings.Builder
+		for len(rest) > 0 && rest[0] != '\'' {
+			if rest[0] == '|' && len(rest) > 1 {
+				switch rest[1] {
+				case 'n':
+					value.WriteByte('\n')
+				case 'r':
+					value.WriteByte('\r')
+				default:
+					value.WriteByte(rest[1])
+				}
+				rest = rest[2:]
+				continue
+			}
+
+			value.WriteByte(rest[0])
+			rest = rest[1:]
+		}
+
+		spec.Attributes[name] = value.String()
+		if len(rest) == 0 {
+			return spec
+		}
+		rest = rest[1:]
+	}
+}
+
+// selectOptions returns the options of a select parameter, declared as data_1, data_2, ...
+// with either a value or "label => value"
+func (s *parameterSpec) selectOptions() []*model.PostActionOptions {
+	var indexes []int
+	for name := range s.Attributes {
+		if strings.HasPrefix(name, "data_") {
+			if index, err := strconv.Atoi(strings.TrimPrefix(name, "data_")); err == nil {
+				indexes = append(indexes, index)
+			}
+		}
+	}
+	sort.Ints(indexes)
+
+	options := make([]*model.PostActionOptions, 0, len(indexes))
+	for _, index := range indexes {
+		data := s.Attributes[fmt.Sprintf("data_%d", index)]
+
+		option := &model.PostActionOptions{Text: data, Value: data}
+		if arrow := strings.Index(data, "=>"); arrow >= 0 {
+			option.Text = strings.TrimSpace(data[:arrow])
+			option.Value = strings.TrimSpace(data[arrow+2:])
+		}
+
+		options = append(options, option)
+	}
+
+	return options
+}
+
+// parameterElement returns the dialog element for a declared build parameter, or nil if the
+// parameter has no specification or is hidden
+func parameterElement(param *tcParameter) *model.DialogElement {
+	if param.Type == nil || param.Type.RawValue == "" {
+		return nil
+	}
+
+	spec := parseParameterSpec(param.Type.RawValue)
+	if spec.Attributes["display"] == "hidden" {
+		return nil
+	}
+
+	element := &model.DialogElement{
+		DisplayName: param.Name,
+		Name:        dialogParameterPrefix + param.Name,
+		Type:        "text",
+		Default:     param.Value,
+		HelpText:    spec.Attributes["description"],
+		Optional:    spec.Attributes["validationMode"] != "not_empty",
+	}
+
+	if label := spec.Attributes["label"]; label != "" {
+		element.DisplayName = label
+	}
+
+	switch spec.Type {
+	case "checkbox":
+		element.Type = "bool"
+		element.Default = strconv.FormatBool(param.Value == checkedValue(spec))
+		element.Optional = true
+
+	case "select":
+		if spec.Attributes["multiple"] == "true" {
+			separator := spec.Attributes["valueSeparator"]
+			if separator == "" {
+				separator = ","
+			}
+			element.Placeholder = fmt.Sprintf("Values separated by %q", separator)
+			break
+		}
+
+		element.Type = "select"
+		element.Options = spec.selectOptions()
+
+	case "password":
+		// The current value is never shown, leaving the field empty keeps it
+		element.SubType = "password"
+		element.Default = ""
+		element.Optional = true
+	}
+
+	return element
+}
+
+func checkedValue(spec *parameterSpec) string {
+	if value, ok := spec.Attributes["checkedValue"]; ok {
+		return value
+	}
+
+	return "true"
+}
+
+// parameterValue returns the value to queue a build with for a declared build parameter from
+// a dialog submission, and false if the parameter should keep its current value
+func parameterValue(param *tcParameter, submitted interface{}) (string, bool) {
+	spec := parseParameterSpec(param.Type.RawValue)
+
+	var value string
+	switch v := submitted.(type) {
+	case bool:
+		value = spec.Attributes["uncheckedValue"]
+		if v {
+			value = checkedValue(spec)
+		}
+	case string:
+		value = v
+	case nil:
+		value = ""
+	default:
+		value = fmt.Sprint(v)
+	}
+
+	if spec.Type == "password" && value == "" {
+		return "", false
+	}
+
+	return value, value != param.Value
+}
+
+// pluginURL returns the URL of a plugin HTTP endpoint, relative to the Mattermost site URL
+func pluginURL(path string) string {
+	return "/plugins/" + manifest.Id + path
+}
+
+// startBuildDialogState returns the state of the start build dialog, which carries the server
+// and the build configuration
+func startBuildDialogState(server, buildTypeID string) string {
+	return serverNameOrDefault(server) + ":" + buildTypeID
+}
+
+// parseStartBuildDialogState returns the server and the build configuration of the start build
+// dialog. Dialogs opened before servers were named only carry the build configuration.
+func parseStartBuildDialogState(state string) (string, string) {
+	parts := strings.SplitN(state, ":", 2)
+	if len(parts) == 1 {
+		return defaultServerName, state
+	}
+
+	return parts[0], parts[1]
+}
+
+// startBuildDialog returns the dialog to start a build of a build configuration, with its
+// declared parameters, or of a build configuration chosen from a list if buildTypeID is empty.
+// The list is limited to the subtree of projectID if it is not empty.
+func (p *Plugin) startBuildDialog(client TeamCityClient, server, projectID, buildTypeID string) (*model.Dialog, error) {
+
+	dialog := &model.Dialog{
+		CallbackId:  "startBuild",
+		Title:       "Start TeamCity Build",
+		SubmitLabel: "Start",
+		State:       startBuildDialogState(server, buildTypeID),
+	}
+
+	if buildTypeID == "" {
+		buildTypes, err := client.GetBuildTypes(projectLocator(projectID))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get build configurations")
+		}
+
+		options := make([]*model.PostActionOptions, 0, len(buildTypes))
+		for _, buildType := range buildTypes {
+			options = append(options, &model.PostActionOptions{
+				Text:  buildType.ProjectName + " / " + buildType.Name,
+				Value: buildType.ID,
+			})
+		}
+
+		dialog.Elements = append(dialog.Elements, model.DialogElement{
+			DisplayName: "Build Configuration",
+			Name:        dialogElementBuildType,
+			Type:        "select",
+			Options:     options,
+		})
+	} else {
+		buildType, err := client.GetBuildType(buildTypeID)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get build configuration")
+		}
+		dialog.IntroductionText = fmt.Sprintf("Start a build of [%s / %s](%s)", buildType.ProjectName, buildType.Name, buildType.WebURL)
+	}
+
+	dialog.Elements = append(dialog.Elements,
+		model.DialogElement{
+			DisplayName: "Branch",
+			Name:        dialogElementBranch,
+			Type:        "text",
+			Placeholder: "Default branch",
+			Optional:    true,
+		},
+		model.DialogElement{
+			DisplayName: "Comment",
+			Name:        dialogElementComment,
+			Type:        "textarea",
+			Optional:    true,
+		},
+	)
+
+	if buildTypeID == "" {
+		dialog.Elements = append(dialog.Elements, model.DialogElement{
+			DisplayName: "Parameters",
+			Name:        dialogElementParameters,
+			Type:        "textarea",
+			Placeholder: "env.NAME=value",
+			HelpText:    "One name=value parameter per line",
+			Optional:    true,
+		})
+
+		return dialog, nil
+	}
+
+	params, err := client.GetBuildTypeParameters(buildTypeID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get build parameters")
+	}
+
+	for _, param := range params {
+		if element := parameterElement(param); element != nil {
+			dialog.Elements = append(dialog.Elements, *element)
+		}
+	}
+
+	return dialog, nil
+}
+
+// openStartBuildDialog opens the start build dialog for the user who triggered the command or
+// action. Trigger IDs expire after a few seconds, so the dialog must be opened right away.
+func (p *Plugin) openStartBuildDialog(client TeamCityClient, server, triggerID, projectID, buildTypeID string) error {
+	dialog, err := p.startBuildDialog(client, server, projectID, buildTypeID)
+	if err != nil {
+		return err
+	}
+
+	appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: triggerID,
+		URL:       pluginURL(startBuildDialogPath),
+		Dialog:    *dialog,
+	})
+	if appErr != nil {
+		return errors.Wrap(appErr, "could not open dialog")
+	}
+
+	return nil
+}
+
+// handleStartBuildAction opens the start build dialog from the button on build notifications
+func (p *Plugin) handleStartBuildAction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserId != userID {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	buildTypeID, _ := request.Context["build_type_id"].(string)
+	serverName, _ := request.Context["server"].(string)
+
+	response := &model.PostActionIntegrationResponse{}
+
+	server := p.getConfiguration().GetServer(serverName)
+	if server == nil {
+		response.EphemeralText = "The TeamCity server `" + serverNameOrDefault(serverName) + "` of this build is not configured anymore"
+		writeJSON(w, response)
+		return
+	}
+
+	client, err := p.clientFor(userID, server, false)
+	if err == errNotConnected {
+		response.EphemeralText = errorNotConnected + p.connectServerHint(server.Name)
+	} else if err != nil {
+		response.EphemeralText = "Could not get your TeamCity token: `" + err.Error() + "`"
+	} else if err = p.openStartBuildDialog(client, server.Name, request.TriggerId, "", buildTypeID); err != nil {
+		response.EphemeralText = "Could not open the start build dialog: `" + err.Error() + "`"
+	}
+
+	writeJSON(w, response)
+}
+
+// handleStartBuildDialog queues the build submitted with the start build dialog
+func (p *Plugin) handleStartBuildDialog(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request model.SubmitDialogRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserId != userID {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if request.Cancelled {
+		writeJSON(w, &model.SubmitDialogResponse{})
+		return
+	}
+
+	serverName, buildTypeID := parseStartBuildDialogState(request.State)
+	chosenBuildType := buildTypeID == ""
+
+	server := p.getConfiguration().GetServer(serverName)
+	if server == nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "The TeamCity server " + serverName + " is not configured anymore"})
+		return
+	}
+
+	client, err := p.clientFor(userID, server, true)
+	if err == errNotConnected {
+		writeJSON(w, &model.SubmitDialogResponse{Error: errorNotConnected + p.connectServerHint(server.Name)})
+		return
+	} else if err != nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "Could not get your TeamCity token: " + err.Error()})
+		return
+	}
+
+	if chosenBuildType {
+		buildTypeID, _ = request.Submission[dialogElementBuildType].(string)
+	}
+
+	buildType, err := client.GetBuildType(buildTypeID)
+	if err != nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "Could not get build configuration: " + err.Error()})
+		return
+	}
+
+	ctx := &permissionContext{UserID: userID, ChannelID: request.ChannelId, TeamID: request.TeamId, Server: server.Name}
+	if message := p.checkPermission(ctx, permissionStart, buildType); message != "" {
+		writeJSON(w, &model.SubmitDialogResponse{Error: message})
+		return
+	}
+
+	options := &queueBuildOptions{
+		Parameters: map[string]string{},
+	}
+	options.Branch, _ = request.Submission[dialogElementBranch].(string)
+	options.Comment, _ = request.Submission[dialogElementComment].(string)
+
+	if chosenBuildType {
+		text, _ := request.Submission[dialogElementParameters].(string)
+
+		var lines []string
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+
+		parameters, invalid := parseParameterAssignments(lines)
+		if invalid != "" {
+			writeJSON(w, &model.SubmitDialogResponse{
+				Errors: map[string]string{dialogElementParameters: "Invalid parameter " + invalid + ", use name=value"},
+			})
+			return
+		}
+		options.Parameters = parameters
+	} else {
+		params, paramsErr := client.GetBuildTypeParameters(buildTypeID)
+		if paramsErr != nil {
+			writeJSON(w, &model.SubmitDialogResponse{Error: "Could not get build parameters: " + paramsErr.Error()})
+			return
+		}
+
+		for _, param := range params {
+			submitted, ok := request.Submission[dialogParameterPrefix+param.Name]
+			if !ok || param.Type == nil {
+				continue
+			}
+
+			if value, changed := parameterValue(param, submitted); changed {
+				options.Parameters[param.Name] = value
+			}
+		}
+	}
+
+	build, err := client.QueueBuild(buildTypeID, options)
+	if err != nil {
+		writeJSON(w, &model.SubmitDialogResponse{Error: "Error starting build: " + err.Error()})
+		return
+	}
+
+	if _, err = p.postStartedBuild(userID, request.ChannelId, "", server.Name, build, options); err != nil {
+		p.API.LogWarn("Could not post started build", "build_id", build.ID, "error", err.Error())
+	}
+
+	writeJSON(w, &model.SubmitDialogResponse{})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func newTestParameter(name, value, rawType string) *tcParameter {
+	param := &tcParameter{Name: name, Value: value}
+	param.Type = &struct {
+		RawValue string `json:"rawValue"`
+	}{RawValue: rawType}
+
+	return param
+}
+
+func TestParseParameterSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := parseParameterSpec("select display='prompt' label='Target |'env|'' data_1='Staging => staging' data_2='production'")
+
+	assert.Equal("select", spec.Type)
+	assert.Equal("prompt", spec.Attributes["display"])
+	assert.Equal("Target 'env'", spec.Attributes["label"])
+	assert.Equal([]*model.PostActionOptions{
+		{Text: "Staging", Value: "staging"},
+		{Text: "production", Value: "production"},
+	}, spec.selectOptions())
+
+	spec = parseParameterSpec("text")
+	assert.Equal("text", spec.Type)
+	assert.Empty(spec.Attributes)
+}
+
+func TestParameterElement(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(parameterElement(&tcParameter{Name: "env.PLAIN", Value: "x"}))
+	assert.Nil(parameterElement(newTestParameter("env.HIDDEN", "x", "text display='hidden'")))
+
+	element := parameterElement(newTestParameter("env.TARGET", "staging", "select label='Target' data_1='staging' data_2='production'"))
+	assert.Equal("Target", element.DisplayName)
+	assert.Equal(dialogParameterPrefix+"env.TARGET", element.Name)
+	assert.Equal("select", element.Type)
+	assert.Equal("staging", element.Default)
+	assert.Len(element.Options, 2)
+	assert.True(element.Optional)
+
+	element = parameterElement(newTestParameter("env.VERSION", "", "text validationMode='not_empty' description='Version to release'"))
+	assert.Equal("text", element.Type)
+	assert.Equal("Version to release", element.HelpText)
+	assert.False(element.Optional)
+
+	element = parameterElement(newTestParameter("env.DRY_RUN", "yes", "checkbox checkedValue='yes' uncheckedValue='no'"))
+	assert.Equal("bool", element.Type)
+	assert.Equal("true", element.Default)
+
+	element = parameterElement(newTestParameter("env.SECRET", "credentialsJSON:abc", "password"))
+	assert.Equal("password", element.SubType)
+	assert.Empty(element.Default)
+}
+
+func TestParameterValue(t *testing.T) {
+	assert := assert.New(t)
+
+	checkbox := newTestParameter("env.DRY_RUN", "yes", "checkbox checkedValue='yes' uncheckedValue='no'")
+
+	value, changed := parameterValue(checkbox, false)
+	assert.Equal("no", value)
+	assert.True(changed)
+
+	_, changed = parameterValue(checkbox, true)
+	assert.False(changed)
+
+	value, changed = parameterValue(newTestParameter("env.TARGET", "staging", "select data_1='staging' data_2='production'"), "production")
+	assert.Equal("production", value)
+	assert.True(changed)
+
+	_, changed = parameterValue(newTestParameter("env.SECRET", "credentialsJSON:abc", "password"), "")
+	assert.False(changed)
+}
+
+func TestParseParameterAssignments(t *testing.T) {
+	assert := assert.New(t)
+
+	parameters, invalid := parseParameterAssignments([]string{"env.FOO=bar", "env.EMPTY=", "env.EQ=a=b"})
+	assert.Empty(invalid)
+	assert.Equal(map[string]string{"env.FOO": "bar", "env.EMPTY": "", "env.EQ": "a=b"}, parameters)
+
+	_, invalid = parseParameterAssignments([]string{"env.FOO=bar", "oops"})
+	assert.Equal("oops", invalid)
+}
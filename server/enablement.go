@@ -0,0 +1,178 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// disabledKey and the team and channel keys are set while the plugin is disabled everywhere,
+	// in a team or in a channel
+	disabledKey        = "disabled"
+	disabledTeamKey    = "disabled_team_"
+	disabledChannelKey = "disabled_channel_"
+
+	scopeGlobal  = "global"
+	scopeTeam    = "team"
+	scopeChannel = "channel"
+)
+
+// disabledScopeKey returns the KV key holding the state of a scope
+func disabledScopeKey(scope, teamID, channelID string) string {
+	switch scope {
+	case scopeTeam:
+		return kvKey(disabledTeamKey, teamID)
+	case scopeChannel:
+		return kvKey(disabledChannelKey, channelID)
+	}
+
+	return disabledKey
+}
+
+// setDisabled disables or enables the plugin in a scope. The state is kept in the KV store, so
+// it survives restarts and is shared by all nodes of a cluster.
+func (p *Plugin) setDisabled(scope, teamID, channelID string, disabled bool) error {
+	key := disabledScopeKey(scope, teamID, channelID)
+
+	if !disabled {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "could not enable plugin")
+		}
+		return nil
+	}
+
+	if appErr := p.API.KVSet(key, []byte("true")); appErr != nil {
+		return errors.Wrap(appErr, "could not disable plugin")
+	}
+
+	return nil
+}
+
+// disabledScope returns the broadest scope the plugin is disabled in for a channel of a team,
+// or "" if it is enabled there
+func (p *Plugin) disabledScope(teamID, channelID string) (string, error) {
+	for _, scope := range []string{scopeGlobal, scopeTeam, scopeChannel} {
+		if scope == scopeTeam && teamID == "" || scope == scopeChannel && channelID == "" {
+			continue
+		}
+
+		value, appErr := p.API.KVGet(disabledScopeKey(scope, teamID, channelID))
+		if appErr != nil {
+			return "", errors.Wrap(appErr, "could not load plugin state")
+		}
+
+		if value != nil {
+			return scope, nil
+		}
+	}
+
+	return "", nil
+}
+
+// channelDisabled returns true if build events must not be posted to a channel
+func (p *Plugin) channelDisabled(channelID string) bool {
+	teamID := ""
+	if channel, appErr := p.API.GetChannel(channelID); appErr == nil {
+		teamID = channel.TeamId
+	}
+
+	scope, err := p.disabledScope(teamID, channelID)
+	if err != nil {
+		p.API.LogWarn("Could not check whether the plugin is disabled", "channel_id", channelID, "error", err.Error())
+		return false
+	}
+
+	return scope != ""
+}
+
+// checkEnabled returns the response to send if the plugin is disabled where a slash command
+// was run
+func (p *Plugin) checkEnabled(args *model.CommandArgs) *model.CommandResponse {
+	scope, err := p.disabledScope(args.TeamId, args.ChannelId)
+	if err != nil {
+		return p.postEphemeral("Could not check whether the plugin is enabled: `" + err.Error() + "`")
+	}
+
+	switch scope {
+	case scopeGlobal:
+		return p.postEphemeral(errorDisabled)
+	case scopeTeam:
+		return p.postEphemeral(errorDisabledTeam)
+	case scopeChannel:
+		return p.postEphemeral(errorDisabledChan)
+	}
+
+	return nil
+}
+
+// commandScope returns the scope an enable or disable command applies to, or the response to
+// send if the user may not change it. Disabling everywhere requires a system administrator, a
+// team a team administrator and a channel a channel administrator.
+func (p *Plugin) commandScope(args *model.CommandArgs, flags commandFlags, command string) (string, *model.CommandResponse) {
+	var allowed bool
+	scope := scopeGlobal
+
+	switch {
+	case flags.Bool(scopeChannel):
+		scope = scopeChannel
+		allowed = p.API.HasPermissionToChannel(args.UserId, args.ChannelId, model.PERMISSION_MANAGE_CHANNEL_ROLES)
+	case flags.Bool(scopeTeam):
+		scope = scopeTeam
+		allowed = p.API.HasPermissionToTeam(args.UserId, args.TeamId, model.PERMISSION_MANAGE_TEAM)
+	default:
+		allowed = p.isSystemAdmin(args.UserId)
+	}
+
+	if !allowed {
+		p.auditDenied(&permissionContext{UserID: args.UserId, ChannelID: args.ChannelId, TeamID: args.TeamId}, command, scope)
+
+		if scope == scopeGlobal {
+			return "", p.postEphemeral(errorAdminOnly)
+		}
+		return "", p.postEphemeral("Only " + scope + " administrators can " + command + " the plugin in this " + scope)
+	}
+
+	return scope, nil
+}
+
+func (p *Plugin) executeCommandTriggerEnable(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	scope, errResponse := p.commandScope(args, input.Flags, commandTriggerEnable)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	if err := p.setDisabled(scope, args.TeamId, args.ChannelId, false); err != nil {
+		return p.postEphemeral("Could not enable the plugin: `" + err.Error() + "`")
+	}
+
+	if scope == scopeGlobal {
+		return p.postEphemeral(msgEnabled)
+	}
+
+	message := msgEnabled + " in this " + scope
+	if other, err := p.disabledScope(args.TeamId, args.ChannelId); err == nil && other == scopeGlobal {
+		message += ", but it is still disabled everywhere"
+	} else if err == nil && other != "" {
+		message += ", but it is still disabled in this " + other
+	}
+
+	return p.postEphemeral(message)
+}
+
+func (p *Plugin) executeCommandTriggerDisable(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	scope, errResponse := p.commandScope(args, input.Flags, commandTriggerDisable)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	if err := p.setDisabled(scope, args.TeamId, args.ChannelId, true); err != nil {
+		return p.postEphemeral("Could not disable the plugin: `" + err.Error() + "`")
+	}
+
+	if scope == scopeGlobal {
+		return p.postEphemeral(msgDisabled)
+	}
+
+	return p.postEphemeral(msgDisabled + " in this " + scope)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestEnableDisableScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PERMISSION_MANAGE_SYSTEM).Return(false)
+	api.On("HasPermissionToTeam", "team-admin", "team", model.PERMISSION_MANAGE_TEAM).Return(true)
+	api.On("HasPermissionToTeam", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_TEAM).Return(false)
+	api.On("HasPermissionToChannel", mock.AnythingOfType("string"), "channel", model.PERMISSION_MANAGE_CHANNEL_ROLES).Return(true)
+	api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team"}, nil)
+	api.On("GetChannel", "other").Return(&model.Channel{Id: "other", TeamId: "other-team"}, nil)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{TeamCityURL: "http://teamcity", teamCityToken: "token"})
+
+	args := func(userID, command string) *model.CommandArgs {
+		return &model.CommandArgs{UserId: userID, TeamId: "team", ChannelId: "channel", Command: "/teamcity " + command}
+	}
+
+	response := p.executeCommandHooks(args("user", "disable"))
+	assert.Equal(errorAdminOnly, response.Text, "only system administrators disable the plugin everywhere")
+
+	response = p.executeCommandHooks(args("user", "disable --team"))
+	assert.Contains(response.Text, "Only team administrators")
+
+	response = p.executeCommandHooks(args("team-admin", "disable --team"))
+	assert.Equal(msgDisabled+" in this team", response.Text)
+	assert.Equal(errorDisabledTeam, p.checkEnabled(args("user", "stats")).Text)
+	assert.True(p.channelDisabled("channel"), "no build events are posted in the team")
+	assert.False(p.channelDisabled("other"), "other teams are not affected")
+
+	response = p.executeCommandHooks(args("user", "disable --channel"))
+	assert.Equal(msgDisabled+" in this channel", response.Text)
+
+	response = p.executeCommandHooks(args("team-admin", "enable --team"))
+	assert.Equal(msgEnabled+" in this team, but it is still disabled in this channel", response.Text)
+	assert.Equal(errorDisabledChan, p.checkEnabled(args("user", "stats")).Text)
+
+	p.executeCommandHooks(args("user", "enable --channel"))
+	assert.Nil(p.checkEnabled(args("user", "stats")))
+	assert.False(p.channelDisabled("channel"))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	eventQueued    = "queued"
+	eventStarted   = "started"
+	eventSucceeded = "succeeded"
+	eventFailed    = "failed"
+	eventCancelled = "cancelled"
+
+	deltaFixed  = "fixed"
+	deltaBroken = "broken"
+
+	colorQueued    = "#9B9B9B"
+	colorStarted   = "#4A90E2"
+	colorSucceeded = "#1EA54B"
+	colorFailed    = "#D0021B"
+	colorCancelled = "#F5A623"
+)
+
+// buildEvent is a build state change reported by TeamCity, independent of how it was received
+type buildEvent struct {
+	// Server is the name of the TeamCity server of the build
+	Server        string
+	Kind          string
+	Delta         string
+	BuildID       int64
+	BuildNumber   string
+	BuildTypeID   string
+	BuildTypeName string
+	ProjectID     string
+	ProjectName   string
+	Status        string
+	StatusText    string
+	Branch        string
+	DefaultBranch bool
+	Personal      bool
+	AgentName     string
+	TriggeredBy   string
+	WebURL        string
+
+	// Failures are the build problems and failed tests of a failed build, and Changes the
+	// changes since the last successful build, looked up by the plugin
+	Failures *failureSummary
+	Changes  *changeSummary
+
+	// detailsFilled is set once the failures and changes were looked up
+	detailsFilled bool
+}
+
+// Title returns the build name as shown in notifications, e.g. "Backend / Integration Tests #42"
+func (e *buildEvent) Title() string {
+	name := e.BuildTypeName
+	if name == "" {
+		name = e.BuildTypeID
+	}
+
+	if e.ProjectName != "" {
+		name = e.ProjectName + " / " + name
+	}
+
+	if e.BuildNumber != "" {
+		name += " #" + e.BuildNumber
+	}
+
+	return name
+}
+
+// BranchKey returns the branch of the build the same way for every event source: webhooks send
+// the display name of a branch, e.g. "main", while the REST API sends its full name, e.g.
+// "refs/heads/main". Builds of the default branch, or of configurations without branches,
+// return branchDefault.
+func (e *buildEvent) BranchKey() string {
+	if e.DefaultBranch || e.Branch == "" {
+		return branchDefault
+	}
+
+	return strings.TrimPrefix(e.Branch, "refs/heads/")
+}
+
+func (e *buildEvent) headline() (string, string) {
+	switch e.Kind {
+	case eventQueued:
+		return "Build queued", colorQueued
+	case eventStarted:
+		return "Build started", colorStarted
+	case eventSucceeded:
+		if e.Delta == deltaFixed {
+			return "Build fixed", colorSucceeded
+		}
+		return "Build succeeded", colorSucceeded
+	case eventFailed:
+		if e.Delta == deltaBroken {
+			return "Build broken", colorFailed
+		}
+		return "Build failed", colorFailed
+	case eventCancelled:
+		return "Build cancelled", colorCancelled
+	}
+
+	return "Build " + e.Kind, colorQueued
+}
+
+// finished returns true for the events of finished builds
+func (e *buildEvent) finished() bool {
+	return e.Kind == eventSucceeded || e.Kind == eventFailed || e.Kind == eventCancelled
+}
+
+func (e *buildEvent) attachment() *model.SlackAttachment {
+	headline, color := e.headline()
+
+	text := "**" + headline + "**"
+	if e.StatusText != "" && e.finished() {
+		text += ": " + e.StatusText
+	}
+
+	if e.Failures != nil && !e.Failures.Empty() {
+		text += "\n" + e.Failures.Markdown()
+	}
+	if e.Changes != nil && len(e.Changes.Changes) > 0 {
+		text += "\n**Changes since the last successful build:**\n" + e.Changes.Markdown()
+	}
+
+	var fields []*model.SlackAttachmentField
+	if e.Branch != "" {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Branch", Value: e.Branch, Short: true})
+	}
+	if e.AgentName != "" {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Agent", Value: e.AgentName, Short: true})
+	}
+	if e.TriggeredBy != "" {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Triggered By", Value: e.TriggeredBy, Short: true})
+	}
+	if e.Personal {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Personal", Value: "Yes", Short: true})
+	}
+	if server := serverNameOrDefault(e.Server); server != defaultServerName {
+		fields = append(fields, &model.SlackAttachmentField{Title: "Server", Value: server, Short: true})
+	}
+
+	return &model.SlackAttachment{
+		Fallback:  fmt.Sprintf("TeamCity: %s - %s", e.Title(), headline),
+		Color:     color,
+		Title:     e.Title(),
+		TitleLink: e.WebURL,
+		Text:      text,
+		Fields:    fields,
+	}
+}
+
+// buildEventActions returns the buttons of a build event post: cancelling queued and running
+// builds, re-running, pinning and tagging finished ones, and showing the log of failed ones
+func (p *Plugin) buildEventActions(event *buildEvent) []*model.PostAction {
+	if event.BuildID == 0 {
+		return nil
+	}
+
+	if !event.finished() {
+		return p.buildActions(event.Server, event.BuildID, buildActionCancel)
+	}
+
+	var actions []*model.PostAction
+	if event.BuildTypeID != "" {
+		actions = append(actions, &model.PostAction{
+			Name: "Start Build",
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Integration: &model.PostActionIntegration{
+				URL:     pluginURL(startBuildActionPath),
+				Context: map[string]interface{}{"build_type_id": event.BuildTypeID, "server": serverNameOrDefault(event.Server)},
+			},
+		})
+	}
+
+	finishedActions := []string{buildActionRerun, buildActionRerunParams, buildActionPin, buildActionTag}
+	if event.Kind == eventFailed {
+		finishedActions = append(finishedActions, buildActionLog)
+	}
+
+	return append(actions, p.buildActions(event.Server, event.BuildID, finishedActions...)...)
+}
+
+// fillFailureDetails looks up the failures and changes of a failed build once, for both channel
+// notifications and direct messages
+func (p *Plugin) fillFailureDetails(event *buildEvent) {
+	if event.detailsFilled {
+		return
+	}
+	event.detailsFilled = true
+
+	p.fillFailureSummary(event)
+	p.fillBuildChanges(event)
+}
+
+// postBuildEvent posts a notification for the build event to a channel as the plugin bot
+func (p *Plugin) postBuildEvent(channelID string, event *buildEvent) error {
+	post := &model.Post{
+		UserId:    p.botUserID,
+		ChannelId: channelID,
+	}
+	attachment := event.attachment()
+	attachment.Actions = p.buildEventActions(event)
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{attachment})
+
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return appErr
+	}
+
+	return nil
+}
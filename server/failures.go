@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	commandTriggerBuildTests = "tests"
+
+	// tcProblemFailedTests is the type of the build problem reporting failed tests, which are
+	// listed on their own
+	tcProblemFailedTests = "TC_FAILED_TESTS"
+
+	// maxProblemDetailsLength truncates the details of build problems, e.g. compiler output
+	maxProblemDetailsLength = 200
+)
+
+// failureSummary are the build problems and failed tests of a build, up to a limit of each
+type failureSummary struct {
+	Problems     []*tcProblemOccurrence
+	MoreProblems bool
+	Tests        []*tcTestOccurrence
+	MoreTests    bool
+
+	// BuildURL lists all build problems of the build and TestsURL all of its tests
+	BuildURL string
+	TestsURL string
+}
+
+// getFailureSummary fetches up to limit build problems and failed tests of a build
+func getFailureSummary(client TeamCityClient, buildID int64, buildURL string, limit int) (*failureSummary, error) {
+	summary := &failureSummary{BuildURL: buildURL, TestsURL: client.BuildTestsURL(buildID)}
+
+	// One more than the limit, as the problem of the failed tests is skipped
+	problems, err := client.GetProblemOccurrences(fmt.Sprintf("build:(id:%d),count:%d", buildID, limit+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get build problems")
+	}
+
+	summary.MoreProblems = problems.NextHref != ""
+	for _, problem := range problems.ProblemOccurrence {
+		if problem.Type == tcProblemFailedTests {
+			continue
+		}
+		if len(summary.Problems) == limit {
+			summary.MoreProblems = true
+			break
+		}
+		summary.Problems = append(summary.Problems, problem)
+	}
+
+	tests, err := client.GetTestOccurrences(fmt.Sprintf("build:(id:%d),status:FAILURE,count:%d", buildID, limit))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get failed tests")
+	}
+
+	summary.Tests = tests.TestOccurrence
+	summary.MoreTests = tests.NextHref != ""
+
+	return summary, nil
+}
+
+// Empty returns true if the build has neither build problems nor failed tests
+func (s *failureSummary) Empty() bool {
+	return len(s.Problems) == 0 && len(s.Tests) == 0
+}
+
+// Markdown lists the build problems and the failed tests with whether they failed for the first
+// time, the build they first failed in and their duration, followed by links to the full lists
+// if they are longer
+func (s *failureSummary) Markdown() string {
+	var text strings.Builder
+
+	if len(s.Problems) > 0 {
+		text.WriteString("**Build problems:**\n")
+		for _, problem := range s.Problems {
+			text.WriteString(" - " + problemDescription(problem) + "\n")
+		}
+		if s.MoreProblems {
+			fmt.Fprintf(&text, "_Showing the first %d build problems._ [All build problems](%s)\n", len(s.Problems), s.BuildURL)
+		}
+	}
+
+	if len(s.Tests) > 0 {
+		text.WriteString("**Failed tests:**\n")
+		for _, test := range s.Tests {
+			text.WriteString(" - " + testDescription(test) + "\n")
+		}
+		if s.MoreTests {
+			fmt.Fprintf(&text, "_Showing the first %d failed tests._ [All failed tests](%s)\n", len(s.Tests), s.TestsURL)
+		}
+	}
+
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// problemDescription returns the first line of the details of a build problem
+func problemDescription(problem *tcProblemOccurrence) string {
+	description := strings.TrimSpace(problem.Details)
+	if description == "" {
+		description = problem.Identity
+	}
+
+	truncated := false
+	if newline := strings.Index(description, "\n"); newline >= 0 {
+		description, truncated = strings.TrimSpace(description[:newline]), true
+	}
+	if runes := []rune(description); len(runes) > maxProblemDetailsLength {
+		description, truncated = string(runes[:maxProblemDetailsLength]), true
+	}
+
+	if truncated {
+		description += " …"
+	}
+
+	return description
+}
+
+// testDescription describes a failed test, e.g. "`TestX` - Recurring, first failed in #41 - 2s"
+func testDescription(test *tcTestOccurrence) string {
+	description := "`" + strings.Replace(test.Name, "`", "'", -1) + "`"
+
+	switch {
+	case test.NewFailure:
+		description += " - **New failure**"
+	case test.FirstFailed != nil && test.FirstFailed.Build != nil:
+		first := test.FirstFailed.Build
+		description += fmt.Sprintf(" - Recurring, first failed in [#%s](%s)", first.Number, first.WebURL)
+	default:
+		description += " - Recurring"
+	}
+
+	description += " - " + fmtTestDuration(test.Duration)
+
+	if test.Muted {
+		description += " (muted)"
+	}
+
+	return description
+}
+
+// fmtTestDuration formats the duration of a test in milliseconds
+func fmtTestDuration(milliseconds int64) string {
+	if milliseconds < 1000 {
+		return fmt.Sprintf("%dms", milliseconds)
+	}
+
+	return fmtDuration(time.Duration(milliseconds) * time.Millisecond)
+}
+
+// fillFailureSummary adds the build problems and failed tests to the event of a failed build,
+// unless the Failed Tests Shown setting is 0
+func (p *Plugin) fillFailureSummary(event *buildEvent) {
+	limit := p.getConfiguration().GetFailureSummaryCount()
+	if event.Kind != eventFailed || event.BuildID == 0 || limit == 0 {
+		return
+	}
+
+	client, err := p.serverClient(event.Server)
+	if err != nil {
+		p.API.LogWarn("Could not get failed tests", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	summary, err := getFailureSummary(client, event.BuildID, event.WebURL, limit)
+	if err != nil {
+		p.API.LogWarn("Could not get failed tests", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	event.Failures = summary
+}
+
+func (p *Plugin) executeCommandTriggerBuildTests(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	client, _, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	buildID := input.Int("build_id")
+
+	build, err := client.GetBuild(buildID)
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral(fmt.Sprintf("Build not found: %d", buildID))
+	}
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting build: `%s`", err.Error()))
+	}
+
+	if build.State != "finished" {
+		return p.postEphemeral(fmt.Sprintf("Build %d has not finished yet", buildID))
+	}
+
+	limit := p.getConfiguration().GetFailureSummaryCount()
+	if limit == 0 {
+		limit = defaultFailureSummaryCount
+	}
+
+	summary, err := getFailureSummary(client, build.ID, build.WebURL, limit)
+	if err != nil {
+		return p.postEphemeral(fmt.Sprintf("Error getting failed tests: `%s`", err.Error()))
+	}
+
+	title := fmt.Sprintf("[%s #%s](%s)", build.BuildType.Name, build.Number, build.WebURL)
+	if summary.Empty() {
+		return p.postEphemeral(title + " has no build problems or failed tests")
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_IN_CHANNEL,
+		Text:         "**Build problems and failed tests of " + title + "**: " + build.StatusText + "\n" + summary.Markdown(),
+	}
+}
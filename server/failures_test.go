@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestFailureSummaryMarkdown(t *testing.T) {
+	assert := assert.New(t)
+
+	recurring := &tcTestOccurrence{Name: "Backend: TestDeploy", Duration: 65000}
+	recurring.FirstFailed = &struct {
+		Build *tcBuildRef `json:"build"`
+	}{Build: &tcBuildRef{ID: 41, Number: "41", WebURL: "http://teamcity/viewLog.html?buildId=41"}}
+
+	summary := &failureSummary{
+		Problems: []*tcProblemOccurrence{
+			{Type: "TC_EXIT_CODE", Details: "Process exited with code 1"},
+			{Type: "TC_COMPILATION_ERROR", Details: "Compilation error: main.go\nundefined: x"},
+			{Type: "TC_EXECUTION_TIMEOUT", Identity: "TC_EXECUTION_TIMEOUT"},
+		},
+		MoreProblems: true,
+		Tests: []*tcTestOccurrence{
+			{Name: "Backend: TestBuild", Duration: 12, NewFailure: true},
+			recurring,
+			{Name: "Backend: Test`Flaky`", Duration: 1500, Muted: true},
+		},
+		MoreTests: true,
+		BuildURL:  "http://teamcity/viewLog.html?buildId=42",
+		TestsURL:  "http://teamcity/viewLog.html?buildId=42&tab=testsInfo",
+	}
+
+	assert.Equal(`**Build problems:**
+ - Process exited with code 1
+ - Compilation error: main.go …
+ - TC_EXECUTION_TIMEOUT
+_Showing the first 3 build problems._ [All build problems](http://teamcity/viewLog.html?buildId=42)
+**Failed tests:**
+ - `+"`Backend: TestBuild`"+` - **New failure** - 12ms
+ - `+"`Backend: TestDeploy`"+` - Recurring, first failed in [#41](http://teamcity/viewLog.html?buildId=41) - 1m 5s
+ - `+"`Backend: Test'Flaky'`"+` - Recurring - 2s (muted)
+_Showing the first 3 failed tests._ [All failed tests](http://teamcity/viewLog.html?buildId=42&tab=testsInfo)`, summary.Markdown())
+
+	long := problemDescription(&tcProblemOccurrence{Details: strings.Repeat("é", 300)})
+	assert.Equal(strings.Repeat("é", maxProblemDetailsLength)+" …", long)
+}
+
+func TestBuildTestsCommand(t *testing.T) {
+	assert := assert.New(t)
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	response := plugin.executeCommandHooks(generateArgs("build tests 2"))
+	assert.Equal(model.COMMAND_RESPONSE_TYPE_IN_CHANNEL, response.ResponseType)
+	assert.Contains(response.Text, "**Build problems and failed tests of [Test Build #2](http://teamcity/viewLog.html?buildId=2)**: Tests failed: 1 (1 new), passed: 11")
+	assert.Contains(response.Text, " - Process exited with code 1 (Step: Test (Command Line))\n")
+	assert.NotContains(response.Text, "Tests failed\n", "the problem of the failed tests is not listed")
+	assert.Contains(response.Text, " - `server: TestBuildLogTail` - **New failure** - 10ms")
+	assert.NotContains(response.Text, "`server: TestBuildLog`", "passed tests are not listed")
+	assert.NotContains(response.Text, "All failed tests")
+
+	response = plugin.executeCommandHooks(generateArgs("build tests 1"))
+	assert.Equal("[Test Build #1](http://teamcity/viewLog.html?buildId=1) has no build problems or failed tests", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("build tests 3"))
+	assert.Equal("Build 3 has not finished yet", response.Text)
+
+	teamCity.tests[2] = append(teamCity.tests[2], &tcTestOccurrence{ID: "build:(id:2),id:3", Name: "server: TestOther", Status: "FAILURE"})
+	configuration := plugin.getConfiguration().Clone()
+	configuration.FailureSummaryCount = "1"
+	plugin.setConfiguration(configuration)
+
+	response = plugin.executeCommandHooks(generateArgs("build tests 2"))
+	assert.NotContains(response.Text, "TestOther")
+	assert.Contains(response.Text, "_Showing the first 1 failed tests._ [All failed tests]("+teamCity.URL+"/viewLog.html?buildId=2&tab=testsInfo)")
+}
+
+func TestFailureNotification(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team"}, nil)
+	api.On("GetDirectChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(&model.Channel{Id: "dm"}, nil)
+
+	var posted []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		if post.ChannelId == "channel" {
+			posted = append(posted, post)
+		}
+		return post
+	}, nil)
+
+	assert.Nil(plugin.addSubscription(&subscription{
+		ChannelID:  "channel",
+		Server:     defaultServerName,
+		TargetID:   "MattermostTeamcityPlugin_TestBuild",
+		TargetType: subscriptionTargetBuildType,
+	}))
+
+	failed := func(build *tcBuild) *buildEvent {
+		event := eventFromBuild(build)
+		event.Kind = eventFailed
+		return event
+	}
+
+	assert.Nil(plugin.dispatchBuildEvent(failed(teamCity.builds[2])))
+	assert.Len(posted, 1)
+
+	text := posted[0].Attachments()[0].Text
+	assert.Contains(text, "**Build problems:**\n - Process exited with code 1")
+	assert.Contains(text, "**Failed tests:**\n - `server: TestBuildLogTail` - **New failure**")
+	assert.Contains(text, "**Changes since the last successful build:**\n - [`9b2e7d1`](http://teamcity/change/12) @jane: Tail the build log")
+	assert.NotContains(text, "Add the build log", "the changes of the last successful build are left out")
+
+	// The summary can be left out of notifications
+	configuration := plugin.getConfiguration().Clone()
+	configuration.FailureSummaryCount = "0"
+	plugin.setConfiguration(configuration)
+
+	assert.Nil(plugin.dispatchBuildEvent(failed(teamCity.rerunBuild(2))))
+	assert.Len(posted, 2)
+	assert.NotContains(posted[1].Attachments()[0].Text, "Failed tests")
+
+	// Successful builds have no summary
+	succeeded := eventFromBuild(teamCity.builds[1])
+	succeeded.Kind = eventSucceeded
+	assert.Nil(plugin.dispatchBuildEvent(succeeded))
+	assert.Len(posted, 3)
+	assert.NotContains(posted[2].Attachments()[0].Text, "Build problems")
+	assert.NotContains(posted[2].Attachments()[0].Text, "Changes since")
+}
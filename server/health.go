@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	healthKey      = "health"
+	healthJobName  = "health"
+	healthInterval = time.Minute
+)
+
+// serverHealth is the result of the periodic TeamCity server checks. The node running the
+// health job stores it in the KV store, so slash commands on every node use it without calling
+// TeamCity themselves.
+type serverHealth struct {
+	// URL is the server that was checked, so the result of a previous installation is ignored
+	URL                 string
+	Healthy             bool
+	LastCheck           int64
+	LastSuccess         int64
+	LastFailure         int64
+	LastError           string
+	ConsecutiveFailures int
+	LatencyMillis       int64
+	Version             string
+	BuildNumber         string
+}
+
+// getHealth returns the last known health of a server, or nil if it was not checked yet
+func (p *Plugin) getHealth(server *teamCityServer) (*serverHealth, error) {
+	raw, appErr := p.API.KVGet(kvServerKey(healthKey, server.Name))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not load server health")
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	var health serverHealth
+	if err := json.Unmarshal(raw, &health); err != nil {
+		return nil, errors.Wrap(err, "could not decode server health")
+	}
+
+	if health.URL != server.URL {
+		return nil, nil
+	}
+
+	return &health, nil
+}
+
+// recordHealth updates the stored health of a server with the result of a check
+func (p *Plugin) recordHealth(server *teamCityServer, info *tcServer, latency time.Duration, checkErr error) (*serverHealth, error) {
+	health, err := p.getHealth(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if health == nil {
+		health = &serverHealth{URL: server.URL}
+	}
+
+	now := model.GetMillis()
+	wasHealthy := health.Healthy || health.LastCheck == 0
+
+	health.LastCheck = now
+	health.LatencyMillis = int64(latency / time.Millisecond)
+
+	if checkErr != nil {
+		health.Healthy = false
+		health.LastFailure = now
+		health.LastError = checkErr.Error()
+		health.ConsecutiveFailures++
+
+		if wasHealthy {
+			p.API.LogWarn("TeamCity server is unreachable", "server", server.Name, "url", health.URL, "error", health.LastError)
+		}
+	} else {
+		health.Healthy = true
+		health.LastSuccess = now
+		health.ConsecutiveFailures = 0
+		health.Version = info.Version
+		health.BuildNumber = info.BuildNumber
+
+		if !wasHealthy {
+			p.API.LogInfo("TeamCity server is reachable again", "server", server.Name, "url", health.URL)
+		}
+	}
+
+	raw, err := json.Marshal(health)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode server health")
+	}
+
+	if appErr := p.API.KVSet(kvServerKey(healthKey, server.Name), raw); appErr != nil {
+		return nil, errors.Wrap(appErr, "could not save server health")
+	}
+
+	return health, nil
+}
+
+// checkHealth checks that a server answers with its system access token
+func (p *Plugin) checkHealth(server *teamCityServer) (*serverHealth, error) {
+	start := time.Now()
+	info, err := p.systemClient(server).GetServer()
+
+	return p.recordHealth(server, info, time.Since(start), err)
+}
+
+func (p *Plugin) startHealthMonitor() {
+	p.startJob(healthJobName, func() time.Duration {
+		return healthInterval
+	}, func() error {
+		for _, server := range p.getConfiguration().GetServers() {
+			if !server.Installed() {
+				continue
+			}
+
+			if _, err := p.checkHealth(server); err != nil {
+				p.API.LogWarn("Could not check the TeamCity server health", "server", server.Name, "error", err.Error())
+			}
+		}
+
+		return nil
+	})
+}
+
+// addDegradedNotice explains in an ephemeral command response that the server of the command
+// could not be reached during the last health checks, since the command likely failed because
+// of it
+func (p *Plugin) addDegradedNotice(server *teamCityServer, response *model.CommandResponse) {
+	if response == nil || response.ResponseType != model.COMMAND_RESPONSE_TYPE_EPHEMERAL || response.Text == "" {
+		return
+	}
+
+	health, err := p.getHealth(server)
+	if err != nil || health == nil || health.Healthy {
+		return
+	}
+
+	since := time.Since(timeFromMillis(health.LastSuccess))
+	if health.LastSuccess == 0 {
+		since = time.Since(timeFromMillis(health.LastFailure))
+	}
+
+	response.Text += fmt.Sprintf("\n\n:warning: TeamCity%s has not been reachable for %s. Results may be incomplete until it is back, see `/teamcity health`.", p.serverNote(server.Name), fmtDuration(since))
+}
+
+// timeFromMillis converts milliseconds since the epoch, as returned by model.GetMillis
+func timeFromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// fmtHealthTime formats a health check time for /teamcity health
+func fmtHealthTime(millis int64) string {
+	if millis == 0 {
+		return "never"
+	}
+
+	t := timeFromMillis(millis)
+
+	return t.Format(fmtDateTime) + " (" + fmtDuration(time.Since(t)) + " ago)"
+}
+
+func (p *Plugin) executeCommandTriggerHealth(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	servers := p.getConfiguration().GetServers()
+	if len(servers) == 0 {
+		return p.postEphemeral(errorNotInstalled)
+	}
+
+	var messages []string
+	for _, server := range servers {
+		message, err := p.serverHealthMessage(server)
+		if err != nil {
+			return p.postEphemeral("Could not get the server health: `" + err.Error() + "`")
+		}
+
+		messages = append(messages, message)
+	}
+
+	return p.postEphemeral(strings.Join(messages, "\n"))
+}
+
+// serverHealthMessage describes the last health checks of a server
+func (p *Plugin) serverHealthMessage(server *teamCityServer) (string, error) {
+	health, err := p.getHealth(server)
+	if err != nil {
+		return "", err
+	}
+
+	title := "**TeamCity Server Health**"
+	if server.Name != defaultServerName || len(p.getConfiguration().GetServers()) > 1 {
+		title = "**TeamCity Server Health: " + server.Name + "**"
+	}
+
+	tokenNote := ""
+	if server.tokenError != "" {
+		tokenNote = " - Access token: " + iconBad + " " + server.tokenError + "\n"
+	}
+
+	if health == nil {
+		return title + "\n" + fmt.Sprintf("The TeamCity server %s was not checked yet. It is checked every %s.\n", server.URL, fmtDuration(healthInterval)) + tokenNote, nil
+	}
+
+	message := title + "\n" +
+		"----\n" +
+		" - Server: " + health.URL + "\n"
+
+	if health.Healthy {
+		message += " - Status: " + iconGood + " Reachable\n"
+	} else {
+		message += fmt.Sprintf(" - Status: %s **Unreachable** (%d failed checks in a row)\n", iconBad, health.ConsecutiveFailures)
+	}
+
+	if health.Version != "" {
+		message += " - Version: " + health.Version + " (build " + health.BuildNumber + ")\n"
+	}
+
+	message += fmt.Sprintf(" - Latency: %dms\n", health.LatencyMillis) +
+		" - Last check: " + fmtHealthTime(health.LastCheck) + "\n" +
+		" - Last success: " + fmtHealthTime(health.LastSuccess) + "\n" +
+		" - Last failure: " + fmtHealthTime(health.LastFailure) + "\n"
+
+	if !health.Healthy && health.LastError != "" {
+		message += " - Error: `" + health.LastError + "`\n"
+	}
+
+	message += tokenNote
+
+	return message, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	up := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&tcServer{Version: "2023.11", BuildNumber: "147412"})
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{TeamCityURL: server.URL, teamCityToken: "token"})
+	teamCity := p.getConfiguration().GetServer(defaultServerName)
+
+	assert.Contains(p.executeCommandTriggerHealth(&model.CommandArgs{}, nil).Text, "not checked yet")
+
+	health, err := p.checkHealth(teamCity)
+	assert.Nil(err)
+	assert.True(health.Healthy)
+	assert.Equal("2023.11", health.Version)
+
+	response := p.postEphemeral("Error listing projects")
+	p.addDegradedNotice(teamCity, response)
+	assert.Equal("Error listing projects", response.Text, "no notice while the server is healthy")
+
+	up = false
+	health, err = p.checkHealth(teamCity)
+	assert.Nil(err)
+	assert.False(health.Healthy)
+	assert.Equal(1, health.ConsecutiveFailures)
+	assert.Contains(health.LastError, "503")
+	assert.NotZero(health.LastSuccess)
+	api.AssertCalled(t, "LogWarn", "TeamCity server is unreachable", "server", defaultServerName, "url", server.URL, "error", health.LastError)
+
+	p.addDegradedNotice(teamCity, response)
+	assert.Contains(response.Text, "TeamCity has not been reachable")
+
+	text := p.executeCommandTriggerHealth(&model.CommandArgs{}, nil).Text
+	assert.Contains(text, "**Unreachable** (1 failed checks in a row)")
+	assert.Contains(text, " - Version: 2023.11 (build 147412)")
+	assert.Contains(text, "503")
+
+	up = true
+	health, err = p.checkHealth(teamCity)
+	assert.Nil(err)
+	assert.True(health.Healthy)
+	assert.Zero(health.ConsecutiveFailures)
+	api.AssertCalled(t, "LogInfo", "TeamCity server is reachable again", "server", defaultServerName, "url", server.URL)
+
+	// Stored tokens that cannot be used are reported
+	p.setConfiguration(&configuration{TeamCityURL: server.URL, TeamCityToken: "encrypted:token", teamCityTokenError: "Could not decrypt the access token"})
+	assert.Contains(p.executeCommandTriggerHealth(&model.CommandArgs{}, nil).Text, " - Access token: "+iconBad+" Could not decrypt the access token")
+
+	// A new installation does not use the health of the previous server
+	p.setConfiguration(&configuration{TeamCityURL: "http://other", teamCityToken: "token"})
+	health, err = p.getHealth(p.getConfiguration().GetServer(defaultServerName))
+	assert.Nil(err)
+	assert.Nil(health)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v5/plugin"
+)
+
+const (
+	// Webhook bodies larger than this are rejected
+	maxWebhookBodySize = 1 << 20
+
+	// webhookQueueSize limits the build events received by the webhook that wait to be
+	// dispatched. Further events are refused so TeamCity retries them later.
+	webhookQueueSize = 100
+)
+
+// webhookQueue holds the build events received by the webhook until they are dispatched.
+// Dispatching an event looks up changes, tests and build problems in TeamCity and sends direct
+// messages, which takes longer than TeamCity waits for the response: it would retry the event
+// and post it twice. A single worker, running while the plugin is active, dispatches the events
+// in the order they were received.
+type webhookQueue struct {
+	sync.Mutex
+	events chan *buildEvent
+	done   chan struct{}
+}
+
+// ServeHTTP handles HTTP requests sent to /plugins/<plugin id>/
+func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/webhook":
+		p.handleWebhook(w, r)
+	case startBuildActionPath:
+		p.handleStartBuildAction(w, r)
+	case startBuildDialogPath:
+		p.handleStartBuildDialog(w, r)
+	case buildActionPath:
+		p.handleBuildAction(w, r)
+	case tagBuildDialogPath:
+		p.handleTagBuildDialog(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, autocompletePath) {
+			p.handleAutocomplete(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// handleWebhook receives build events pushed by TeamCity. Servers other than the default one
+// add their name to the webhook URL with the server query parameter.
+func (p *Plugin) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	configuration := p.getConfiguration()
+
+	secret := r.URL.Query().Get("secret")
+	if configuration.WebhookSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(secret), []byte(configuration.WebhookSecret)) != 1 {
+		http.Error(w, "invalid webhook secret", http.StatusForbidden)
+		return
+	}
+
+	server := configuration.GetServer(r.URL.Query().Get("server"))
+	if server == nil {
+		http.Error(w, "unknown server", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	event, err := parseWebhook(body)
+	if err != nil {
+		p.API.LogWarn("Received invalid TeamCity webhook", "server", server.Name, "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if event == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	event.Server = server.Name
+
+	if !p.queueWebhookEvent(event) {
+		p.API.LogWarn("Could not queue TeamCity build event, refusing webhook", "server", server.Name, "build_id", event.BuildID)
+		http.Error(w, "could not queue build event", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// startWebhookWorker creates the webhook queue and starts the worker dispatching its events
+func (p *Plugin) startWebhookWorker() {
+	p.webhookEvents.Lock()
+	defer p.webhookEvents.Unlock()
+
+	events := make(chan *buildEvent, webhookQueueSize)
+	done := make(chan struct{})
+	p.webhookEvents.events = events
+	p.webhookEvents.done = done
+
+	go p.dispatchWebhookEvents(events, done)
+}
+
+// stopWebhookWorker closes the webhook queue and waits for the worker to dispatch the events
+// still queued
+func (p *Plugin) stopWebhookWorker() {
+	p.webhookEvents.Lock()
+	events, done := p.webhookEvents.events, p.webhookEvents.done
+	p.webhookEvents.events, p.webhookEvents.done = nil, nil
+	p.webhookEvents.Unlock()
+
+	if events == nil {
+		return
+	}
+
+	close(events)
+	<-done
+}
+
+// queueWebhookEvent queues a build event for the webhook worker, returning false if the queue
+// is full or the worker is not running
+func (p *Plugin) queueWebhookEvent(event *buildEvent) bool {
+	p.webhookEvents.Lock()
+	defer p.webhookEvents.Unlock()
+
+	if p.webhookEvents.events == nil {
+		return false
+	}
+
+	select {
+	case p.webhookEvents.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatchWebhookEvents dispatches the queued webhook events one at a time until the queue is
+// closed
+func (p *Plugin) dispatchWebhookEvents(events <-chan *buildEvent, done chan<- struct{}) {
+	defer close(done)
+
+	for event := range events {
+		if err := p.dispatchBuildEvent(event); err != nil {
+			p.API.LogError("Could not dispatch TeamCity build event",
+				"server", event.Server,
+				"build_id", event.BuildID,
+				"error", err.Error(),
+			)
+		}
+	}
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "could not encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// kvKey builds a KV store key from a prefix and identifiers such as build configuration IDs or
+// branch names. The identifiers are hashed if the key would exceed the KV store's limit.
+func kvKey(prefix string, ids ...string) string {
+	key := prefix + strings.Join(ids, "_")
+	if len(key) <= model.KEY_VALUE_KEY_MAX_RUNES {
+		return key
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\x00")))
+	hashed := hex.EncodeToString(sum[:])
+
+	return prefix + hashed[:model.KEY_VALUE_KEY_MAX_RUNES-len(prefix)]
+}
+
+// kvServerKey is kvKey for state belonging to a TeamCity server. The keys of the server of the
+// plugin settings do not contain its name, so state stored before servers were named is kept.
+func kvServerKey(prefix, server string, ids ...string) string {
+	if server = serverNameOrDefault(server); server != defaultServerName {
+		ids = append([]string{server}, ids...)
+	}
+
+	return kvKey(prefix, ids...)
+}
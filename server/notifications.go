@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	commandTriggerNotifications    = "notifications"
+	commandTriggerNotificationsOn  = "on"
+	commandTriggerNotificationsOff = "off"
+
+	// notificationsOffKey is set for users who do not want direct messages about builds their
+	// changes broke
+	notificationsOffKey = "notifications_off_"
+
+	// maxMutedFailures limits the failed tests and the build problems muted at once
+	maxMutedFailures = 100
+
+	msgNotificationsOn  = "The TeamCity bot sends you a direct message when your changes are in the first failing build of a build configuration. Turn this off with `/teamcity notifications off`."
+	msgNotificationsOff = "The TeamCity bot does not send you direct messages about failing builds. Turn them on with `/teamcity notifications on`."
+)
+
+// notificationsOff returns true if a user opted out of direct messages about broken builds
+func (p *Plugin) notificationsOff(userID string) (bool, error) {
+	value, appErr := p.API.KVGet(kvKey(notificationsOffKey, userID))
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "could not load notification settings")
+	}
+
+	return value != nil, nil
+}
+
+// setNotificationsOff opts a user out of direct messages about broken builds, or in again
+func (p *Plugin) setNotificationsOff(userID string, off bool) error {
+	key := kvKey(notificationsOffKey, userID)
+
+	if !off {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "could not save notification settings")
+		}
+		return nil
+	}
+
+	if appErr := p.API.KVSet(key, []byte("true")); appErr != nil {
+		return errors.Wrap(appErr, "could not save notification settings")
+	}
+
+	return nil
+}
+
+// notifyCommitters sends a direct message to the Mattermost users whose changes are in the first
+// failing build of a build configuration, with buttons to take the investigation or mute the
+// failures
+func (p *Plugin) notifyCommitters(event *buildEvent) {
+	if event.Kind != eventFailed || event.Delta != deltaBroken || event.Personal || event.BuildID == 0 {
+		return
+	}
+
+	// Direct messages belong to no team or channel, so only disabling the plugin everywhere
+	// stops them
+	if scope, err := p.disabledScope("", ""); err != nil || scope != "" {
+		return
+	}
+
+	client, err := p.serverClient(event.Server)
+	if err != nil {
+		p.API.LogWarn("Could not notify committers", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	changes, err := client.GetChanges(fmt.Sprintf("build:(id:%d)", event.BuildID))
+	if err != nil {
+		p.API.LogWarn("Could not notify committers", "build_id", event.BuildID, "error", err.Error())
+		return
+	}
+
+	var userIDs []string
+	seen := map[string]bool{}
+	for _, change := range p.resolveChangeAuthors(event.Server, changes) {
+		if change.AuthorID == "" || seen[change.AuthorID] {
+			continue
+		}
+		seen[change.AuthorID] = true
+
+		off, err := p.notificationsOff(change.AuthorID)
+		if err != nil {
+			p.API.LogWarn("Could not check notification settings", "user_id", change.AuthorID, "error", err.Error())
+			continue
+		}
+		if !off {
+			userIDs = append(userIDs, change.AuthorID)
+		}
+	}
+
+	if len(userIDs) == 0 {
+		return
+	}
+
+	p.fillFailureDetails(event)
+
+	for _, userID := range userIDs {
+		if err := p.postCommitterNotification(userID, event); err != nil {
+			p.API.LogError("Could not notify committer of a broken build",
+				"build_id", event.BuildID,
+				"user_id", userID,
+				"error", err.Error(),
+			)
+		}
+	}
+}
+
+// postCommitterNotification posts a broken build to the direct channel of a user with the bot
+func (p *Plugin) postCommitterNotification(userID string, event *buildEvent) error {
+	channel, appErr := p.API.GetDirectChannel(userID, p.botUserID)
+	if appErr != nil {
+		return errors.Wrap(appErr, "could not get direct channel")
+	}
+
+	post := &model.Post{
+		UserId:    p.botUserID,
+		ChannelId: channel.Id,
+		Message: fmt.Sprintf("Your changes are in [%s](%s), the first failing build since the build configuration last succeeded. "+
+			"Take the investigation if you are looking into it, or mute the failures if they are expected.\n"+
+			"_Turn these messages off with `/teamcity notifications off`._", event.Title(), event.WebURL),
+	}
+	attachment := event.attachment()
+	attachment.Actions = p.buildActions(event.Server, event.BuildID, buildActionInvestigate, buildActionMute, buildActionLog)
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{attachment})
+
+	if _, appErr = p.API.CreatePost(post); appErr != nil {
+		return appErr
+	}
+
+	return nil
+}
+
+// muteBuildFailures mutes the failed tests and the build problems of a build in its build
+// configuration until they are fixed, returning a note on what was muted
+func muteBuildFailures(client TeamCityClient, build *tcBuild, comment string) (string, error) {
+	tests, err := client.GetTestOccurrences(fmt.Sprintf("build:(id:%d),status:FAILURE,count:%d", build.ID, maxMutedFailures))
+	if err != nil {
+		return "", errors.Wrap(err, "could not get failed tests")
+	}
+
+	problems, err := client.GetProblemOccurrences(fmt.Sprintf("build:(id:%d),count:%d", build.ID, maxMutedFailures))
+	if err != nil {
+		return "", errors.Wrap(err, "could not get build problems")
+	}
+
+	var testIDs, problemIDs []int64
+	for _, test := range tests.TestOccurrence {
+		if test.Test != nil && !test.Muted {
+			testIDs = append(testIDs, int64(test.Test.ID))
+		}
+	}
+	for _, problem := range problems.ProblemOccurrence {
+		// The problem of the failed tests goes away with the tests
+		if problem.Problem != nil && problem.Type != tcProblemFailedTests {
+			problemIDs = append(problemIDs, int64(problem.Problem.ID))
+		}
+	}
+
+	if len(testIDs) == 0 && len(problemIDs) == 0 {
+		return "", nil
+	}
+
+	if err = client.MuteFailures(build.BuildTypeID, testIDs, problemIDs, comment); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s and %s", pluralize(len(testIDs), "test"), pluralize(len(problemIDs), "build problem")), nil
+}
+
+func (p *Plugin) executeCommandTriggerNotifications(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	off, err := p.notificationsOff(args.UserId)
+	if err != nil {
+		return p.postEphemeral("Could not get your notification settings: `" + err.Error() + "`")
+	}
+
+	if off {
+		return p.postEphemeral(msgNotificationsOff)
+	}
+
+	return p.postEphemeral(msgNotificationsOn)
+}
+
+func (p *Plugin) executeCommandTriggerNotificationsOn(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	if err := p.setNotificationsOff(args.UserId, false); err != nil {
+		return p.postEphemeral("Could not turn notifications on: `" + err.Error() + "`")
+	}
+
+	return p.postEphemeral(msgNotificationsOn)
+}
+
+func (p *Plugin) executeCommandTriggerNotificationsOff(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	if err := p.setNotificationsOff(args.UserId, true); err != nil {
+		return p.postEphemeral("Could not turn notifications off: `" + err.Error() + "`")
+	}
+
+	return p.postEphemeral(msgNotificationsOff)
+}
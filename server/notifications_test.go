@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestCommitterNotifications(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	plugin.botUserID = "bot"
+	jane := testUsers[0]
+	api.On("GetDirectChannel", jane.Id, "bot").Return(&model.Channel{Id: "dm"}, nil)
+
+	var posted []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		posted = append(posted, post)
+		return post
+	}, nil)
+
+	// Events of a build are only dispatched once, later events are of builds of the same revision
+	dispatched := map[int64]bool{}
+	event := func(buildID int64, kind string) *buildEvent {
+		build := teamCity.builds[buildID]
+		if dispatched[buildID] {
+			build = teamCity.rerunBuild(buildID)
+		}
+		dispatched[buildID] = true
+
+		event := eventFromBuild(build)
+		event.Kind = kind
+		return event
+	}
+
+	// Without a stored result, the failing build is compared with the previous build in TeamCity
+	assert.Nil(plugin.dispatchBuildEvent(event(2, eventFailed)))
+	assert.Len(posted, 1, "only the committer with a Mattermost user is notified")
+
+	post := posted[0]
+	assert.Equal("dm", post.ChannelId)
+	assert.Equal("bot", post.UserId)
+	assert.Contains(post.Message, "Your changes are in [Mattermost TeamCity Plugin / Test Build #2](http://teamcity/viewLog.html?buildId=2)")
+	assert.Contains(post.Message, "`/teamcity notifications off`")
+
+	attachment := post.Attachments()[0]
+	assert.Contains(attachment.Text, "**Build broken**")
+	assert.Contains(attachment.Text, "**Failed tests:**\n - `server: TestBuildLogTail`")
+	var actions []string
+	for _, action := range attachment.Actions {
+		actions = append(actions, action.Name)
+	}
+	assert.Equal([]string{"Take investigation", "Mute", "Show log tail"}, actions)
+
+	// Builds failing again are not the first failing build
+	assert.Nil(plugin.dispatchBuildEvent(event(2, eventFailed)))
+	assert.Len(posted, 1)
+
+	// Personal builds are not notified
+	assert.Nil(plugin.dispatchBuildEvent(event(1, eventSucceeded)))
+	personal := event(2, eventFailed)
+	personal.Personal = true
+	assert.Nil(plugin.dispatchBuildEvent(personal))
+	assert.Len(posted, 1)
+
+	args := generateArgs("notifications off")
+	args.UserId = jane.Id
+	response := plugin.executeCommandHooks(args)
+	assert.Equal(msgNotificationsOff, response.Text)
+
+	args = generateArgs("notifications")
+	args.UserId = jane.Id
+	response = plugin.executeCommandHooks(args)
+	assert.Equal(msgNotificationsOff, response.Text)
+
+	assert.Nil(plugin.dispatchBuildEvent(event(1, eventSucceeded)))
+	assert.Nil(plugin.dispatchBuildEvent(event(2, eventFailed)))
+	assert.Len(posted, 1, "users who turned notifications off are not notified")
+
+	args = generateArgs("notifications on")
+	args.UserId = jane.Id
+	response = plugin.executeCommandHooks(args)
+	assert.Equal(msgNotificationsOn, response.Text)
+
+	assert.Nil(plugin.dispatchBuildEvent(event(1, eventSucceeded)))
+	assert.Nil(plugin.dispatchBuildEvent(event(2, eventFailed)))
+	assert.Len(posted, 2)
+
+	assert.Nil(plugin.setDisabled(scopeGlobal, "", "", true))
+	assert.Nil(plugin.dispatchBuildEvent(event(1, eventSucceeded)))
+	assert.Nil(plugin.dispatchBuildEvent(event(2, eventFailed)))
+	assert.Len(posted, 2, "no direct messages are sent while the plugin is disabled everywhere")
+}
+
+func TestInvestigateAndMuteActions(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("")
+	api.On("GetUser", args.UserId).Return(&model.User{Id: args.UserId, Username: "jane"}, nil)
+
+	buttons := plugin.buildActions(defaultServerName, 2, buildActionInvestigate, buildActionMute)
+	post := &model.Post{Id: "post", ChannelId: "dm"}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{Text: "**Build broken**", Actions: buttons}})
+	api.On("GetPost", "post").Return(post, nil)
+
+	click := func(button *model.PostAction) *model.PostActionIntegrationResponse {
+		body, _ := json.Marshal(&model.PostActionIntegrationRequest{
+			UserId:    args.UserId,
+			ChannelId: "dm",
+			PostId:    "post",
+			Context:   button.Integration.Context,
+		})
+
+		r := httptest.NewRequest(http.MethodPost, buildActionPath, bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-Id", args.UserId)
+		w := httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, r)
+
+		var response model.PostActionIntegrationResponse
+		assert.Nil(json.NewDecoder(w.Body).Decode(&response))
+		return &response
+	}
+
+	response := click(buttons[0])
+	assert.Empty(response.EphemeralText)
+	assert.Contains(response.Update.Attachments()[0].Text, "_Investigation taken by @jane_")
+	assert.Len(response.Update.Attachments()[0].Actions, 1, "the investigation can only be taken once")
+
+	assert.Len(teamCity.investigations, 1)
+	investigation := teamCity.investigations[0]
+	assert.Equal(map[string]interface{}{"username": "admin"}, investigation["assignee"], "the TeamCity account of the user takes the investigation")
+	assert.Equal("TAKEN", investigation["state"])
+	assert.Equal(map[string]interface{}{"anyProblem": true}, investigation["target"])
+	assert.Equal(map[string]interface{}{"buildTypes": map[string]interface{}{"buildType": []interface{}{map[string]interface{}{"id": "MattermostTeamcityPlugin_TestBuild"}}}}, investigation["scope"])
+
+	response = click(buttons[1])
+	assert.Empty(response.EphemeralText)
+	assert.Contains(response.Update.Attachments()[0].Text, "_Muted 1 test and 1 build problem by @jane_")
+
+	assert.Len(teamCity.mutes, 1)
+	assert.Equal(map[string]interface{}{
+		"tests":    map[string]interface{}{"test": []interface{}{map[string]interface{}{"id": "-102"}}},
+		"problems": map[string]interface{}{"problem": []interface{}{map[string]interface{}{"id": "2"}}},
+	}, teamCity.mutes[0]["target"], "the failed tests and build problems are muted, except the problem of the failed tests")
+
+	// Successful builds have nothing to mute
+	succeeded := plugin.buildActions(defaultServerName, 1, buildActionMute)
+	response = click(succeeded[0])
+	assert.Equal("Build 1 has no failures to mute", response.EphemeralText)
+	assert.Len(teamCity.mutes, 1)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	permissionStart  = "start"
+	permissionCancel = "cancel"
+
+	principalGroupPrefix = "group:"
+	principalRolePrefix  = "role:"
+
+	errorAdminOnly = "Only system administrators can use this command"
+)
+
+// permissionRule allows the principals to perform an action on a project, including its
+// subprojects, or on a build configuration. Rules are configured one per line as
+// "<action> [<server>:]<project_id|build_type_id|*> <principal>, <principal>...". Like in the
+// polling scope, targets without a server are on the default server. A principal is a
+// username, "group:<name>" or "role:<channel_admin|team_admin|system_admin>".
+type permissionRule struct {
+	Action string
+	// Server is the name of the TeamCity server of the target, or "" for the default server
+	Server     string
+	Target     string
+	Principals []string
+}
+
+// parsePermissionRules parses the permission rules of the plugin configuration
+func parsePermissionRules(text string) ([]*permissionRule, error) {
+	var rules []*permissionRule
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected <action> <target> <principals>", i+1)
+		}
+
+		server, target := splitScopedID(fields[1])
+		rule := &permissionRule{
+			Action: strings.ToLower(fields[0]),
+			Server: strings.ToLower(server),
+			Target: target,
+		}
+
+		if rule.Action != permissionStart && rule.Action != permissionCancel {
+			return nil, fmt.Errorf("line %d: unknown action %q", i+1, fields[0])
+		}
+
+		if target == "" {
+			return nil, fmt.Errorf("line %d: missing target in %q", i+1, fields[1])
+		}
+
+		if rule.Server != "" {
+			if err := validateServerName(rule.Server); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+			}
+		}
+
+		for _, principal := range strings.Split(strings.Join(fields[2:], " "), ",") {
+			principal = strings.TrimPrefix(strings.TrimSpace(principal), "@")
+			if principal == "" {
+				continue
+			}
+
+			if strings.HasPrefix(principal, principalRolePrefix) {
+				switch strings.TrimPrefix(principal, principalRolePrefix) {
+				case model.CHANNEL_ADMIN_ROLE_ID, model.TEAM_ADMIN_ROLE_ID, model.SYSTEM_ADMIN_ROLE_ID:
+				default:
+					return nil, fmt.Errorf("line %d: unknown role %q", i+1, principal)
+				}
+			}
+
+			rule.Principals = append(rule.Principals, principal)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// permissionContext is where a user attempts an action
+type permissionContext struct {
+	UserID    string
+	ChannelID string
+	TeamID    string
+	// Server is the TeamCity server of the build configuration
+	Server string
+}
+
+func (p *Plugin) isSystemAdmin(userID string) bool {
+	return p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM)
+}
+
+// hasPermission returns true if the user may perform the action on a build configuration.
+// Build configurations not matched by any rule for the action are open to everyone, and system
+// administrators may always act.
+func (p *Plugin) hasPermission(ctx *permissionContext, action string, buildType *tcBuildType) (bool, error) {
+	configuration := p.getConfiguration()
+	server := serverNameOrDefault(ctx.Server)
+
+	rules, err := parsePermissionRules(configuration.Permissions)
+	if err != nil {
+		return false, errors.Wrap(err, "invalid permission rules")
+	}
+
+	var actionRules []*permissionRule
+	for _, rule := range rules {
+		if rule.Action == action && configuration.scopeMatchesServer(rule.Server, server) {
+			actionRules = append(actionRules, rule)
+		}
+	}
+
+	if len(actionRules) == 0 {
+		return true, nil
+	}
+
+	// A rule on a parent project that cannot be looked up could deny the action, so the check
+	// fails rather than ignoring it
+	ancestors, err := p.projectAncestors(&buildEvent{Server: ctx.Server, BuildTypeID: buildType.ID, ProjectID: buildType.ProjectID})
+	if err != nil {
+		return false, err
+	}
+
+	// TeamCity IDs are case-insensitive, like the targets of subscriptions
+	targets := map[string]bool{"*": true, targetKey(buildType.ID): true}
+	for _, projectID := range ancestors {
+		targets[targetKey(projectID)] = true
+	}
+
+	var matching []*permissionRule
+	for _, rule := range actionRules {
+		if targets[targetKey(rule.Target)] {
+			matching = append(matching, rule)
+		}
+	}
+
+	if len(matching) == 0 || p.isSystemAdmin(ctx.UserID) {
+		return true, nil
+	}
+
+	user, appErr := p.API.GetUser(ctx.UserID)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "could not get user")
+	}
+
+	for _, rule := range matching {
+		for _, principal := range rule.Principals {
+			if p.matchesPrincipal(ctx, user, principal) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (p *Plugin) matchesPrincipal(ctx *permissionContext, user *model.User, principal string) bool {
+	switch {
+	case strings.HasPrefix(principal, principalGroupPrefix):
+		name := strings.TrimPrefix(principal, principalGroupPrefix)
+
+		groups, appErr := p.API.GetGroupsForUser(user.Id)
+		if appErr != nil {
+			p.API.LogWarn("Could not get groups of user", "user_id", user.Id, "error", appErr.Error())
+			return false
+		}
+
+		for _, group := range groups {
+			if group.Name != nil && strings.EqualFold(*group.Name, name) {
+				return true
+			}
+		}
+
+		return false
+
+	case strings.HasPrefix(principal, principalRolePrefix):
+		switch strings.TrimPrefix(principal, principalRolePrefix) {
+		case model.CHANNEL_ADMIN_ROLE_ID:
+			member, appErr := p.API.GetChannelMember(ctx.ChannelID, user.Id)
+			return appErr == nil && (member.SchemeAdmin || strings.Contains(member.Roles, model.CHANNEL_ADMIN_ROLE_ID))
+		case model.TEAM_ADMIN_ROLE_ID:
+			member, appErr := p.API.GetTeamMember(ctx.TeamID, user.Id)
+			return appErr == nil && (member.SchemeAdmin || strings.Contains(member.Roles, model.TEAM_ADMIN_ROLE_ID))
+		case model.SYSTEM_ADMIN_ROLE_ID:
+			return p.isSystemAdmin(user.Id)
+		}
+
+		return false
+	}
+
+	return strings.EqualFold(user.Username, principal)
+}
+
+// auditDenied records a denied attempt in the server log
+func (p *Plugin) auditDenied(ctx *permissionContext, action, target string) {
+	p.API.LogWarn("TeamCity permission denied",
+		"audit", true,
+		"user_id", ctx.UserID,
+		"channel_id", ctx.ChannelID,
+		"action", action,
+		"target", target,
+	)
+}
+
+// checkPermission returns the message to show if the user may not perform the action on the
+// build configuration, or "" if they may
+func (p *Plugin) checkPermission(ctx *permissionContext, action string, buildType *tcBuildType) string {
+	allowed, err := p.hasPermission(ctx, action, buildType)
+	if err != nil {
+		p.API.LogError("Could not check TeamCity permissions", "error", err.Error())
+		return "Could not check your permissions: `" + err.Error() + "`"
+	}
+
+	if !allowed {
+		p.auditDenied(ctx, action, buildType.ID)
+		return fmt.Sprintf("You are not allowed to %s builds of `%s`. Ask a system administrator for access.", action, buildType.ID)
+	}
+
+	return ""
+}
+
+// commandPermission checks the permission of the user running a slash command on a build
+// configuration of a server, returning the response to send if they lack it
+func (p *Plugin) commandPermission(args *model.CommandArgs, server, action string, buildType *tcBuildType) *model.CommandResponse {
+	ctx := &permissionContext{UserID: args.UserId, ChannelID: args.ChannelId, TeamID: args.TeamId, Server: server}
+
+	if message := p.checkPermission(ctx, action, buildType); message != "" {
+		return p.postEphemeral(message)
+	}
+
+	return nil
+}
+
+// requireSystemAdmin returns the response to send if the user running the slash command is not
+// a system administrator
+func (p *Plugin) requireSystemAdmin(args *model.CommandArgs, command string) *model.CommandResponse {
+	if p.isSystemAdmin(args.UserId) {
+		return nil
+	}
+
+	p.auditDenied(&permissionContext{UserID: args.UserId, ChannelID: args.ChannelId, TeamID: args.TeamId}, command, "")
+
+	return p.postEphemeral(errorAdminOnly)
+}
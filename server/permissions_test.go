@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestParsePermissionRules(t *testing.T) {
+	assert := assert.New(t)
+
+	rules, err := parsePermissionRules(`
+# Release managers deploy
+start Production @alice, group:release-managers
+cancel * role:channel_admin
+start Infra:Tools bob
+`)
+	assert.Nil(err)
+	assert.Equal([]*permissionRule{
+		{Action: permissionStart, Target: "Production", Principals: []string{"alice", "group:release-managers"}},
+		{Action: permissionCancel, Target: "*", Principals: []string{"role:channel_admin"}},
+		{Action: permissionStart, Server: "infra", Target: "Tools", Principals: []string{"bob"}},
+	}, rules)
+
+	_, err = parsePermissionRules("deploy Production alice")
+	assert.NotNil(err, "unknown action")
+
+	_, err = parsePermissionRules("start Production")
+	assert.NotNil(err, "no principals")
+
+	_, err = parsePermissionRules("start Production role:owner")
+	assert.NotNil(err, "unknown role")
+
+	_, err = parsePermissionRules("start infra: alice")
+	assert.NotNil(err, "no target")
+
+	_, err = parsePermissionRules("start in.fra:Production alice")
+	assert.NotNil(err, "invalid server")
+}
+
+func TestHasPermission(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/app/rest/projects/id:") {
+		case "Production_Web":
+			_ = json.NewEncoder(w).Encode(&tcProject{ID: "Production_Web", ParentProjectID: "Production"})
+		case "Production":
+			_ = json.NewEncoder(w).Encode(&tcProject{ID: "Production", ParentProjectID: "_Root"})
+		case "Unavailable":
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+		default:
+			_ = json.NewEncoder(w).Encode(&tcProject{ID: "_Root"})
+		}
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PERMISSION_MANAGE_SYSTEM).Return(func(userID string, _ *model.Permission) bool {
+		return userID == "admin"
+	})
+	api.On("GetUser", mock.AnythingOfType("string")).Return(func(userID string) *model.User {
+		return &model.User{Id: userID, Username: userID}
+	}, nil)
+	api.On("GetGroupsForUser", mock.AnythingOfType("string")).Return(func(userID string) []*model.Group {
+		if userID == "carol" {
+			return []*model.Group{{Name: model.NewString("release-managers")}}
+		}
+		return nil
+	}, nil)
+	api.On("GetChannelMember", "channel", mock.AnythingOfType("string")).Return(func(_, userID string) *model.ChannelMember {
+		return &model.ChannelMember{UserId: userID, SchemeAdmin: userID == "dave"}
+	}, nil)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{
+		TeamCityURL: server.URL,
+		Permissions: "start Production alice, group:release-managers\ncancel production_web_deploy role:channel_admin",
+	})
+
+	deploy := &tcBuildType{ID: "Production_Web_Deploy", ProjectID: "Production_Web"}
+	other := &tcBuildType{ID: "Other_Build", ProjectID: "Other"}
+
+	for _, test := range []struct {
+		user      string
+		action    string
+		buildType *tcBuildType
+		allowed   bool
+	}{
+		{"alice", permissionStart, deploy, true},
+		{"carol", permissionStart, deploy, true},
+		{"bob", permissionStart, deploy, false},
+		{"admin", permissionStart, deploy, true},
+		{"bob", permissionStart, other, true},
+		{"dave", permissionCancel, deploy, true},
+		{"alice", permissionCancel, deploy, false},
+	} {
+		ctx := &permissionContext{UserID: test.user, ChannelID: "channel"}
+
+		allowed, err := p.hasPermission(ctx, test.action, test.buildType)
+		assert.Nil(err)
+		assert.Equal(test.allowed, allowed, "%s %s %s", test.user, test.action, test.buildType.ID)
+	}
+
+	// Rules on parent projects that cannot be looked up are not ignored
+	unavailable := &tcBuildType{ID: "Unavailable_Build", ProjectID: "Unavailable"}
+	allowed, err := p.hasPermission(&permissionContext{UserID: "bob", ChannelID: "channel"}, permissionStart, unavailable)
+	assert.NotNil(err)
+	assert.False(allowed)
+
+	message := p.checkPermission(&permissionContext{UserID: "bob", ChannelID: "channel"}, permissionStart, deploy)
+	assert.Contains(message, "not allowed to start builds of `Production_Web_Deploy`")
+	api.AssertCalled(t, "LogWarn", "TeamCity permission denied", "audit", true, "user_id", "bob", "channel_id", "channel", "action", permissionStart, "target", "Production_Web_Deploy")
+
+	p.setConfiguration(&configuration{TeamCityURL: server.URL, Permissions: "start"})
+	_, err = p.hasPermission(&permissionContext{UserID: "bob"}, permissionStart, deploy)
+	assert.NotNil(err, "invalid rules deny")
+
+	// Rules without a server are on the default server
+	p.setConfiguration(&configuration{
+		TeamCityURL:     server.URL,
+		TeamCityServers: []*teamCityServer{{Name: "infra", URL: server.URL, Token: "token"}},
+		Permissions:     "start Production alice\nstart infra:Production carol",
+	})
+	for _, test := range []struct {
+		user    string
+		server  string
+		allowed bool
+	}{
+		{"alice", "", true},
+		{"carol", "", false},
+		{"alice", "infra", false},
+		{"carol", "infra", true},
+	} {
+		allowed, err = p.hasPermission(&permissionContext{UserID: test.user, Server: test.server}, permissionStart, deploy)
+		assert.Nil(err)
+		assert.Equal(test.allowed, allowed, "%s on %s", test.user, test.server)
+	}
+
+	// Projects are only looked up if there are rules for the action
+	p.setConfiguration(&configuration{TeamCityURL: server.URL, Permissions: "cancel Production alice"})
+	allowed, err = p.hasPermission(&permissionContext{UserID: "bob"}, permissionStart, unavailable)
+	assert.Nil(err)
+	assert.True(allowed)
+}
+
+func TestRequireSystemAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PERMISSION_MANAGE_SYSTEM).Return(func(userID string, _ *model.Permission) bool {
+		return userID == "admin"
+	})
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	assert.Nil(p.requireSystemAdmin(&model.CommandArgs{UserId: "admin"}, commandTriggerInstall))
+
+	response := p.requireSystemAdmin(&model.CommandArgs{UserId: "bob", ChannelId: "channel"}, commandTriggerInstall)
+	assert.Equal(errorAdminOnly, response.Text)
+	api.AssertCalled(t, "LogWarn", "TeamCity permission denied", "audit", true, "user_id", "bob", "channel_id", "channel", "action", commandTriggerInstall, "target", "")
+}
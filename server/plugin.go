@@ -16,6 +16,33 @@ type Plugin struct {
 	// configuration is the active plugin configuration. Consult getConfiguration and
 	// setConfiguration for usage.
 	configuration *configuration
+
+	// botUserID is the user the plugin posts build notifications as.
+	botUserID string
+
+	// projects caches the TeamCity project hierarchy used to route build events.
+	projects projectCache
+
+	// autocomplete caches the suggestions of the slash command autocomplete.
+	autocomplete autocompleteCache
+
+	// webhookEvents queues the build events received by the webhook.
+	webhookEvents webhookQueue
+
+	// nodeID identifies this plugin instance when electing the cluster node that runs
+	// background jobs.
+	nodeID string
+
+	// jobs are the background jobs started on activation.
+	jobs []*backgroundJob
+
+	// polledTargets are the projects and build configurations polled since activation, keyed
+	// by server and ID. Only the poller job uses it.
+	polledTargets map[string]bool
+
+	// newClient creates TeamCity clients. It defaults to the REST API client and is replaced by
+	// tests.
+	newClient func(baseURL, token string) TeamCityClient
 }
 
 // See https://developers.mattermost.com/extend/plugins/server/reference/
@@ -1,56 +1,113 @@
 package main
 
 import (
-	"testing"
 	"fmt"
+	"net/http"
+	"strings"
+	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/mattermost/mattermost-server/v5/model"
-	"github.com/icelander/teamcity-sdk-go/teamcity"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 )
 
-type commandArgs struct {
-	UserID string `json:"user_id"`
-	ChannelID string `json:"channel_id"`
-	TeamID string `json:"team_id"`
-	RootID string `json:"root_id"`
-	ParentID string `json:"parent_id"`
-	TriggerID string `json:"trigger_id"`
-	Command string `json:"command"`
-}
-
 func generateArgs(cmd string) *model.CommandArgs {
 	var cArgs = &model.CommandArgs{
-		UserId: "31rs9bjkm38rxq6666x1tgm9to",
+		UserId:    "31rs9bjkm38rxq6666x1tgm9to",
 		ChannelId: "8orrfwp793yypgucsbysuusu4c",
-		TeamId: "qoocd8165ibjdynn96qo1p6d8w",
-		RootId: "",
-		ParentId: "",
+		TeamId:    "qoocd8165ibjdynn96qo1p6d8w",
+		RootId:    "",
+		ParentId:  "",
 		TriggerId: "OW1oY3V0d2Rwam42ZnAxbWV1ZWc0M25lYnI6MzFyczliamttMzhyeHE2NjY2eDF0Z205dG86MTU3OTQwNjE5NDg1NjpNRVFDSUNEaEZ2RGcxNFUwdFRiZDFwY1lmZkJFNW9QOXA4c3UrblB0Y2E2d3BYRUlBaUJmRmo5Q1hTcEZwZTVpOVlOcjF0WmhwQjRUK3R5bm1KWXh3bkZzU0dpZ2d3PT0=",
-		Command: "/teamcity " + cmd,
+		Command:   "/teamcity " + cmd,
 	}
 
 	return cArgs
 }
 
+// testUsers are the Mattermost users of newTestPlugin, found by username or email
+var testUsers = []*model.User{
+	{Id: "janeid00000000000000000000", Username: "jane", Email: "jane@example.com"},
+	{Id: "bobid000000000000000000000", Username: "bob", Email: "bob@example.com"},
+}
+
+func testUser(usernameOrEmail string) *model.User {
+	for _, user := range testUsers {
+		if user.Username == usernameOrEmail || user.Email == usernameOrEmail {
+			return user
+		}
+	}
+
+	return nil
+}
+
+func testUserError(usernameOrEmail string) *model.AppError {
+	if testUser(usernameOrEmail) == nil {
+		return model.NewAppError("GetUser", "app.user.missing_account.const", nil, "", http.StatusNotFound)
+	}
+
+	return nil
+}
+
+// newTestPlugin returns a plugin using a fake TeamCity server, with the Mattermost API mocked.
+// The user of generateArgs is a system administrator. The caller closes the TeamCity server.
+func newTestPlugin(t *testing.T) (*Plugin, *plugintest.API, *fakeTeamCity) {
+	teamCity := newFakeTeamCity()
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+	allowLogs(api)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	api.On("GetPluginConfig").Return(map[string]interface{}{})
+	api.On("SavePluginConfig", mock.Anything).Return(nil)
+	api.On("GetUserByEmail", mock.AnythingOfType("string")).Return(testUser, testUserError)
+	api.On("GetUserByUsername", mock.AnythingOfType("string")).Return(testUser, testUserError)
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.setConfiguration(&configuration{})
+
+	return plugin, api, teamCity
+}
+
+// installTestPlugin installs the plugin on the fake TeamCity server and connects the user of
+// generateArgs
+func installTestPlugin(t *testing.T) (*Plugin, *plugintest.API, *fakeTeamCity) {
+	plugin, api, teamCity := newTestPlugin(t)
+
+	response := plugin.executeCommandHooks(generateArgs("install " + teamCity.URL + " " + fakeTeamCityToken))
+	if !strings.Contains(response.Text, "TeamCity Installed!") {
+		t.Fatalf("Could not install the plugin: %s", response.Text)
+	}
+
+	response = plugin.executeCommandHooks(generateArgs("connect " + fakeTeamCityToken))
+	if !strings.Contains(response.Text, "Connected to TeamCity") {
+		t.Fatalf("Could not connect the user: %s", response.Text)
+	}
+
+	return plugin, api, teamCity
+}
+
 func TestNoArguments(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	cArgs := generateArgs("")
 	response := plugin.executeCommandHooks(cArgs)
 
-	assert.Equal(commandDialogHelp, response.Text)
+	assert.Equal(commandTree().helpText(), response.Text)
+	assert.Contains(response.Text, "- `/teamcity build cancel <build_id> [<comment>]` - Cancel a build")
 }
 
 func TestPluginNotInstalled(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-	
+	plugin, _, teamCity := newTestPlugin(t)
+	defer teamCity.Close()
+
 	cArgs := generateArgs("list projects")
 	response := plugin.executeCommandHooks(cArgs)
 
@@ -59,15 +116,18 @@ func TestPluginNotInstalled(t *testing.T) {
 
 func TestInstallPlugin(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, _, teamCity := newTestPlugin(t)
+	defer teamCity.Close()
 
-	cArgs := generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl")
+	cArgs := generateArgs("install " + teamCity.URL + " " + fakeTeamCityToken)
 	response := plugin.executeCommandHooks(cArgs)
-	
+
 	configuration := plugin.getConfiguration()
 
-	assert.Equal("http://127.0.0.1:8111/", configuration.TeamCityURL)
-	assert.Equal("eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl", configuration.TeamCityToken)
+	assert.Equal(teamCity.URL, configuration.TeamCityURL)
+	assert.Equal(fakeTeamCityToken, configuration.GetTeamCityToken())
+	// The token is stored encrypted
+	assert.True(strings.HasPrefix(configuration.TeamCityToken, encryptedPrefix))
 
 	assert.True(configuration.Installed())
 
@@ -76,52 +136,46 @@ func TestInstallPlugin(t *testing.T) {
 
 func TestEnablePlugin(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
-
-	
 	cArgs := generateArgs("enable")
 	response := plugin.executeCommandHooks(cArgs)
-	
-	configuration := plugin.getConfiguration()
 
-	assert.False(configuration.disabled, "configuration.disabled should be false after enabling it")
+	scope, err := plugin.disabledScope(cArgs.TeamId, cArgs.ChannelId)
+	assert.Nil(err)
+	assert.Empty(scope, "the plugin should be enabled after enabling it")
 	assert.Equal(msgEnabled, response.Text)
 }
 
 func TestDisablePlugin(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
-	
 	cArgs := generateArgs("disable")
 	response := plugin.executeCommandHooks(cArgs)
-	
-	configuration := plugin.getConfiguration()
 
-	assert.True(configuration.disabled, "configuration.disabled should be true after disabling it")
+	scope, err := plugin.disabledScope(cArgs.TeamId, cArgs.ChannelId)
+	assert.Nil(err)
+	assert.Equal(scopeGlobal, scope, "the plugin should be disabled after disabling it")
 	assert.Equal(msgDisabled, response.Text)
 }
 
 func TestPluginDisabled(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-	
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
-
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	// Make sure the plugin is disabled
 	plugin.executeCommandHooks(generateArgs("disable"))
 	configuration := plugin.getConfiguration()
 
-	assert.True(configuration.disabled, "configuration.disabled should be true")
-	assert.True(configuration.Installed(), "configuration.Installed() should be true")	
-	
+	scope, err := plugin.disabledScope("", "")
+	assert.Nil(err)
+	assert.Equal(scopeGlobal, scope, "the plugin should be disabled")
+	assert.True(configuration.Installed(), "configuration.Installed() should be true")
+
 	cArgs := generateArgs("list projects")
 	response := plugin.executeCommandHooks(cArgs)
 
@@ -130,62 +184,57 @@ func TestPluginDisabled(t *testing.T) {
 
 func TestListProjects(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-	
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	cArgs := generateArgs("list projects")
 	response := plugin.executeCommandHooks(cArgs)
 
 	assert.Contains(response.Text, "TeamCity Projects")
+	assert.Contains(response.Text, "Mattermost TeamCity Plugin (ID: MattermostTeamcityPlugin)")
+	assert.NotContains(response.Text, "_Root")
 }
 
 func TestListBuilds(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-	
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	cArgs := generateArgs("list builds")
 	response := plugin.executeCommandHooks(cArgs)
 
-	// fmt.Print(response.Text)
-
 	assert.Contains(response.Text, "TeamCity Builds")
+	assert.Contains(response.Text, "[MattermostTeamcityPlugin_TestBuild #2]")
+	assert.Contains(response.Text, "[MattermostTeamcityPlugin_TestBuild #1]")
+	assert.NotContains(response.Text, "#3]", "running builds are not listed")
 }
 
 func TestWhatList(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-	
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	cArgs := generateArgs("list")
 	response := plugin.executeCommandHooks(cArgs)
 
-	assert.Contains(response.Text, errorWhatList)	
+	assert.Contains(response.Text, "`/teamcity list builds`")
+	assert.Contains(response.Text, "`/teamcity list projects`")
 }
 
 func TestStartBuildInvalidBuildType(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	response := plugin.executeCommandHooks(generateArgs("build start janet"))
 
-	assert.Contains(response.Text, "Invalid Build ID")	
+	assert.Contains(response.Text, "Invalid Build ID")
 }
 
 func TestInvalidBuildID(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
-
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
 	response := plugin.executeCommandHooks(generateArgs(fmt.Sprintf("build cancel janet \"%s\"", "Not a buildID")))
 
@@ -194,82 +243,82 @@ func TestInvalidBuildID(t *testing.T) {
 
 func TestGetStats(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: model.NewId()}, nil)
 
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
 	// Start two builds to create a BuildQueue
 	plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild"))
-	time.Sleep(10 * time.Second)
 	plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild"))
-	time.Sleep(10 * time.Second)	
 
 	response := plugin.executeCommandHooks(generateArgs("stats"))
 
 	assert.Contains(response.Text, "Agent Stats")
-	assert.Contains(response.Text, "Build Queue")
+	assert.Contains(response.Text, "[agent-1]")
+	assert.Contains(response.Text, "Build Queue** - Total Builds: 2")
 }
 
 func TestStartBuild(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
-	// Install it first
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
+	var post *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(created *model.Post) *model.Post {
+		post = created
+		post.Id = model.NewId()
+		return post
+	}, nil)
 
-	response := plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild"))
+	plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild --branch=feature/x -p env.TARGET=production"))
 
-	assert.Contains(response.Text, "TEAMCITY BUILD STARTED")
+	// The build is posted on behalf of the user so that the post can follow the build
+	assert.Contains(post.Message, "TEAMCITY BUILD STARTED")
+	assert.Equal(&queueBuildOptions{Branch: "feature/x", Parameters: map[string]string{"env.TARGET": "production"}}, teamCity.queued[4])
 
-	// fmt.Print(response.Text)
+	plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild --agent=agent-2"))
+	assert.Equal(int64(2), teamCity.queued[5].AgentID)
 }
 
 // Since this takes the longest move it to thend
 func TestCancelBuild(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
 
-	// Start a build
-	client := teamcity.New("http://127.0.0.1:8111/", "eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl")
+	// The running build of the fake server
+	var buildID int64 = 3
 
-	var emptyMap = make(map[string]string)
+	buildNotes := fmt.Sprintf("Cancelling test build #%d", buildID)
 
-	build, err := client.QueueBuild("MattermostTeamcityPlugin_TestBuild", "", emptyMap)
-	// Wait for build to actually start or the cancel won't have any effect
-	time.Sleep(10 * time.Second)
-
-	if err != nil {
-		t.Errorf(fmt.Sprintf("Error creating test build: %s", err.Error()))
-	}
-
-	buildNotes := fmt.Sprintf("Cancelling test build #%d", build.ID)
-
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
-	
-	response := plugin.executeCommandHooks(generateArgs(fmt.Sprintf("build cancel %d \"%s\"", build.ID, buildNotes)))
+	response := plugin.executeCommandHooks(generateArgs(fmt.Sprintf("build cancel %d \"%s\"", buildID, buildNotes)))
 
 	assert.Contains(response.Text, "TEAMCITY BUILD CANCELLED")
+	assert.Contains(response.Text, "**Canceled**")
+	assert.Equal(buildNotes, teamCity.cancelled[buildID])
 }
 
 func TestNoCancelBuildComments(t *testing.T) {
 	assert := assert.New(t)
-	plugin := Plugin{}
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: model.NewId()}, nil)
 
-	// Start a build
-	client := teamcity.New("http://127.0.0.1:8111/", "eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl")
-
-	var emptyMap = make(map[string]string)
+	// Cancel a queued build
+	plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild"))
+	assert.Equal([]int64{4}, teamCity.queue)
 
-	build, err := client.QueueBuild("MattermostTeamcityPlugin_TestBuild", "", emptyMap)
-	// Wait for build to actually start or the cancel won't have any effect
-	time.Sleep(10 * time.Second)
+	response := plugin.executeCommandHooks(generateArgs("build cancel 4"))
 
-	if err != nil {
-		t.Errorf(fmt.Sprintf("Error creating test build: %s", err.Error()))
-	}
+	assert.Contains(response.Text, "TEAMCITY BUILD CANCELLED")
+	assert.Equal("", teamCity.cancelled[4])
+	assert.Empty(teamCity.queue)
+}
 
-	plugin.executeCommandHooks(generateArgs("install http://127.0.0.1:8111/ eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"))
-	
-	response := plugin.executeCommandHooks(generateArgs(fmt.Sprintf("build cancel %d", build.ID)))
+func TestFmtDuration(t *testing.T) {
+	assert := assert.New(t)
 
-	assert.Contains(response.Text, "TEAMCITY BUILD CANCELLED")
-}
\ No newline at end of file
+	assert.Equal("42s", fmtDuration(42*time.Second))
+	assert.Equal("5m 3s", fmtDuration(5*time.Minute+3*time.Second))
+	assert.Equal("1h 0m 12s", fmtDuration(time.Hour+12*time.Second+400*time.Millisecond))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pollerJobName = "poller"
+	pollStateKey  = "poll_"
+
+	// Number of builds fetched per project or build configuration on every poll
+	pollBuildCount = 100
+	// pollSeenCount is the number of builds remembered per state and build configuration. It
+	// is larger than the polled window, so builds still in the window are never reported twice.
+	pollSeenCount = 2 * pollBuildCount
+)
+
+// pollState is what the poller remembers about a build configuration between polls: the
+// builds already reported as queued, started and finished, newest last. Builds start and
+// finish out of order when several agents run them, so each build is remembered rather than
+// the highest build ID.
+type pollState struct {
+	Queued   []int64
+	Started  []int64
+	Finished []int64
+}
+
+// empty returns true before the first poll of a build configuration, and for the state stored
+// by earlier versions of the plugin
+func (s *pollState) empty() bool {
+	return len(s.Queued) == 0 && len(s.Started) == 0 && len(s.Finished) == 0
+}
+
+// seenBuild returns true if a build is in a list of reported builds
+func seenBuild(ids []int64, buildID int64) bool {
+	for _, id := range ids {
+		if id == buildID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addSeenBuild adds a build to a list of reported builds, keeping the newest pollSeenCount
+func addSeenBuild(ids []int64, buildID int64) []int64 {
+	ids = append(ids, buildID)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > pollSeenCount {
+		ids = ids[len(ids)-pollSeenCount:]
+	}
+
+	return ids
+}
+
+// startPoller starts the background job that queries TeamCity for builds and emits the same
+// build events a webhook would, for TeamCity servers that cannot reach Mattermost. It checks
+// the configuration before every poll, so polling can be enabled and disabled at any time.
+func (p *Plugin) startPoller() {
+	p.polledTargets = map[string]bool{}
+
+	p.startJob(pollerJobName, func() time.Duration {
+		return p.getConfiguration().GetPollingInterval()
+	}, func() error {
+		if !p.getConfiguration().EnablePolling {
+			return nil
+		}
+
+		return p.poll()
+	})
+}
+
+// pollTargets returns the project and build configuration IDs to poll on a server: the
+// configured scope, or everything the channels are subscribed to
+func (p *Plugin) pollTargets(server *teamCityServer) (map[string]string, error) {
+	targets := map[string]string{}
+
+	if scope := p.getConfiguration().GetPollingScope(server.Name); len(scope) > 0 {
+		for _, id := range scope {
+			sub, err := p.resolveSubscriptionTarget(server, id)
+			if err != nil {
+				return nil, err
+			}
+
+			if sub == nil {
+				p.API.LogWarn("Polling scope contains an unknown project or build configuration", "server", server.Name, "id", id)
+				continue
+			}
+
+			targets[sub.TargetID] = sub.TargetType
+		}
+
+		return targets, nil
+	}
+
+	subs, err := p.getSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs.Subscriptions {
+		if sub.ServerName() == server.Name {
+			targets[sub.TargetID] = sub.TargetType
+		}
+	}
+
+	return targets, nil
+}
+
+// poll polls every installed server
+func (p *Plugin) poll() error {
+	for _, server := range p.getConfiguration().GetServers() {
+		if !server.Installed() {
+			continue
+		}
+
+		if err := p.pollServer(server); err != nil {
+			p.API.LogWarn("Could not poll TeamCity server", "server", server.Name, "error", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// pollServer fetches the build queue and the latest builds of every polled target of a server
+// and emits events for the builds that were queued, started or finished since the previous
+// poll
+func (p *Plugin) pollServer(server *teamCityServer) error {
+	targets, err := p.pollTargets(server)
+	if err != nil {
+		return err
+	}
+
+	client := p.systemClient(server)
+
+	if p.polledTargets == nil {
+		p.polledTargets = map[string]bool{}
+	}
+
+	// A build configuration may be polled through several projects, only handle it once. The
+	// builds of a build configuration never polled before are only remembered if all its
+	// targets are polled for the first time since activation: its builds are not new, the
+	// poller just did not look at them yet. Build configurations showing up later in a polled
+	// project are new, and so are their builds.
+	byBuildType := map[string]map[int64]*tcBuild{}
+	seedOnly := map[string]bool{}
+	add := func(builds []*tcBuild, firstPoll bool) {
+		for _, build := range builds {
+			if byBuildType[build.BuildTypeID] == nil {
+				byBuildType[build.BuildTypeID] = map[int64]*tcBuild{}
+				seedOnly[build.BuildTypeID] = true
+			}
+			byBuildType[build.BuildTypeID][build.ID] = build
+			seedOnly[build.BuildTypeID] = seedOnly[build.BuildTypeID] && firstPoll
+		}
+	}
+
+	for id, targetType := range targets {
+		dimension := "affectedProject"
+		if targetType == subscriptionTargetBuildType {
+			dimension = "buildType"
+		}
+
+		// The queue is fetched first, so builds that started in between are seen running
+		queue, err := client.GetBuildQueue(fmt.Sprintf("%s:(id:%s)", dimension, id))
+		if err != nil {
+			p.API.LogWarn("Could not poll the build queue", "server", server.Name, "target_id", id, "error", err.Error())
+			continue
+		}
+
+		locator := fmt.Sprintf("%s:(id:%s),defaultFilter:false,running:any,canceled:any,count:%d", dimension, id, pollBuildCount)
+
+		builds, err := client.GetBuilds(locator)
+		if err != nil {
+			p.API.LogWarn("Could not poll builds", "server", server.Name, "target_id", id, "error", err.Error())
+			continue
+		}
+
+		polled := server.Name + ":" + targetKey(id)
+		firstPoll := !p.polledTargets[polled]
+		p.polledTargets[polled] = true
+
+		add(queue, firstPoll)
+		add(builds, firstPoll)
+	}
+
+	for buildTypeID, builds := range byBuildType {
+		if err := p.pollBuildType(server.Name, buildTypeID, builds, seedOnly[buildTypeID]); err != nil {
+			p.API.LogWarn("Could not process polled builds", "server", server.Name, "build_type_id", buildTypeID, "error", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// pollBuildType emits the events of the polled builds of a build configuration that were not
+// reported yet. If seed is true and the build configuration was never polled, its builds are
+// only remembered.
+func (p *Plugin) pollBuildType(server, buildTypeID string, builds map[int64]*tcBuild, seed bool) error {
+	key := kvServerKey(pollStateKey, server, buildTypeID)
+
+	raw, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return errors.Wrap(appErr, "could not load poll state")
+	}
+
+	sorted := make([]*tcBuild, 0, len(builds))
+	for _, build := range builds {
+		sorted = append(sorted, build)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	state := &pollState{}
+	if raw != nil {
+		if err := json.Unmarshal(raw, state); err != nil {
+			return errors.Wrap(err, "could not decode poll state")
+		}
+	}
+
+	// The first poll only remembers the existing builds
+	firstPoll := seed && state.empty()
+
+	for _, build := range sorted {
+		var kind string
+
+		switch build.State {
+		case "queued":
+			if !seenBuild(state.Queued, build.ID) {
+				state.Queued = addSeenBuild(state.Queued, build.ID)
+				kind = eventQueued
+			}
+
+		case "running":
+			if !seenBuild(state.Started, build.ID) {
+				state.Started = addSeenBuild(state.Started, build.ID)
+				kind = eventStarted
+			}
+
+		case "finished":
+			if !seenBuild(state.Finished, build.ID) {
+				state.Finished = addSeenBuild(state.Finished, build.ID)
+				kind = finishedEventKind(build.Status)
+			}
+		}
+
+		if kind != "" && !firstPoll {
+			p.emitPolledBuild(server, build, kind)
+		}
+	}
+
+	newRaw, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "could not encode poll state")
+	}
+
+	if appErr := p.API.KVSet(key, newRaw); appErr != nil {
+		return errors.Wrap(appErr, "could not save poll state")
+	}
+
+	return nil
+}
+
+func (p *Plugin) emitPolledBuild(server string, build *tcBuild, kind string) {
+	event := eventFromBuild(build)
+	event.Server = server
+	event.Kind = kind
+
+	if err := p.dispatchBuildEvent(event); err != nil {
+		p.API.LogError("Could not dispatch TeamCity build event",
+			"build_id", event.BuildID,
+			"error", err.Error(),
+		)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestPoller(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team"}, nil)
+
+	var events []string
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		fallback := post.Attachments()[0].Fallback
+		events = append(events, strings.TrimPrefix(fallback, "TeamCity: Mattermost TeamCity Plugin / Test Build "))
+		return post
+	}, nil)
+
+	assert.Nil(plugin.addSubscription(&subscription{
+		ChannelID:  "channel",
+		Server:     defaultServerName,
+		TargetID:   "MattermostTeamcityPlugin",
+		TargetType: subscriptionTargetProject,
+		Filter:     subscriptionFilter{Events: []string{eventQueued, eventStarted, eventSucceeded, eventFailed, eventCancelled}},
+	}))
+
+	poll := func() []string {
+		events = nil
+		assert.Nil(plugin.poll())
+		return events
+	}
+
+	assert.Empty(poll(), "the first poll only remembers the existing builds")
+
+	first := teamCity.addBuild("running", "SUCCESS", "Running")
+	second := teamCity.addBuild("running", "SUCCESS", "Running")
+	queued := teamCity.addBuild("queued", "", "")
+	teamCity.queue = append(teamCity.queue, queued.ID)
+
+	assert.Equal([]string{"#4 - Build started", "#5 - Build started", "#6 - Build queued"}, poll())
+
+	// The second build finishes before the first one, and the queued build starts
+	second.State, second.Status, second.StatusText = "finished", "FAILURE", "Tests failed: 1"
+	teamCity.queue = nil
+	queued.State, queued.Status = "running", "SUCCESS"
+
+	assert.Equal([]string{"#5 - Build failed", "#6 - Build started"}, poll())
+
+	// Builds that started before the last reported one still finish
+	first.State, first.StatusText = "finished", "Tests passed: 12"
+	teamCity.builds[3].State, teamCity.builds[3].Status, teamCity.builds[3].StatusText = "finished", "FAILURE", "Tests failed: 2"
+
+	assert.Equal([]string{"#3 - Build failed", "#4 - Build fixed"}, poll())
+
+	assert.Empty(poll(), "builds are reported once")
+
+	// Build configurations added to a polled project are new, and so are their builds
+	addBuildType := func(id, name string) *tcBuild {
+		buildType := &tcBuildType{ID: id, Name: name, ProjectID: "MattermostTeamcityPlugin", ProjectName: "Mattermost TeamCity Plugin"}
+		teamCity.buildTypes = append(teamCity.buildTypes, buildType)
+
+		build := teamCity.addBuild("finished", "FAILURE", "Tests failed: 1")
+		build.BuildTypeID, build.BuildType = buildType.ID, *buildType
+		return build
+	}
+
+	addBuildType("MattermostTeamcityPlugin_Lint", "Lint")
+	assert.Equal([]string{"TeamCity: Mattermost TeamCity Plugin / Lint #7 - Build broken"}, poll(), "the first build of a configuration has no previous build")
+
+	// After activation, only build configurations never polled are seeded silently
+	plugin.polledTargets = nil
+	addBuildType("MattermostTeamcityPlugin_Docs", "Docs")
+	teamCity.addBuild("finished", "SUCCESS", "Tests passed: 12")
+
+	assert.Equal([]string{"#9 - Build succeeded"}, poll())
+}
+
+func TestAddSeenBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	var ids []int64
+	for id := int64(pollSeenCount + 10); id > 0; id-- {
+		ids = addSeenBuild(ids, id)
+	}
+
+	assert.Len(ids, pollSeenCount)
+	assert.Equal(int64(11), ids[0], "the oldest builds are forgotten")
+	assert.True(seenBuild(ids, pollSeenCount+10))
+	assert.False(seenBuild(ids, 10))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// projectLinkChannelKey and projectLinkTeamKey store the project a channel or a team is
+	// linked to
+	projectLinkChannelKey = "project_channel_"
+	projectLinkTeamKey    = "project_team_"
+
+	commandTriggerChannel       = "channel"
+	commandTriggerChannelLink   = "link"
+	commandTriggerChannelUnlink = "unlink"
+	commandTriggerChannelInfo   = "info"
+)
+
+// projectLink is the TeamCity project a channel or a team works on. Commands run there list,
+// start and show the builds of its subtree unless they are given `--all`.
+type projectLink struct {
+	Server      string
+	ProjectID   string
+	ProjectName string
+	WebURL      string
+	LinkedBy    string
+}
+
+// ServerName returns the name of the TeamCity server of the project
+func (l *projectLink) ServerName() string {
+	return serverNameOrDefault(l.Server)
+}
+
+func projectLinkKey(scope, teamID, channelID string) string {
+	if scope == scopeTeam {
+		return kvKey(projectLinkTeamKey, teamID)
+	}
+
+	return kvKey(projectLinkChannelKey, channelID)
+}
+
+// projectLocator returns the TeamCity locator dimension matching the subtree of a project, or
+// "" for all projects
+func projectLocator(projectID string) string {
+	if projectID == "" {
+		return ""
+	}
+
+	return "affectedProject:(id:" + projectID + ")"
+}
+
+func (p *Plugin) getProjectLink(scope, teamID, channelID string) (*projectLink, error) {
+	raw, appErr := p.API.KVGet(projectLinkKey(scope, teamID, channelID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not load the linked project")
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	var link projectLink
+	if err := json.Unmarshal(raw, &link); err != nil {
+		return nil, errors.Wrap(err, "could not decode the linked project")
+	}
+
+	return &link, nil
+}
+
+func (p *Plugin) setProjectLink(scope, teamID, channelID string, link *projectLink) error {
+	key := projectLinkKey(scope, teamID, channelID)
+
+	if link == nil {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "could not unlink the project")
+		}
+		return nil
+	}
+
+	raw, err := json.Marshal(link)
+	if err != nil {
+		return errors.Wrap(err, "could not encode the linked project")
+	}
+
+	if appErr := p.API.KVSet(key, raw); appErr != nil {
+		return errors.Wrap(appErr, "could not link the project")
+	}
+
+	return nil
+}
+
+// linkedProject returns the project of a channel, else the project of its team, with the scope
+// it is linked in. It returns nil if neither is linked.
+func (p *Plugin) linkedProject(teamID, channelID string) (*projectLink, string, error) {
+	for _, scope := range []string{scopeChannel, scopeTeam} {
+		if scope == scopeTeam && teamID == "" || scope == scopeChannel && channelID == "" {
+			continue
+		}
+
+		link, err := p.getProjectLink(scope, teamID, channelID)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if link != nil {
+			return link, scope, nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+// commandProject returns the project a slash command defaults to on a server, or nil if there
+// is none or the command was given `--all`
+func (p *Plugin) commandProject(args *model.CommandArgs, server *teamCityServer, flags commandFlags) *projectLink {
+	if flags.Bool("all") {
+		return nil
+	}
+
+	link, _, err := p.linkedProject(args.TeamId, args.ChannelId)
+	if err != nil {
+		p.API.LogWarn("Could not get the linked project", "channel_id", args.ChannelId, "error", err.Error())
+		return nil
+	}
+
+	if link == nil || link.ServerName() != server.Name {
+		return nil
+	}
+
+	return link
+}
+
+// projectBuildTypeID returns the ID of a build configuration given without the ID of the
+// project as prefix, e.g. "Deploy" for "Backend_Deploy". TeamCity derives build configuration IDs
+// from the project ID, so typing the prefix in a linked channel is redundant. IDs of existing
+// build configurations are returned as is.
+func (p *Plugin) projectBuildTypeID(client TeamCityClient, projectID, buildTypeID string) string {
+	if strings.HasPrefix(strings.ToLower(buildTypeID), strings.ToLower(projectID)+"_") {
+		return buildTypeID
+	}
+
+	if _, err := client.GetBuildType(buildTypeID); errors.Cause(err) != errNotFound {
+		return buildTypeID
+	}
+
+	if buildType, err := client.GetBuildType(projectID + "_" + buildTypeID); err == nil {
+		return buildType.ID
+	}
+
+	return buildTypeID
+}
+
+// linkScope returns the scope a link or unlink command applies to, or the response to send if
+// the user may not change it. Linking a channel requires a channel administrator and linking a
+// team a team administrator.
+func (p *Plugin) linkScope(args *model.CommandArgs, flags commandFlags, command string) (string, *model.CommandResponse) {
+	if flags.Bool(scopeTeam) {
+		if !p.API.HasPermissionToTeam(args.UserId, args.TeamId, model.PERMISSION_MANAGE_TEAM) {
+			p.auditDenied(&permissionContext{UserID: args.UserId, ChannelID: args.ChannelId, TeamID: args.TeamId}, commandTriggerChannel, command+" "+scopeTeam)
+			return "", p.postEphemeral("Only team administrators can " + command + " a project for this team")
+		}
+		return scopeTeam, nil
+	}
+
+	if !p.API.HasPermissionToChannel(args.UserId, args.ChannelId, model.PERMISSION_MANAGE_CHANNEL_ROLES) {
+		p.auditDenied(&permissionContext{UserID: args.UserId, ChannelID: args.ChannelId, TeamID: args.TeamId}, commandTriggerChannel, command+" "+scopeChannel)
+		return "", p.postEphemeral("Only channel administrators can " + command + " a project for this channel")
+	}
+
+	return scopeChannel, nil
+}
+
+func (p *Plugin) executeCommandTriggerChannelLink(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	projectID := input.Arg("project_id")
+
+	scope, errResponse := p.linkScope(args, input.Flags, commandTriggerChannelLink)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	client, server, errResponse := p.commandClient(args, input.Flags, false)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	project, err := client.GetProject(projectID)
+	if errors.Cause(err) == errNotFound {
+		return p.postEphemeral("Unknown project `" + projectID + "`, see `/teamcity list projects`")
+	} else if err != nil {
+		return p.postEphemeral("Could not get the project: `" + err.Error() + "`")
+	}
+
+	link := &projectLink{
+		Server:      server.Name,
+		ProjectID:   project.ID,
+		ProjectName: project.Name,
+		WebURL:      project.WebURL,
+		LinkedBy:    args.UserId,
+	}
+
+	if err := p.setProjectLink(scope, args.TeamId, args.ChannelId, link); err != nil {
+		return p.postEphemeral("Could not link the project: `" + err.Error() + "`")
+	}
+
+	return p.postEphemeral(fmt.Sprintf("This %s is now linked to the TeamCity project [%s](%s)%s. "+
+		"`/teamcity list builds`, `/teamcity build start` and `/teamcity stats` show its builds unless they are given `--all`",
+		scope, project.Name, project.WebURL, p.serverNote(server.Name)))
+}
+
+func (p *Plugin) executeCommandTriggerChannelUnlink(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	scope, errResponse := p.linkScope(args, input.Flags, commandTriggerChannelUnlink)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	if err := p.setProjectLink(scope, args.TeamId, args.ChannelId, nil); err != nil {
+		return p.postEphemeral("Could not unlink the project: `" + err.Error() + "`")
+	}
+
+	return p.postEphemeral("This " + scope + " is no longer linked to a TeamCity project")
+}
+
+func (p *Plugin) executeCommandTriggerChannelInfo(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	link, scope, err := p.linkedProject(args.TeamId, args.ChannelId)
+	if err != nil {
+		return p.postEphemeral("Could not get the linked project: `" + err.Error() + "`")
+	}
+
+	message := "**TeamCity in this channel:**\n\n"
+
+	if link == nil {
+		message += " - Project: none, link one with `/teamcity channel link <project_id>`\n"
+	} else {
+		message += fmt.Sprintf(" - Project: [%s (ID: %s)](%s)%s", link.ProjectName, link.ProjectID, link.WebURL, p.serverNote(link.ServerName()))
+		if scope == scopeTeam {
+			message += ", linked for the whole team"
+		}
+		message += "\n"
+	}
+
+	message += " - Server: `" + p.commandServerName(args, input.Flags) + "`\n"
+
+	subscriptions, err := p.channelSubscriptions(args.ChannelId)
+	if err != nil {
+		return p.postEphemeral("Could not get the subscriptions: `" + err.Error() + "`")
+	}
+
+	message += fmt.Sprintf(" - Subscriptions: %d, see `/teamcity subscriptions list`\n", len(subscriptions))
+
+	return p.postEphemeral(message)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestChannelLink(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+	api.On("HasPermissionToChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_CHANNEL_ROLES).Return(true)
+	api.On("HasPermissionToTeam", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_TEAM).Return(true)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: model.NewId()}, nil)
+
+	response := plugin.executeCommandHooks(generateArgs("channel link Unknown"))
+	assert.Contains(response.Text, "Unknown project `Unknown`")
+
+	response = plugin.executeCommandHooks(generateArgs("channel link Website"))
+	assert.Contains(response.Text, "This channel is now linked to the TeamCity project [Website]")
+
+	response = plugin.executeCommandHooks(generateArgs("channel info"))
+	assert.Contains(response.Text, "Project: [Website (ID: Website)]")
+	assert.Contains(response.Text, "Subscriptions: 0")
+
+	// Build configurations of the project can be given without the project prefix
+	plugin.executeCommandHooks(generateArgs("build start Deploy"))
+	assert.Equal([]int64{4}, teamCity.queue)
+	assert.Equal("Website_Deploy", teamCity.builds[4].BuildTypeID)
+
+	plugin.executeCommandHooks(generateArgs("build start MattermostTeamcityPlugin_TestBuild"))
+	assert.Equal([]int64{4, 5}, teamCity.queue)
+
+	response = plugin.executeCommandHooks(generateArgs("stats"))
+	assert.Contains(response.Text, "Build Queue of Website** - Total Builds: 1")
+
+	response = plugin.executeCommandHooks(generateArgs("stats --all"))
+	assert.Contains(response.Text, "Build Queue** - Total Builds: 2")
+
+	response = plugin.executeCommandHooks(generateArgs("list builds"))
+	assert.Equal("No builds found", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("list builds --all"))
+	assert.Contains(response.Text, "[MattermostTeamcityPlugin_TestBuild #2]")
+
+	// The project of the channel takes precedence over the project of the team
+	response = plugin.executeCommandHooks(generateArgs("channel link MattermostTeamcityPlugin --team"))
+	assert.Contains(response.Text, "This team is now linked")
+
+	response = plugin.executeCommandHooks(generateArgs("list builds"))
+	assert.Equal("No builds found", response.Text)
+
+	response = plugin.executeCommandHooks(generateArgs("channel unlink"))
+	assert.Contains(response.Text, "This channel is no longer linked")
+
+	response = plugin.executeCommandHooks(generateArgs("list builds"))
+	assert.Contains(response.Text, "TeamCity Builds of Mattermost TeamCity Plugin")
+
+	response = plugin.executeCommandHooks(generateArgs("channel info"))
+	assert.Contains(response.Text, "linked for the whole team")
+
+	plugin.executeCommandHooks(generateArgs("channel unlink --team"))
+
+	response = plugin.executeCommandHooks(generateArgs("channel info"))
+	assert.Contains(response.Text, "Project: none")
+}
+
+func TestChannelLinkPermission(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+	api.On("HasPermissionToChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_CHANNEL_ROLES).Return(false)
+	api.On("HasPermissionToTeam", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_TEAM).Return(false)
+
+	response := plugin.executeCommandHooks(generateArgs("channel link Website"))
+	assert.Contains(response.Text, "Only channel administrators")
+
+	response = plugin.executeCommandHooks(generateArgs("channel link Website --team"))
+	assert.Contains(response.Text, "Only team administrators")
+
+	args := generateArgs("")
+	link, _, err := plugin.linkedProject(args.TeamId, args.ChannelId)
+	assert.Nil(err)
+	assert.Nil(link)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// defaultServerName is the name of the server configured with the TeamCity URL and TeamCity
+	// Access Token settings
+	defaultServerName = "default"
+
+	// channelServerKey stores the server a channel uses when commands do not name one
+	channelServerKey = "channel_server_"
+
+	commandTriggerServers      = "servers"
+	commandTriggerServersUse   = "use"
+	commandTriggerServersReset = "reset"
+	commandTriggerServersRm    = "remove"
+)
+
+var serverNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// teamCityServer is a TeamCity server the plugin talks to. Besides the server of the plugin
+// settings, administrators add named servers with `/teamcity install --server=<name>`.
+type teamCityServer struct {
+	Name string
+	URL  string
+	// Token is the encrypted system access token
+	Token   string
+	Default bool
+
+	// token is Token decrypted, and tokenError explains why it could not be decrypted or saved
+	token      string
+	tokenError string
+}
+
+// GetToken returns the decrypted system access token
+func (s *teamCityServer) GetToken() string {
+	if s.token != "" || strings.HasPrefix(s.Token, encryptedPrefix) {
+		return s.token
+	}
+
+	return s.Token
+}
+
+// Installed returns true if the server has a valid URL and a token
+func (s *teamCityServer) Installed() bool {
+	if s.GetToken() == "" || s.URL == "" {
+		return false
+	}
+
+	_, err := url.ParseRequestURI(s.URL)
+
+	return err == nil
+}
+
+// serverNameOrDefault returns name, or the name of the server of the plugin settings if it is
+// empty. Subscriptions, tracked builds and buttons created before servers were named have no
+// server name and belong to that server.
+func serverNameOrDefault(name string) string {
+	if name == "" {
+		return defaultServerName
+	}
+
+	return name
+}
+
+// validateServerName checks that a server name can be used in slash commands and URLs
+func validateServerName(name string) error {
+	if !serverNamePattern.MatchString(name) {
+		return errors.Errorf("invalid server name `%s`, use lower case letters, digits, `-` and `_`", name)
+	}
+
+	return nil
+}
+
+// GetServers returns the configured servers, starting with the server of the plugin settings
+func (c *configuration) GetServers() []*teamCityServer {
+	var servers []*teamCityServer
+
+	if c.TeamCityURL != "" {
+		servers = append(servers, &teamCityServer{
+			Name:       defaultServerName,
+			URL:        c.TeamCityURL,
+			Token:      c.TeamCityToken,
+			token:      c.teamCityToken,
+			tokenError: c.teamCityTokenError,
+		})
+	}
+
+	return append(servers, c.TeamCityServers...)
+}
+
+// GetServer returns the server with the given name, or nil if there is none
+func (c *configuration) GetServer(name string) *teamCityServer {
+	name = serverNameOrDefault(name)
+
+	for _, server := range c.GetServers() {
+		if strings.EqualFold(server.Name, name) {
+			return server
+		}
+	}
+
+	return nil
+}
+
+// GetDefaultServer returns the server flagged as default, else the server of the plugin
+// settings, else the first named server
+func (c *configuration) GetDefaultServer() *teamCityServer {
+	servers := c.GetServers()
+	if len(servers) == 0 {
+		return nil
+	}
+
+	for _, server := range servers {
+		if server.Default {
+			return server
+		}
+	}
+
+	return servers[0]
+}
+
+// serverConfigValue converts named servers to the plugin configuration value storing them.
+// Plugin settings are sent to the server as generic JSON values.
+func serverConfigValue(servers []*teamCityServer) (interface{}, error) {
+	raw, err := json.Marshal(servers)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode servers")
+	}
+
+	var value []interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, errors.Wrap(err, "could not encode servers")
+	}
+
+	return value, nil
+}
+
+// systemClient returns a client for a server using its system access token
+func (p *Plugin) systemClient(server *teamCityServer) TeamCityClient {
+	return p.teamCityClient(server.URL, server.GetToken())
+}
+
+// serverClient returns a client for the named server using its system access token
+func (p *Plugin) serverClient(name string) (TeamCityClient, error) {
+	server := p.getConfiguration().GetServer(name)
+	if server == nil {
+		return nil, errors.Errorf("TeamCity server %s is not configured", serverNameOrDefault(name))
+	}
+
+	return p.systemClient(server), nil
+}
+
+// channelServer returns the name of the server a channel uses by default, or "" if it uses the
+// default server
+func (p *Plugin) channelServer(channelID string) (string, error) {
+	raw, appErr := p.API.KVGet(kvKey(channelServerKey, channelID))
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "could not load the server of the channel")
+	}
+
+	return string(raw), nil
+}
+
+func (p *Plugin) setChannelServer(channelID, name string) error {
+	key := kvKey(channelServerKey, channelID)
+
+	if name == "" {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return errors.Wrap(appErr, "could not reset the server of the channel")
+		}
+		return nil
+	}
+
+	if appErr := p.API.KVSet(key, []byte(name)); appErr != nil {
+		return errors.Wrap(appErr, "could not save the server of the channel")
+	}
+
+	return nil
+}
+
+// commandServerName returns the name of the server a slash command applies to: the server
+// given with --server in the flags of the command, else the server of the channel, else the
+// server of the project linked to the channel, else the default server. The server may not
+// exist.
+func (p *Plugin) commandServerName(args *model.CommandArgs, flags commandFlags) string {
+	if name := flags.String(serverFlag.Name); name != "" {
+		return strings.ToLower(name)
+	}
+
+	name, err := p.channelServer(args.ChannelId)
+	if err != nil {
+		p.API.LogWarn("Could not get the server of the channel", "channel_id", args.ChannelId, "error", err.Error())
+	}
+
+	// Channels keep using the default server if their server was removed
+	if name != "" && p.getConfiguration().GetServer(name) != nil {
+		return name
+	}
+
+	link, _, err := p.linkedProject(args.TeamId, args.ChannelId)
+	if err != nil {
+		p.API.LogWarn("Could not get the linked project", "channel_id", args.ChannelId, "error", err.Error())
+	}
+
+	if link != nil && p.getConfiguration().GetServer(link.ServerName()) != nil {
+		return link.ServerName()
+	}
+
+	if server := p.getConfiguration().GetDefaultServer(); server != nil {
+		return server.Name
+	}
+
+	return defaultServerName
+}
+
+// commandServer returns the server a slash command applies to, see commandServerName, or the
+// response to send if it is not installed
+func (p *Plugin) commandServer(args *model.CommandArgs, flags commandFlags) (*teamCityServer, *model.CommandResponse) {
+	name := p.commandServerName(args, flags)
+
+	server := p.getConfiguration().GetServer(name)
+	if server == nil {
+		return nil, p.postEphemeral("Unknown TeamCity server `" + name + "`, see `/teamcity servers`")
+	}
+
+	if !server.Installed() {
+		return nil, p.postEphemeral(errorNotInstalled)
+	}
+
+	return server, nil
+}
+
+// serverNote returns " on <name>" for messages about servers, or "" when only the server of the
+// plugin settings is used
+func (p *Plugin) serverNote(name string) string {
+	if name == defaultServerName && len(p.getConfiguration().GetServers()) <= 1 {
+		return ""
+	}
+
+	return " on `" + name + "`"
+}
+
+// executeCommandTriggerUseServer changes the server of the channel, or resets it to the default
+// server without a name
+func (p *Plugin) executeCommandTriggerUseServer(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	action := commandTriggerServersReset
+	if input.Arg("name") != "" {
+		action = commandTriggerServersUse
+	}
+
+	if !p.API.HasPermissionToChannel(args.UserId, args.ChannelId, model.PERMISSION_MANAGE_CHANNEL_ROLES) {
+		p.auditDenied(&permissionContext{UserID: args.UserId, ChannelID: args.ChannelId, TeamID: args.TeamId}, commandTriggerServers, action)
+		return p.postEphemeral("Only channel administrators can change the TeamCity server of this channel")
+	}
+
+	name := ""
+	if action == commandTriggerServersUse {
+		server := p.getConfiguration().GetServer(strings.ToLower(input.Arg("name")))
+		if server == nil {
+			return p.postEphemeral("Unknown TeamCity server `" + input.Arg("name") + "`, see `/teamcity servers`")
+		}
+		name = server.Name
+	}
+
+	if err := p.setChannelServer(args.ChannelId, name); err != nil {
+		return p.postEphemeral("Could not change the server of this channel: `" + err.Error() + "`")
+	}
+
+	if name == "" {
+		return p.postEphemeral("This channel uses the default TeamCity server again")
+	}
+
+	return p.postEphemeral("Commands in this channel now use the TeamCity server `" + name + "` unless they name another one with `--server`")
+}
+
+func (p *Plugin) executeCommandTriggerListServers(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	configuration := p.getConfiguration()
+
+	servers := configuration.GetServers()
+	if len(servers) == 0 {
+		return p.postEphemeral(errorNotInstalled)
+	}
+
+	defaultServer := configuration.GetDefaultServer()
+	channelServer, err := p.channelServer(args.ChannelId)
+	if err != nil {
+		return p.postEphemeral("Could not get the server of this channel: `" + err.Error() + "`")
+	}
+
+	message := "**TeamCity Servers:**\n\n"
+
+	for _, server := range servers {
+		message += fmt.Sprintf(" - `%s` - %s", server.Name, server.URL)
+
+		if server.Name == defaultServer.Name {
+			message += " - default"
+		}
+		if server.Name == channelServer {
+			message += " - used in this channel"
+		}
+
+		message += "\n"
+	}
+
+	return p.postEphemeral(message)
+}
+
+// executeCommandTriggerRemoveServer forgets a server. The subscriptions to its builds stay, so
+// they work again if the server is installed again under the same name.
+func (p *Plugin) executeCommandTriggerRemoveServer(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	if errResponse := p.requireSystemAdmin(args, commandTriggerServers); errResponse != nil {
+		return errResponse
+	}
+
+	configuration := p.getConfiguration()
+	name := strings.ToLower(input.Arg("name"))
+
+	if configuration.GetServer(name) == nil {
+		return p.postEphemeral("Unknown TeamCity server `" + name + "`, see `/teamcity servers`")
+	}
+
+	values := map[string]interface{}{}
+	configuration = configuration.Clone()
+
+	if name == defaultServerName {
+		values["TeamCityURL"] = ""
+		values["TeamCityToken"] = ""
+		configuration.TeamCityURL = ""
+		configuration.TeamCityToken = ""
+		configuration.teamCityToken = ""
+	} else {
+		var kept []*teamCityServer
+		for _, server := range configuration.TeamCityServers {
+			if server.Name != name {
+				kept = append(kept, server)
+			}
+		}
+
+		value, err := serverConfigValue(kept)
+		if err != nil {
+			return p.postEphemeral("Could not remove the server: `" + err.Error() + "`")
+		}
+
+		values["TeamCityServers"] = value
+		configuration.TeamCityServers = kept
+	}
+
+	if err := p.savePluginConfigValues(values); err != nil {
+		return p.postEphemeral("Could not remove the server: `" + err.Error() + "`")
+	}
+
+	p.setConfiguration(configuration)
+
+	return p.postEphemeral("Removed the TeamCity server `" + name + "`")
+}
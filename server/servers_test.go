@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+func TestGetServers(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &configuration{}
+	assert.Empty(config.GetServers())
+	assert.Nil(config.GetDefaultServer())
+
+	config = &configuration{
+		TeamCityURL:   "http://teamcity",
+		TeamCityToken: "system",
+		TeamCityServers: []*teamCityServer{
+			{Name: "infra", URL: "http://infra", Token: "infra-system"},
+		},
+	}
+
+	servers := config.GetServers()
+	assert.Len(servers, 2)
+	assert.Equal(defaultServerName, servers[0].Name)
+	assert.Equal("system", servers[0].GetToken())
+
+	assert.Equal("http://teamcity", config.GetServer("").URL, "no name means the server of the settings")
+	assert.Equal("http://infra", config.GetServer("Infra").URL)
+	assert.Nil(config.GetServer("other"))
+	assert.Equal(defaultServerName, config.GetDefaultServer().Name)
+
+	config.TeamCityServers[0].Default = true
+	assert.Equal("infra", config.GetDefaultServer().Name)
+
+	assert.Nil(validateServerName("infra-eu_2"))
+	assert.NotNil(validateServerName("Infra"))
+	assert.NotNil(validateServerName("-infra"))
+	assert.NotNil(validateServerName("infra:eu"))
+}
+
+func TestNamedServers(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+	api.On("HasPermissionToChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_CHANNEL_ROLES).Return(true)
+
+	infra := newFakeTeamCity()
+	defer infra.Close()
+	infra.projects[1].Name = "Infrastructure"
+
+	response := plugin.executeCommandHooks(generateArgs("install --server=infra:eu " + infra.URL + " " + fakeTeamCityToken))
+	assert.Contains(response.Text, "invalid server name")
+
+	response = plugin.executeCommandHooks(generateArgs("install --server=infra " + infra.URL + " " + fakeTeamCityToken))
+	assert.Contains(response.Text, "TeamCity Installed!")
+
+	server := plugin.getConfiguration().GetServer("infra")
+	if assert.NotNil(server) {
+		assert.Equal(infra.URL, server.URL)
+		assert.Equal(fakeTeamCityToken, server.GetToken())
+		assert.False(server.Default)
+	}
+	assert.Equal(teamCity.URL, plugin.getConfiguration().TeamCityURL, "the server of the settings is kept")
+
+	response = plugin.executeCommandHooks(generateArgs("servers"))
+	assert.Contains(response.Text, "`default` - "+teamCity.URL+" - default")
+	assert.Contains(response.Text, "`infra` - "+infra.URL)
+
+	// User tokens are per server
+	response = plugin.executeCommandHooks(generateArgs("build cancel 3 --server=infra"))
+	assert.Contains(response.Text, "/teamcity connect <token> --server=infra")
+
+	response = plugin.executeCommandHooks(generateArgs("connect --server=infra " + fakeTeamCityToken))
+	assert.Contains(response.Text, "Connected to TeamCity on `infra`")
+
+	response = plugin.executeCommandHooks(generateArgs("list projects --server=infra"))
+	assert.Contains(response.Text, "Infrastructure")
+
+	response = plugin.executeCommandHooks(generateArgs("list projects"))
+	assert.Contains(response.Text, "Mattermost TeamCity Plugin")
+
+	response = plugin.executeCommandHooks(generateArgs("list projects --server=other"))
+	assert.Contains(response.Text, "Unknown TeamCity server `other`")
+
+	response = plugin.executeCommandHooks(generateArgs("build cancel 3 --server=infra"))
+	assert.Contains(response.Text, "TEAMCITY BUILD CANCELLED")
+	assert.Contains(infra.cancelled, int64(3))
+	assert.NotContains(teamCity.cancelled, int64(3))
+
+	// Words after -- are arguments, not the server
+	response = plugin.executeCommandHooks(generateArgs("build cancel 3 -- --server=infra"))
+	assert.Contains(response.Text, "TEAMCITY BUILD CANCELLED")
+	assert.Contains(teamCity.cancelled, int64(3))
+
+	// The channel uses another server
+	response = plugin.executeCommandHooks(generateArgs("servers use infra"))
+	assert.Contains(response.Text, "now use the TeamCity server `infra`")
+
+	response = plugin.executeCommandHooks(generateArgs("list projects"))
+	assert.Contains(response.Text, "Infrastructure")
+
+	response = plugin.executeCommandHooks(generateArgs("servers reset"))
+	assert.Contains(response.Text, "default TeamCity server again")
+
+	response = plugin.executeCommandHooks(generateArgs("list projects"))
+	assert.Contains(response.Text, "Mattermost TeamCity Plugin")
+
+	// The default server changes
+	response = plugin.executeCommandHooks(generateArgs("install --server=infra --default " + infra.URL + " " + fakeTeamCityToken))
+	assert.Contains(response.Text, "TeamCity Installed!")
+	assert.Equal("infra", plugin.getConfiguration().GetDefaultServer().Name)
+
+	response = plugin.executeCommandHooks(generateArgs("list projects"))
+	assert.Contains(response.Text, "Infrastructure")
+
+	response = plugin.executeCommandHooks(generateArgs("servers remove infra"))
+	assert.Contains(response.Text, "Removed the TeamCity server `infra`")
+	assert.Nil(plugin.getConfiguration().GetServer("infra"))
+
+	response = plugin.executeCommandHooks(generateArgs("list projects"))
+	assert.Contains(response.Text, "Mattermost TeamCity Plugin")
+}
+
+func TestServerChannelPermission(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+	api.On("HasPermissionToChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string"), model.PERMISSION_MANAGE_CHANNEL_ROLES).Return(false)
+
+	response := plugin.executeCommandHooks(generateArgs("servers use default"))
+	assert.Contains(response.Text, "Only channel administrators")
+
+	name, err := plugin.channelServer(generateArgs("").ChannelId)
+	assert.Nil(err)
+	assert.Empty(name)
+}
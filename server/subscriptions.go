@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	subscriptionsKey = "subscriptions"
+	buildResultKey   = "result_"
+	// dispatchedEventKey marks the build events already dispatched
+	dispatchedEventKey = "dispatched_"
+
+	// branchDefault in a branch filter matches builds of the default branch
+	branchDefault = "<default>"
+
+	subscriptionTargetProject   = "project"
+	subscriptionTargetBuildType = "buildType"
+
+	// Number of attempts to update the subscriptions when other nodes write them concurrently
+	maxKVUpdateAttempts = 5
+
+	projectCacheTTL = 10 * time.Minute
+
+	// dispatchedEventTTL is how long a dispatched build event is remembered to ignore the same
+	// event reported again
+	dispatchedEventTTL = 24 * time.Hour
+)
+
+// defaultSubscriptionEvents are the events a subscription reports when none are given
+var defaultSubscriptionEvents = []string{eventStarted, eventSucceeded, eventFailed, eventCancelled}
+
+// subscriptionEvents are the event names accepted by /teamcity subscribe
+var subscriptionEvents = []string{eventQueued, eventStarted, eventSucceeded, eventFailed, deltaFixed, deltaBroken, eventCancelled}
+
+// subscriptionFilter narrows down which build events of a subscription are posted
+type subscriptionFilter struct {
+	Events          []string
+	Branches        []string
+	ExcludePersonal bool
+}
+
+// subscription routes the build events of a project (and its subprojects) or a single build
+// configuration to a channel
+type subscription struct {
+	// Server is the name of the TeamCity server of the target, see ServerName
+	Server    string
+	ChannelID string
+	// TargetID is the ID of the project or build configuration as spelled by TeamCity. Compare
+	// it with HasTarget or targetKey.
+	TargetID   string
+	TargetType string
+	TargetName string
+	WebURL     string
+	Filter     subscriptionFilter
+	CreatorID  string
+}
+
+type subscriptions struct {
+	Subscriptions []*subscription
+}
+
+// ServerName returns the name of the TeamCity server of the subscription
+func (s *subscription) ServerName() string {
+	return serverNameOrDefault(s.Server)
+}
+
+// HasTarget returns true if the subscription is to the project or build configuration targetID
+// of a server
+func (s *subscription) HasTarget(server, targetID string) bool {
+	return s.ServerName() == server && targetKey(s.TargetID) == targetKey(targetID)
+}
+
+// targetKey normalizes the ID of a project or build configuration for comparisons. TeamCity IDs
+// are case-insensitive, and webhooks, polling and users do not always spell them alike.
+func targetKey(id string) string {
+	return strings.ToLower(id)
+}
+
+// Matches returns true if the subscription wants to be notified about the event. The caller
+// checks that the event belongs to the subscribed project or build configuration.
+func (s *subscription) Matches(event *buildEvent) bool {
+	return s.Filter.Matches(event)
+}
+
+// Matches returns true if the event passes the event, branch and personal build filters
+func (f *subscriptionFilter) Matches(event *buildEvent) bool {
+	if f.ExcludePersonal && event.Personal {
+		return false
+	}
+
+	return f.matchesEvent(event) && f.matchesBranch(event)
+}
+
+func (f *subscriptionFilter) matchesEvent(event *buildEvent) bool {
+	events := f.Events
+	if len(events) == 0 {
+		events = defaultSubscriptionEvents
+	}
+
+	for _, name := range events {
+		if name == event.Kind || (event.Delta != "" && name == event.Delta) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *subscriptionFilter) matchesBranch(event *buildEvent) bool {
+	if len(f.Branches) == 0 {
+		return true
+	}
+
+	// Builds of configurations without branches are considered default branch builds
+	isDefault := event.DefaultBranch || event.Branch == ""
+	branch := strings.TrimPrefix(event.Branch, "refs/heads/")
+
+	for _, pattern := range f.Branches {
+		if pattern == branchDefault {
+			if isDefault {
+				return true
+			}
+			continue
+		}
+
+		if event.Branch == "" {
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, event.Branch); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String describes the filter for humans
+func (f *subscriptionFilter) String() string {
+	events := f.Events
+	if len(events) == 0 {
+		events = defaultSubscriptionEvents
+	}
+
+	description := "events: " + strings.Join(events, ", ")
+
+	if len(f.Branches) > 0 {
+		description += "; branches: " + strings.Join(f.Branches, ", ")
+	}
+
+	if f.ExcludePersonal {
+		description += "; excluding personal builds"
+	}
+
+	return description
+}
+
+// validateBranchPatterns checks that every branch pattern is a valid glob
+func validateBranchPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == branchDefault {
+			continue
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid branch pattern `%s`", pattern)
+		}
+	}
+
+	return nil
+}
+
+// parseSubscriptionEvents parses a comma separated list of event names
+func parseSubscriptionEvents(raw string) ([]string, error) {
+	var events []string
+
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		valid := false
+		for _, known := range subscriptionEvents {
+			if name == known {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return nil, errors.Errorf("unknown event `%s`, use one of: %s", name, strings.Join(subscriptionEvents, ", "))
+		}
+
+		events = append(events, name)
+	}
+
+	return events, nil
+}
+
+func (p *Plugin) getSubscriptions() (*subscriptions, error) {
+	subs := &subscriptions{}
+
+	raw, appErr := p.API.KVGet(subscriptionsKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not load subscriptions")
+	}
+
+	if raw == nil {
+		return subs, nil
+	}
+
+	if err := json.Unmarshal(raw, subs); err != nil {
+		return nil, errors.Wrap(err, "could not decode subscriptions")
+	}
+
+	return subs, nil
+}
+
+// updateSubscriptions applies update to the stored subscriptions, retrying if another node
+// changed them in the meantime
+func (p *Plugin) updateSubscriptions(update func(subs *subscriptions) error) error {
+	for attempt := 0; attempt < maxKVUpdateAttempts; attempt++ {
+		oldRaw, appErr := p.API.KVGet(subscriptionsKey)
+		if appErr != nil {
+			return errors.Wrap(appErr, "could not load subscriptions")
+		}
+
+		subs := &subscriptions{}
+		if oldRaw != nil {
+			if err := json.Unmarshal(oldRaw, subs); err != nil {
+				return errors.Wrap(err, "could not decode subscriptions")
+			}
+		}
+
+		if err := update(subs); err != nil {
+			return err
+		}
+
+		newRaw, err := json.Marshal(subs)
+		if err != nil {
+			return errors.Wrap(err, "could not encode subscriptions")
+		}
+
+		saved, appErr := p.API.KVCompareAndSet(subscriptionsKey, oldRaw, newRaw)
+		if appErr != nil {
+			return errors.Wrap(appErr, "could not save subscriptions")
+		}
+
+		if saved {
+			return nil
+		}
+	}
+
+	return errors.New("could not save subscriptions, please try again")
+}
+
+// addSubscription stores sub, replacing the channel's existing subscription to the same target
+func (p *Plugin) addSubscription(sub *subscription) error {
+	return p.updateSubscriptions(func(subs *subscriptions) error {
+		for i, existing := range subs.Subscriptions {
+			if existing.ChannelID == sub.ChannelID && existing.HasTarget(sub.ServerName(), sub.TargetID) {
+				subs.Subscriptions[i] = sub
+				return nil
+			}
+		}
+
+		subs.Subscriptions = append(subs.Subscriptions, sub)
+		return nil
+	})
+}
+
+// removeSubscription deletes the channel's subscription to targetID on a server, returning
+// false if there was none
+func (p *Plugin) removeSubscription(channelID, server, targetID string) (bool, error) {
+	removed := false
+
+	err := p.updateSubscriptions(func(subs *subscriptions) error {
+		removed = false
+
+		var kept []*subscription
+		for _, existing := range subs.Subscriptions {
+			if existing.ChannelID == channelID && existing.HasTarget(server, targetID) {
+				removed = true
+				continue
+			}
+			kept = append(kept, existing)
+		}
+
+		subs.Subscriptions = kept
+		return nil
+	})
+
+	return removed, err
+}
+
+// channelSubscriptions returns the subscriptions of a single channel
+func (p *Plugin) channelSubscriptions(channelID string) ([]*subscription, error) {
+	subs, err := p.getSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*subscription
+	for _, sub := range subs.Subscriptions {
+		if sub.ChannelID == channelID {
+			found = append(found, sub)
+		}
+	}
+
+	return found, nil
+}
+
+// dispatchBuildEvent posts the event to every channel subscribed to its build configuration or
+// to one of the projects containing it on the server of the event
+func (p *Plugin) dispatchBuildEvent(event *buildEvent) error {
+	event.Server = serverNameOrDefault(event.Server)
+
+	if first, err := p.firstDispatch(event); err != nil || !first {
+		return err
+	}
+
+	if event.Kind != eventQueued {
+		p.refreshTrackedBuildByID(event.Server, event.BuildID)
+	}
+
+	subs, err := p.getSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	p.fillBuildDelta(event)
+
+	p.notifyCommitters(event)
+
+	if len(subs.Subscriptions) == 0 {
+		return nil
+	}
+
+	// Without the parent projects, the subscriptions to the build configuration and the
+	// projects found are still notified
+	ancestors, err := p.projectAncestors(event)
+	if err != nil {
+		p.API.LogWarn("Could not look up the projects of a build", "build_id", event.BuildID, "error", err.Error())
+	}
+
+	targets := map[string]bool{targetKey(event.BuildTypeID): true}
+	for _, projectID := range ancestors {
+		targets[targetKey(projectID)] = true
+	}
+
+	notified := map[string]bool{}
+	for _, sub := range subs.Subscriptions {
+		if notified[sub.ChannelID] || sub.ServerName() != event.Server || !targets[targetKey(sub.TargetID)] || !sub.Matches(event) {
+			continue
+		}
+
+		notified[sub.ChannelID] = true
+
+		if p.channelDisabled(sub.ChannelID) {
+			continue
+		}
+
+		// Only looked up once a channel is notified
+		p.fillFailureDetails(event)
+
+		if err := p.postBuildEvent(sub.ChannelID, event); err != nil {
+			p.API.LogError("Could not post TeamCity build event",
+				"build_id", event.BuildID,
+				"channel_id", sub.ChannelID,
+				"error", err.Error(),
+			)
+		}
+	}
+
+	return nil
+}
+
+// firstDispatch records that a build event is dispatched, returning false if it already was.
+// The same event may be reported several times: tcWebHooks sends both buildFailed and
+// buildBroken for a build breaking its configuration, and a webhook and the poller may both
+// report a build.
+func (p *Plugin) firstDispatch(event *buildEvent) (bool, error) {
+	if event.BuildID == 0 {
+		return true, nil
+	}
+
+	key := kvServerKey(dispatchedEventKey, event.Server, strconv.FormatInt(event.BuildID, 10), event.Kind)
+
+	first, appErr := p.API.KVSetWithOptions(key, []byte(event.Kind), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(dispatchedEventTTL / time.Second),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "could not record build event")
+	}
+
+	return first, nil
+}
+
+// fillBuildDelta determines whether a finished build fixed or broke its build configuration
+// when the event source did not say so, by remembering the last result of each configuration
+// and branch
+func (p *Plugin) fillBuildDelta(event *buildEvent) {
+	if event.Personal || (event.Kind != eventSucceeded && event.Kind != eventFailed) {
+		return
+	}
+
+	key := kvServerKey(buildResultKey, event.Server, event.BuildTypeID, event.BranchKey())
+
+	previous, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		p.API.LogWarn("Could not load previous build result", "build_type_id", event.BuildTypeID, "error", appErr.Error())
+		return
+	}
+
+	if appErr := p.API.KVSet(key, []byte(event.Kind)); appErr != nil {
+		p.API.LogWarn("Could not save build result", "build_type_id", event.BuildTypeID, "error", appErr.Error())
+	}
+
+	if event.Delta != "" {
+		return
+	}
+
+	// The first build seen of a configuration and branch, e.g. after installing the plugin,
+	// is compared with the build before it. A failing first build of a branch is the first
+	// failing build too.
+	if previous == nil {
+		kind, err := p.previousBuildResult(event)
+		if err != nil {
+			p.API.LogWarn("Could not look up the previous build", "build_id", event.BuildID, "error", err.Error())
+			return
+		}
+
+		previous = []byte(kind)
+		if kind == "" && event.Kind == eventFailed {
+			event.Delta = deltaBroken
+		}
+	}
+
+	switch {
+	case string(previous) == eventFailed && event.Kind == eventSucceeded:
+		event.Delta = deltaFixed
+	case string(previous) == eventSucceeded && event.Kind == eventFailed:
+		event.Delta = deltaBroken
+	}
+}
+
+// previousBuildResult returns the event kind of the finished build of the configuration and
+// branch of the event before its build, or "" if there is none
+func (p *Plugin) previousBuildResult(event *buildEvent) (string, error) {
+	if event.BuildID == 0 || !validTeamCityID(event.BuildTypeID) {
+		return "", errors.New("the event has no build")
+	}
+
+	client, err := p.serverClient(event.Server)
+	if err != nil {
+		return "", err
+	}
+
+	branch := branchLocator(&tcBuild{BranchName: event.Branch, DefaultBranch: event.DefaultBranch})
+	builds, err := client.GetBuilds(fmt.Sprintf("buildType:(id:%s),branch:%s,untilBuild:(id:%d),count:2", event.BuildTypeID, branch, event.BuildID))
+	if err != nil {
+		return "", err
+	}
+
+	for _, build := range builds {
+		if build.ID != event.BuildID {
+			return finishedEventKind(build.Status), nil
+		}
+	}
+
+	return "", nil
+}
+
+// projectCache remembers the parent of each TeamCity project so events can be matched against
+// subscriptions to parent projects without querying TeamCity for every event. Projects are
+// keyed by server and project ID.
+type projectCache struct {
+	sync.Mutex
+	parents map[string]string
+	expires time.Time
+}
+
+// parent returns the cached parent of a project, and false if it is not cached
+func (c *projectCache) parent(key string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.parents == nil || time.Now().After(c.expires) {
+		return "", false
+	}
+
+	parentID, ok := c.parents[key]
+	return parentID, ok
+}
+
+// setParent caches the parent of a project
+func (c *projectCache) setParent(key, parentID string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.parents == nil || time.Now().After(c.expires) {
+		c.parents = map[string]string{}
+		c.expires = time.Now().Add(projectCacheTTL)
+	}
+
+	c.parents[key] = parentID
+}
+
+// projectAncestors returns the project of the event followed by all of its parent projects. If
+// a project cannot be looked up, the projects found so far are returned with the error.
+func (p *Plugin) projectAncestors(event *buildEvent) ([]string, error) {
+	server := serverNameOrDefault(event.Server)
+
+	client, err := p.serverClient(server)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not look up projects")
+	}
+
+	projectID := event.ProjectID
+	if projectID == "" && event.BuildTypeID != "" {
+		buildType, err := client.GetBuildType(event.BuildTypeID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not look up build configuration %s", event.BuildTypeID)
+		}
+		projectID = buildType.ProjectID
+	}
+
+	var ancestors []string
+	seen := map[string]bool{}
+	for projectID != "" && !seen[projectID] {
+		seen[projectID] = true
+		ancestors = append(ancestors, projectID)
+
+		cacheKey := server + ":" + projectID
+
+		// The cache is not locked while TeamCity is queried, so a slow server does not hold up
+		// the events of other servers
+		parentID, ok := p.projects.parent(cacheKey)
+		if !ok {
+			project, err := client.GetProject(projectID)
+			if err != nil {
+				return ancestors, errors.Wrapf(err, "could not look up project %s", projectID)
+			}
+			parentID = project.ParentProjectID
+			p.projects.setParent(cacheKey, parentID)
+		}
+
+		projectID = parentID
+	}
+
+	return ancestors, nil
+}
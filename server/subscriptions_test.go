@@ -0,0 +1,199 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestParseSubscriptionEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	events, err := parseSubscriptionEvents("Failed, fixed,,started")
+	assert.Nil(err)
+	assert.Equal([]string{eventFailed, deltaFixed, eventStarted}, events)
+
+	_, err = parseSubscriptionEvents("failed,exploded")
+	assert.NotNil(err)
+}
+
+func TestSubscriptionMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	fixed := &buildEvent{Kind: eventSucceeded, Delta: deltaFixed}
+	succeeded := &buildEvent{Kind: eventSucceeded}
+	queued := &buildEvent{Kind: eventQueued}
+
+	defaults := &subscription{}
+	assert.True(defaults.Matches(succeeded))
+	assert.False(defaults.Matches(queued))
+
+	onlyFixed := &subscription{Filter: subscriptionFilter{Events: []string{eventFailed, deltaFixed}}}
+	assert.True(onlyFixed.Matches(fixed))
+	assert.False(onlyFixed.Matches(succeeded))
+}
+
+func TestSubscriptionFilterBranches(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := &subscriptionFilter{Branches: []string{branchDefault, "release/*"}}
+
+	assert.True(filter.Matches(&buildEvent{Kind: eventFailed, Branch: "main", DefaultBranch: true}))
+	assert.True(filter.Matches(&buildEvent{Kind: eventFailed}))
+	assert.True(filter.Matches(&buildEvent{Kind: eventFailed, Branch: "refs/heads/release/1.0"}))
+	assert.False(filter.Matches(&buildEvent{Kind: eventFailed, Branch: "feature/x"}))
+
+	assert.NotNil(validateBranchPatterns([]string{"release/["}))
+}
+
+func TestSubscriptionFilterExcludePersonal(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := &subscriptionFilter{ExcludePersonal: true}
+
+	assert.False(filter.Matches(&buildEvent{Kind: eventFailed, Personal: true}))
+	assert.True(filter.Matches(&buildEvent{Kind: eventFailed}))
+}
+
+func TestFillBuildDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+	allowLogs(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	delta := func(kind, branch string, defaultBranch bool) string {
+		event := &buildEvent{Server: defaultServerName, Kind: kind, BuildTypeID: "Backend_Build", Branch: branch, DefaultBranch: defaultBranch}
+		p.fillBuildDelta(event)
+		return event.Delta
+	}
+
+	// Webhooks send the display name of branches and the REST API their full name
+	assert.Empty(delta(eventSucceeded, "main", true))
+	assert.Equal(deltaBroken, delta(eventFailed, "refs/heads/main", true))
+	assert.Equal(deltaFixed, delta(eventSucceeded, "", false), "configurations without branches build the default branch")
+
+	assert.Empty(delta(eventFailed, "feature/x", false), "branches have their own results")
+	assert.Equal(deltaFixed, delta(eventSucceeded, "refs/heads/feature/x", false))
+}
+
+func TestDispatchBuildEvent(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	api.On("GetChannel", mock.AnythingOfType("string")).Return(func(channelID string) *model.Channel {
+		return &model.Channel{Id: channelID, TeamId: "team"}
+	}, nil)
+	api.On("GetDirectChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(&model.Channel{Id: "dm"}, nil)
+
+	var channels []string
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		if post.ChannelId != "dm" {
+			channels = append(channels, post.ChannelId)
+		}
+		return post
+	}, nil)
+
+	subscribe := func(channelID, server, targetID, targetType string, events ...string) {
+		assert.Nil(plugin.addSubscription(&subscription{
+			ChannelID:  channelID,
+			Server:     server,
+			TargetID:   targetID,
+			TargetType: targetType,
+			Filter:     subscriptionFilter{Events: events},
+		}))
+	}
+
+	subscribe("root", defaultServerName, "_Root", subscriptionTargetProject, eventFailed)
+	subscribe("project", defaultServerName, "MattermostTeamcityPlugin", subscriptionTargetProject, eventFailed)
+	subscribe("project", defaultServerName, "MattermostTeamcityPlugin_TestBuild", subscriptionTargetBuildType, eventFailed)
+	subscribe("buildtype", defaultServerName, "mattermostteamcityplugin_testbuild", subscriptionTargetBuildType, eventFailed)
+	subscribe("successes", defaultServerName, "MattermostTeamcityPlugin", subscriptionTargetProject, eventSucceeded)
+	subscribe("website", defaultServerName, "Website", subscriptionTargetProject, eventFailed)
+	subscribe("infra", "infra", "MattermostTeamcityPlugin", subscriptionTargetProject, eventFailed)
+
+	event := eventFromBuild(teamCity.builds[2])
+	event.Kind = eventFailed
+	assert.Nil(plugin.dispatchBuildEvent(event))
+
+	sort.Strings(channels)
+	assert.Equal([]string{"buildtype", "project", "root"}, channels,
+		"subscriptions to the build configuration and its parent projects are notified once per channel")
+
+	// tcWebHooks reports builds breaking their configuration twice, and the poller may report
+	// them too
+	channels = nil
+	broken := eventFromBuild(teamCity.builds[2])
+	broken.Kind, broken.Delta = eventFailed, deltaBroken
+	assert.Nil(plugin.dispatchBuildEvent(broken))
+	assert.Empty(channels, "build events are dispatched once")
+
+	// Subscriptions are replaced and removed regardless of how the ID is spelled
+	subscribe("buildtype", defaultServerName, "MattermostTeamcityPlugin_TestBuild", subscriptionTargetBuildType, eventSucceeded)
+	subs, err := plugin.channelSubscriptions("buildtype")
+	assert.Nil(err)
+	assert.Len(subs, 1)
+
+	removed, err := plugin.removeSubscription("root", defaultServerName, "_root")
+	assert.Nil(err)
+	assert.True(removed)
+
+	channels = nil
+	event = eventFromBuild(teamCity.rerunBuild(2))
+	event.Kind = eventFailed
+	assert.Nil(plugin.dispatchBuildEvent(event))
+	assert.Equal([]string{"project"}, channels)
+}
+
+func TestParseCommandLine(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd, args, flags := parseCommandLine("/teamcity subscribe Backend --events=failed,fixed --branch=main --branch=release/* --exclude-personal")
+
+	assert.Equal(commandTriggerSubscribe, cmd.Name)
+	assert.Equal([]string{"Backend"}, args)
+	assert.Equal([]string{eventFailed, deltaFixed}, flags.List("events"))
+	assert.Equal([]string{"main", "release/*"}, flags.List("branch"))
+	assert.True(flags.Bool("exclude-personal"))
+
+	_, _, unknown, _ := cmd.scan([]string{"Backend", "--foo"})
+	assert.Equal([]string{"--foo"}, unknown)
+
+	cmd, args, flags = parseCommandLine("/teamcity build start Backend_Build -p env.FOO=bar -p env.BAZ=1 --top")
+
+	assert.Equal(commandTriggerBuildStart, cmd.Name)
+	assert.Equal([]string{"Backend_Build"}, args)
+	assert.Equal([]string{"env.FOO=bar", "env.BAZ=1"}, flags["param"])
+	assert.True(flags.Bool("top"))
+
+	// Flags with a value may be separated from it by a space, as the autocomplete writes them
+	_, args, flags = parseCommandLine("/teamcity build start Backend_Build --branch feature/x --top --server infra")
+
+	assert.Equal([]string{"Backend_Build"}, args)
+	assert.Equal("feature/x", flags.String("branch"))
+	assert.Equal("infra", flags.String("server"))
+	assert.True(flags.Bool("top"))
+
+	_, args, flags = parseCommandLine("/teamcity build start --dialog Backend_Build")
+	assert.Equal([]string{"Backend_Build"}, args, "boolean flags take no value")
+	assert.True(flags.Bool("dialog"))
+
+	// Words after -- are arguments, as when the command runs
+	_, args, flags = parseCommandLine("/teamcity build cancel 42 -- --server=x")
+	assert.Equal([]string{"42", "--server=x"}, args)
+	assert.Empty(flags.String("server"))
+
+	// Partial commands of the autocomplete are read up to the flag missing its value
+	_, args, flags = parseCommandLine("/teamcity build start Backend_Build --server infra --branch")
+	assert.Equal([]string{"Backend_Build"}, args)
+	assert.Equal("infra", flags.String("server"))
+}
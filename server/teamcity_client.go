@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const restClientTimeout = 30 * time.Second
+
+// buildFields are the build fields requested from TeamCity, matching tcBuild
+const buildFields = "id,buildTypeId,number,status,state,statusText,branchName,defaultBranch,personal,webUrl," +
+	"queuedDate,startDate,finishDate,buildType(id,name,projectId,projectName,webUrl),agent(id,name)," +
+	"triggered(type,details,user(id,username,name,email))," +
+	"running-info(percentageComplete,currentStageText,elapsedSeconds,estimatedTotalSeconds)"
+
+// errNotFound is returned when TeamCity answers 404 for the requested resource
+var errNotFound = errors.New("not found")
+
+// teamCityIDPattern matches the IDs of TeamCity projects and build configurations. IDs are put
+// in locators as they are, so other characters could add dimensions to them.
+var teamCityIDPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// TeamCityClient is the part of the TeamCity REST API used by the plugin. The plugin creates
+// clients with Plugin.newClient, so tests can replace them.
+type TeamCityClient interface {
+	GetServer() (*tcServer, error)
+	GetCurrentUser() (*tcUser, error)
+
+	GetProject(projectID string) (*tcProject, error)
+	GetProjects() ([]*tcProject, error)
+	GetBuildType(buildTypeID string) (*tcBuildType, error)
+	GetBuildTypes(locator string) ([]*tcBuildType, error)
+	GetBuildTypeParameters(buildTypeID string) ([]*tcParameter, error)
+	GetBranches(buildTypeID string) ([]*tcBranch, error)
+
+	GetBuild(buildID int64) (*tcBuild, error)
+	GetBuilds(locator string) ([]*tcBuild, error)
+	GetBuildParameters(buildID int64) (map[string]string, error)
+	GetBuildLog(buildID int64) (io.ReadCloser, error)
+	BuildLogURL(buildID int64) string
+	GetTestOccurrences(locator string) (*tcTestOccurrences, error)
+	GetProblemOccurrences(locator string) (*tcProblemOccurrences, error)
+	BuildTestsURL(buildID int64) string
+	GetChanges(locator string) ([]*tcChange, error)
+	BuildChangesURL(buildID int64) string
+
+	QueueBuild(buildTypeID string, options *queueBuildOptions) (*tcBuild, error)
+	GetBuildQueue(locator string) ([]*tcBuild, error)
+	CancelBuild(build *tcBuild, comment string) error
+	PinBuild(buildID int64, comment string) error
+	AddBuildTags(buildID int64, tags []string) error
+	TakeInvestigation(buildTypeID, username, comment string) error
+	MuteFailures(buildTypeID string, testIDs, problemIDs []int64, comment string) error
+
+	GetAgent(locator string) (*tcAgent, error)
+	GetAgents() ([]*tcAgent, error)
+}
+
+// restClient implements TeamCityClient with the TeamCity REST API, authenticating with an
+// access token
+type restClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func newRESTClient(baseURL, token string) *restClient {
+	return &restClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: restClientTimeout},
+	}
+}
+
+// teamCityClient returns a client for a TeamCity server
+func (p *Plugin) teamCityClient(baseURL, token string) TeamCityClient {
+	if p.newClient != nil {
+		return p.newClient(baseURL, token)
+	}
+
+	return newRESTClient(baseURL, token)
+}
+
+// do sends a request to path, relative to the server URL, and decodes the JSON response into
+// out unless it is nil. body, if not nil, is sent as plain text if it is a string and as JSON
+// otherwise.
+func (c *restClient) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	req, err := c.newRequest(method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrapf(err, "could not decode response from %s", path)
+	}
+
+	return nil
+}
+
+// newRequest creates an authenticated request to path, relative to the server URL, see do
+func (c *restClient) newRequest(method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	var reqBody io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reqBody = strings.NewReader(b)
+		contentType = "text/plain"
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not encode request")
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return req, nil
+}
+
+// send sends a request and returns the response if it succeeded. The caller closes its body.
+func (c *restClient) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed", req.Method, req.URL.Path)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s failed: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
+
+func (c *restClient) get(path string, query url.Values, out interface{}) error {
+	return c.do(http.MethodGet, path, query, nil, out)
+}
+
+// locatorPath escapes a TeamCity locator for use in a URL path, e.g. "id:MyProject"
+func locatorPath(locator string) string {
+	return url.PathEscape(locator)
+}
+
+// validTeamCityID returns true if id can be the ID of a TeamCity project or build configuration
+func validTeamCityID(id string) bool {
+	return teamCityIDPattern.MatchString(id)
+}
+
+// idLocator returns the locator of the project or build configuration with the given ID, e.g.
+// "id:MyProject", or errNotFound if there can be none
+func idLocator(id string) (string, error) {
+	if !validTeamCityID(id) {
+		return "", errors.Wrapf(errNotFound, "invalid ID `%s`", id)
+	}
+
+	return "id:" + id, nil
+}
+
+// locatorValue encodes a free-form value of a locator dimension, e.g. a branch name, so commas
+// and parentheses in it are not read as part of the locator
+func locatorValue(value string) string {
+	return "$base64:" + base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// GetProject returns the project with the given external ID
+func (c *restClient) GetProject(projectID string) (*tcProject, error) {
+	var project tcProject
+
+	query := url.Values{"fields": {"id,name,parentProjectId,webUrl"}}
+	locator, err := idLocator(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.get("/app/rest/projects/"+locatorPath(locator), query, &project); err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// GetProjects returns all projects
+func (c *restClient) GetProjects() ([]*tcProject, error) {
+	var projects struct {
+		Project []*tcProject `json:"project"`
+	}
+
+	query := url.Values{"fields": {"project(id,name,parentProjectId,webUrl)"}}
+	if err := c.get("/app/rest/projects", query, &projects); err != nil {
+		return nil, err
+	}
+
+	return projects.Project, nil
+}
+
+// GetBuildType returns the build configuration with the given external ID
+func (c *restClient) GetBuildType(buildTypeID string) (*tcBuildType, error) {
+	var buildType tcBuildType
+
+	query := url.Values{"fields": {"id,name,projectId,projectName,webUrl"}}
+	locator, err := idLocator(buildTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.get("/app/rest/buildTypes/"+locatorPath(locator), query, &buildType); err != nil {
+		return nil, err
+	}
+
+	return &buildType, nil
+}
+
+// GetBuildTypes returns the build configurations matching a TeamCity build type locator, or all
+// of them if the locator is empty
+func (c *restClient) GetBuildTypes(locator string) ([]*tcBuildType, error) {
+	var buildTypes struct {
+		BuildType []*tcBuildType `json:"buildType"`
+	}
+
+	query := url.Values{"fields": {"buildType(id,name,projectId,projectName,webUrl)"}}
+	if locator != "" {
+		query.Set("locator", locator)
+	}
+	if err := c.get("/app/rest/buildTypes", query, &buildTypes); err != nil {
+		return nil, err
+	}
+
+	return buildTypes.BuildType, nil
+}
+
+// GetBuildTypeParameters returns the parameters of the build configuration with the given
+// external ID, including inherited ones
+func (c *restClient) GetBuildTypeParameters(buildTypeID string) ([]*tcParameter, error) {
+	var parameters struct {
+		Property []*tcParameter `json:"property"`
+	}
+
+	query := url.Values{"fields": {"property(name,value,type(rawValue))"}}
+	locator, err := idLocator(buildTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.get("/app/rest/buildTypes/"+locatorPath(locator)+"/parameters", query, &parameters); err != nil {
+		return nil, err
+	}
+
+	return parameters.Property, nil
+}
+
+// GetBranches returns the branches of the build configuration with the given external ID that
+// TeamCity knows about, including the default branch
+func (c *restClient) GetBranches(buildTypeID string) ([]*tcBranch, error) {
+	var branches struct {
+		Branch []*tcBranch `json:"branch"`
+	}
+
+	query := url.Values{
+		"locator": {"policy:ALL_BRANCHES"},
+		"fields":  {"branch(name,default)"},
+	}
+	locator, err := idLocator(buildTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.get("/app/rest/buildTypes/"+locatorPath(locator)+"/branches", query, &branches); err != nil {
+		return nil, err
+	}
+
+	return branches.Branch, nil
+}
+
+// GetBuild returns the build with the given ID
+func (c *restClient) GetBuild(buildID int64) (*tcBuild, error) {
+	var build tcBuild
+
+	query := url.Values{"fields": {buildFields}}
+	if err := c.get(fmt.Sprintf("/app/rest/builds/id:%d", buildID), query, &build); err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+// GetBuildLog downloads the build log of a build as plain text. The caller closes it.
+func (c *restClient) GetBuildLog(buildID int64) (io.ReadCloser, error) {
+	query := url.Values{"buildId": {strconv.FormatInt(buildID, 10)}, "plain": {"true"}}
+
+	req, err := c.newRequest(http.MethodGet, "/downloadBuildLog.html", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// BuildLogURL returns the web URL of the build log of a build
+func (c *restClient) BuildLogURL(buildID int64) string {
+	return fmt.Sprintf("%s/viewLog.html?buildId=%d&tab=buildLog", c.baseURL, buildID)
+}
+
+// GetTestOccurrences returns the test runs matching a locator, e.g.
+// "build:(id:42),status:FAILURE,count:10"
+func (c *restClient) GetTestOccurrences(locator string) (*tcTestOccurrences, error) {
+	var tests tcTestOccurrences
+
+	query := url.Values{
+		"locator": {locator},
+		"fields":  {"count,nextHref,testOccurrence(id,name,status,duration,newFailure,muted,firstFailed(build(id,number,webUrl)),test(id))"},
+	}
+	if err := c.get("/app/rest/testOccurrences", query, &tests); err != nil {
+		return nil, err
+	}
+
+	return &tests, nil
+}
+
+// GetProblemOccurrences returns the build problems matching a locator, e.g.
+// "build:(id:42),count:10"
+func (c *restClient) GetProblemOccurrences(locator string) (*tcProblemOccurrences, error) {
+	var problems tcProblemOccurrences
+
+	query := url.Values{
+		"locator": {locator},
+		"fields":  {"count,nextHref,problemOccurrence(id,type,identity,details,problem(id))"},
+	}
+	if err := c.get("/app/rest/problemOccurrences", query, &problems); err != nil {
+		return nil, err
+	}
+
+	return &problems, nil
+}
+
+// BuildTestsURL returns the web URL of the tests of a build
+func (c *restClient) BuildTestsURL(buildID int64) string {
+	return fmt.Sprintf("%s/viewLog.html?buildId=%d&tab=testsInfo", c.baseURL, buildID)
+}
+
+// GetChanges returns the VCS changes matching a locator, e.g. "build:(id:42)", newest first
+func (c *restClient) GetChanges(locator string) ([]*tcChange, error) {
+	var changes struct {
+		Change []*tcChange `json:"change"`
+	}
+
+	query := url.Values{
+		"locator": {locator},
+		"fields":  {"change(id,version,username,date,comment,webUrl,user(id,username,name,email),files(count))"},
+	}
+	if err := c.get("/app/rest/changes", query, &changes); err != nil {
+		return nil, err
+	}
+
+	return changes.Change, nil
+}
+
+// BuildChangesURL returns the web URL of the changes of a build
+func (c *restClient) BuildChangesURL(buildID int64) string {
+	return fmt.Sprintf("%s/viewLog.html?buildId=%d&tab=buildChangesDiv", c.baseURL, buildID)
+}
+
+// QueueBuild adds a build of the build configuration to the queue
+func (c *restClient) QueueBuild(buildTypeID string, options *queueBuildOptions) (*tcBuild, error) {
+	type idRef struct {
+		ID interface{} `json:"id"`
+	}
+
+	type comment struct {
+		Text string `json:"text"`
+	}
+
+	type triggeringOptions struct {
+		QueueAtTop bool `json:"queueAtTop"`
+	}
+
+	request := struct {
+		BuildType         idRef              `json:"buildType"`
+		BranchName        string             `json:"branchName,omitempty"`
+		Comment           *comment           `json:"comment,omitempty"`
+		Properties        *tcProperties      `json:"properties,omitempty"`
+		Agent             *idRef             `json:"agent,omitempty"`
+		TriggeringOptions *triggeringOptions `json:"triggeringOptions,omitempty"`
+	}{
+		BuildType:  idRef{ID: buildTypeID},
+		BranchName: options.Branch,
+	}
+
+	if options.Comment != "" {
+		request.Comment = &comment{Text: options.Comment}
+	}
+
+	if len(options.Parameters) > 0 {
+		request.Properties = &tcProperties{}
+		for name, value := range options.Parameters {
+			request.Properties.Property = append(request.Properties.Property, tcProperty{Name: name, Value: value})
+		}
+	}
+
+	if options.AgentID != 0 {
+		request.Agent = &idRef{ID: options.AgentID}
+	}
+
+	if options.QueueAtTop {
+		request.TriggeringOptions = &triggeringOptions{QueueAtTop: true}
+	}
+
+	var build tcBuild
+
+	query := url.Values{"fields": {buildFields}}
+	if err := c.do(http.MethodPost, "/app/rest/buildQueue", query, request, &build); err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+// GetBuildQueue returns the queued builds matching a TeamCity build queue locator, or all of
+// them if the locator is empty, first in the queue first
+func (c *restClient) GetBuildQueue(locator string) ([]*tcBuild, error) {
+	var queue struct {
+		Build []*tcBuild `json:"build"`
+	}
+
+	query := url.Values{"fields": {"build(" + buildFields + ")"}}
+	if locator != "" {
+		query.Set("locator", locator)
+	}
+	if err := c.get("/app/rest/buildQueue", query, &queue); err != nil {
+		return nil, err
+	}
+
+	return queue.Build, nil
+}
+
+// CancelBuild cancels a queued or running build, with a comment
+func (c *restClient) CancelBuild(build *tcBuild, comment string) error {
+	request := struct {
+		Comment        string `json:"comment"`
+		ReaddIntoQueue bool   `json:"readdIntoQueue"`
+	}{
+		Comment: comment,
+	}
+
+	path := fmt.Sprintf("/app/rest/builds/id:%d", build.ID)
+	if build.State == "queued" {
+		path = fmt.Sprintf("/app/rest/buildQueue/id:%d", build.ID)
+	}
+
+	return c.do(http.MethodPost, path, nil, request, nil)
+}
+
+// PinBuild pins a finished build, with a comment, so that it is not cleaned up
+func (c *restClient) PinBuild(buildID int64, comment string) error {
+	return c.do(http.MethodPut, fmt.Sprintf("/app/rest/builds/id:%d/pin/", buildID), nil, comment, nil)
+}
+
+// AddBuildTags adds tags to a build
+func (c *restClient) AddBuildTags(buildID int64, tags []string) error {
+	type tag struct {
+		Name string `json:"name"`
+	}
+
+	request := struct {
+		Tag []tag `json:"tag"`
+	}{}
+	for _, name := range tags {
+		request.Tag = append(request.Tag, tag{Name: name})
+	}
+
+	return c.do(http.MethodPost, fmt.Sprintf("/app/rest/builds/id:%d/tags/", buildID), nil, request, nil)
+}
+
+// TakeInvestigation assigns the investigation of all problems of a build configuration to a
+// TeamCity user until they are fixed
+func (c *restClient) TakeInvestigation(buildTypeID, username, comment string) error {
+	request := map[string]interface{}{
+		"assignee":   map[string]interface{}{"username": username},
+		"assignment": map[string]interface{}{"text": comment},
+		"state":      "TAKEN",
+		"resolution": map[string]interface{}{"type": "whenFixed"},
+		"scope":      buildTypeScope(buildTypeID),
+		"target":     map[string]interface{}{"anyProblem": true},
+	}
+
+	return c.do(http.MethodPost, "/app/rest/investigations", nil, request, nil)
+}
+
+// MuteFailures mutes tests and build problems in a build configuration until they are fixed
+func (c *restClient) MuteFailures(buildTypeID string, testIDs, problemIDs []int64, comment string) error {
+	var tests, problems []map[string]interface{}
+	for _, id := range testIDs {
+		tests = append(tests, map[string]interface{}{"id": strconv.FormatInt(id, 10)})
+	}
+	for _, id := range problemIDs {
+		problems = append(problems, map[string]interface{}{"id": strconv.FormatInt(id, 10)})
+	}
+
+	target := map[string]interface{}{}
+	if len(tests) > 0 {
+		target["tests"] = map[string]interface{}{"test": tests}
+	}
+	if len(problems) > 0 {
+		target["problems"] = map[string]interface{}{"problem": problems}
+	}
+
+	request := map[string]interface{}{
+		"assignment": map[string]interface{}{"text": comment},
+		"resolution": map[string]interface{}{"type": "whenFixed"},
+		"scope":      buildTypeScope(buildTypeID),
+		"target":     target,
+	}
+
+	return c.do(http.MethodPost, "/app/rest/mutes", nil, request, nil)
+}
+
+func buildTypeScope(buildTypeID string) map[string]interface{} {
+	return map[string]interface{}{
+		"buildTypes": map[string]interface{}{
+			"buildType": []map[string]interface{}{{"id": buildTypeID}},
+		},
+	}
+}
+
+// GetBuildParameters returns the custom parameters a build was queued with
+func (c *restClient) GetBuildParameters(buildID int64) (map[string]string, error) {
+	var build struct {
+		Properties tcProperties `json:"properties"`
+	}
+
+	query := url.Values{"fields": {"properties(property(name,value))"}}
+	if err := c.get(fmt.Sprintf("/app/rest/builds/id:%d", buildID), query, &build); err != nil {
+		return nil, err
+	}
+
+	parameters := map[string]string{}
+	for _, property := range build.Properties.Property {
+		parameters[property.Name] = property.Value
+	}
+
+	return parameters, nil
+}
+
+// GetServer returns the version of the TeamCity server
+func (c *restClient) GetServer() (*tcServer, error) {
+	var server tcServer
+
+	query := url.Values{"fields": {"version,buildNumber,webUrl"}}
+	if err := c.get("/app/rest/server", query, &server); err != nil {
+		return nil, err
+	}
+
+	return &server, nil
+}
+
+// GetCurrentUser returns the TeamCity user owning the access token
+func (c *restClient) GetCurrentUser() (*tcUser, error) {
+	var user tcUser
+
+	query := url.Values{"fields": {"id,username,name,email"}}
+	if err := c.get("/app/rest/users/current", query, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetAgent returns the build agent matching an agent locator, e.g. "name:agent-1"
+func (c *restClient) GetAgent(locator string) (*tcAgent, error) {
+	var agent tcAgent
+
+	query := url.Values{"fields": {"id,name"}}
+	if err := c.get("/app/rest/agents/"+locatorPath(locator), query, &agent); err != nil {
+		return nil, err
+	}
+
+	return &agent, nil
+}
+
+// GetAgents returns the authorized and unauthorized build agents, connected or not, with the
+// builds they are running
+func (c *restClient) GetAgents() ([]*tcAgent, error) {
+	var agents struct {
+		Agent []*tcAgent `json:"agent"`
+	}
+
+	query := url.Values{
+		"locator": {"defaultFilter:false"},
+		"fields":  {"agent(id,name,webUrl,enabled,authorized,uptodate,connected,build(id,buildTypeId))"},
+	}
+	if err := c.get("/app/rest/agents", query, &agents); err != nil {
+		return nil, err
+	}
+
+	return agents.Agent, nil
+}
+
+// GetBuilds returns the builds matching a TeamCity build locator, newest first
+func (c *restClient) GetBuilds(locator string) ([]*tcBuild, error) {
+	var builds struct {
+		Build []*tcBuild `json:"build"`
+	}
+
+	query := url.Values{
+		"locator": {locator},
+		"fields":  {"build(" + buildFields + ")"},
+	}
+	if err := c.get("/app/rest/builds", query, &builds); err != nil {
+		return nil, err
+	}
+
+	return builds.Build, nil
+}
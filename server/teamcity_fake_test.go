@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+const fakeTeamCityToken = "eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl"
+
+// fakeFailedBuildLog is the build log of the failed build of fakeTeamCity
+const fakeFailedBuildLog = `[10:00:00]i: TeamCity server version is 2023.11 (build 147412)
+[10:00:01] : Checking for changes
+[10:00:02] : Updating sources
+[10:00:05] : Step 1/2: Build (Command Line)
+[10:00:05]i: [Step 1/2] Starting: make dist
+[10:00:20] : [Step 1/2] Process exited with code 0
+[10:00:21] : Step 2/2: Test (Command Line)
+[10:00:21] : [Step 2/2] === RUN   TestBuildLog
+[10:00:22] : [Step 2/2] --- FAIL: TestBuildLog (0.01s)
+[10:00:22] : [Step 2/2]     buildlog_test.go:42: expected 10 lines, got 9
+[10:00:23] : [Step 2/2] FAIL
+[10:00:23]E: [Step 2/2] Process exited with code 1
+[10:00:24]E: Step Test (Command Line) failed
+[10:00:25] : Publishing artifacts
+`
+
+// fakeTeamCity is a TeamCity REST API server for tests, with two projects and their build
+// configurations, finished and running builds of the first one, a build queue, two agents and the
+// log, tests, build problems and changes of the failed build. It accepts fakeTeamCityToken.
+type fakeTeamCity struct {
+	*httptest.Server
+	sync.Mutex
+
+	projects   []*tcProject
+	buildTypes []*tcBuildType
+	parameters map[string][]*tcParameter
+	builds     map[int64]*tcBuild
+	queue      []int64
+	agents     []*tcAgent
+	logs       map[int64]string
+	tests      map[int64][]*tcTestOccurrence
+	problems   map[int64][]*tcProblemOccurrence
+	changes    map[int64][]*tcChange
+	nextID     int64
+
+	// cancelled are the comments of cancelled builds
+	cancelled map[int64]string
+	// queued are the options of queued builds
+	queued map[int64]*queueBuildOptions
+	// investigations and mutes are the requests creating them
+	investigations []map[string]interface{}
+	mutes          []map[string]interface{}
+}
+
+func newFakeTeamCity() *fakeTeamCity {
+	tc := &fakeTeamCity{
+		projects: []*tcProject{
+			{ID: "_Root", Name: "<Root project>"},
+			{ID: "MattermostTeamcityPlugin", Name: "Mattermost TeamCity Plugin", ParentProjectID: "_Root"},
+			{ID: "Website", Name: "Website", ParentProjectID: "_Root"},
+		},
+		buildTypes: []*tcBuildType{
+			{ID: "MattermostTeamcityPlugin_TestBuild", Name: "Test Build", ProjectID: "MattermostTeamcityPlugin", ProjectName: "Mattermost TeamCity Plugin"},
+			{ID: "Website_Deploy", Name: "Deploy", ProjectID: "Website", ProjectName: "Website"},
+		},
+		parameters: map[string][]*tcParameter{
+			"MattermostTeamcityPlugin_TestBuild": {{Name: "env.TARGET", Value: "staging"}},
+		},
+		builds:    map[int64]*tcBuild{},
+		logs:      map[int64]string{},
+		tests:     map[int64][]*tcTestOccurrence{},
+		problems:  map[int64][]*tcProblemOccurrence{},
+		changes:   map[int64][]*tcChange{},
+		cancelled: map[int64]string{},
+		queued:    map[int64]*queueBuildOptions{},
+		nextID:    1,
+	}
+
+	for _, project := range tc.projects {
+		project.WebURL = "http://teamcity/project.html?projectId=" + project.ID
+	}
+
+	succeeded := tc.addBuild("finished", "SUCCESS", "Tests passed: 12")
+	tc.changes[succeeded.ID] = []*tcChange{
+		{ID: 10, Version: "0c3f5a0e8b1d4c2a9f7e6d5c4b3a29181716f5e4", Username: "bob", Comment: "Add the build log", WebURL: "http://teamcity/change/10"},
+	}
+	failed := tc.addBuild("finished", "FAILURE", "Tests failed: 1 (1 new), passed: 11")
+	tc.logs[failed.ID] = fakeFailedBuildLog
+	tc.changes[failed.ID] = []*tcChange{
+		{ID: 12, Version: "9b2e7d1c4a5f6e8d0c1b2a3f4e5d6c7b8a9f0e1d", Username: "Jane Doe <jane@example.com>", Comment: "Tail the build log\n\nWith a ring buffer", WebURL: "http://teamcity/change/12",
+			User: &tcUser{ID: 2, Username: "jdoe", Name: "Jane Doe", Email: "jane@example.com"}},
+		{ID: 11, Version: "4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e", Username: "Carl <carl@example.com>", Comment: "Fix typo", WebURL: "http://teamcity/change/11"},
+	}
+	tc.changes[failed.ID][0].Files.Count = 3
+	tc.changes[failed.ID][1].Files.Count = 1
+	tc.tests[failed.ID] = []*tcTestOccurrence{
+		{ID: "build:(id:2),id:1", Name: "server: TestBuildLog", Status: "SUCCESS", Duration: 850, Test: &tcTestRef{ID: -101}},
+		{ID: "build:(id:2),id:2", Name: "server: TestBuildLogTail", Status: "FAILURE", Duration: 10, NewFailure: true, Test: &tcTestRef{ID: -102}},
+	}
+	tc.problems[failed.ID] = []*tcProblemOccurrence{
+		{ID: "problem:(id:1),build:(id:2)", Type: tcProblemFailedTests, Identity: "TC_FAILED_TESTS", Details: "Tests failed", Problem: &tcProblemRef{ID: 1}},
+		{ID: "problem:(id:2),build:(id:2)", Type: "TC_EXIT_CODE", Identity: "TC_EXIT_CODE1", Details: "Process exited with code 1 (Step: Test (Command Line))", Problem: &tcProblemRef{ID: 2}},
+	}
+	running := tc.addBuild("running", "SUCCESS", "Running tests")
+	running.RunningInfo = &tcRunningInfo{PercentageComplete: 50, CurrentStageText: "Running tests"}
+
+	tc.agents = []*tcAgent{
+		{ID: 1, Name: "agent-1", Enabled: true, Authorized: true, UpToDate: true, Connected: true, Build: &tcBuildRef{ID: running.ID, BuildTypeID: running.BuildTypeID}},
+		{ID: 2, Name: "agent-2", Enabled: true, Authorized: true, UpToDate: true},
+	}
+	for _, agent := range tc.agents {
+		agent.WebURL = fmt.Sprintf("http://teamcity/agentDetails.html?id=%d", agent.ID)
+	}
+
+	tc.Server = httptest.NewServer(http.HandlerFunc(tc.serveHTTP))
+
+	return tc
+}
+
+// addBuild adds a build of the test build configuration
+func (tc *fakeTeamCity) addBuild(state, status, statusText string) *tcBuild {
+	buildType := tc.buildTypes[0]
+
+	build := &tcBuild{
+		ID:            tc.nextID,
+		BuildTypeID:   buildType.ID,
+		Number:        strconv.FormatInt(tc.nextID, 10),
+		State:         state,
+		Status:        status,
+		StatusText:    statusText,
+		DefaultBranch: true,
+		WebURL:        fmt.Sprintf("http://teamcity/viewLog.html?buildId=%d", tc.nextID),
+		QueuedDate:    tcTime(time.Now().Format(tcTimeFormat)),
+		BuildType:     *buildType,
+	}
+
+	if state != "queued" {
+		build.StartDate = build.QueuedDate
+		build.Agent = tcAgent{ID: 1, Name: "agent-1"}
+	}
+	if state == "finished" {
+		build.FinishDate = build.QueuedDate
+	}
+
+	tc.builds[build.ID] = build
+	tc.nextID++
+
+	return build
+}
+
+// rerunBuild adds a build with the result, log, tests, problems and changes of an existing
+// build, as if the same revision was built again
+func (tc *fakeTeamCity) rerunBuild(id int64) *tcBuild {
+	build := *tc.builds[id]
+	build.ID = tc.nextID
+	build.Number = strconv.FormatInt(tc.nextID, 10)
+	build.WebURL = fmt.Sprintf("http://teamcity/viewLog.html?buildId=%d", tc.nextID)
+
+	tc.builds[build.ID] = &build
+	tc.logs[build.ID] = tc.logs[id]
+	tc.tests[build.ID] = tc.tests[id]
+	tc.problems[build.ID] = tc.problems[id]
+	tc.changes[build.ID] = tc.changes[id]
+	tc.nextID++
+
+	return &build
+}
+
+func (tc *fakeTeamCity) buildType(id string) *tcBuildType {
+	for _, buildType := range tc.buildTypes {
+		if buildType.ID == id {
+			return buildType
+		}
+	}
+
+	return nil
+}
+
+func (tc *fakeTeamCity) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeTeamCityToken {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/app/rest")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	var id string
+	if len(parts) > 1 {
+		id = strings.TrimPrefix(parts[1], "id:")
+	}
+
+	var out interface{}
+
+	switch {
+	case path == "/downloadBuildLog.html":
+		buildID, _ := strconv.ParseInt(r.URL.Query().Get("buildId"), 10, 64)
+		if log, ok := tc.logs[buildID]; ok {
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(log))
+			return
+		}
+
+	case path == "/testOccurrences":
+		locator := r.URL.Query().Get("locator")
+		status := locatorDimension(locator, "status")
+
+		var tests []*tcTestOccurrence
+		for _, test := range tc.tests[locatorID(locator, "build")] {
+			if status == "" || test.Status == status {
+				tests = append(tests, test)
+			}
+		}
+
+		page := &tcTestOccurrences{TestOccurrence: tests}
+		if count, _ := strconv.Atoi(locatorDimension(locator, "count")); count > 0 && len(tests) > count {
+			page.TestOccurrence, page.NextHref = tests[:count], "/app/rest/testOccurrences?locator=next"
+		}
+		page.Count = len(page.TestOccurrence)
+		out = page
+
+	case path == "/problemOccurrences":
+		locator := r.URL.Query().Get("locator")
+
+		page := &tcProblemOccurrences{ProblemOccurrence: tc.problems[locatorID(locator, "build")]}
+		if count, _ := strconv.Atoi(locatorDimension(locator, "count")); count > 0 && len(page.ProblemOccurrence) > count {
+			page.ProblemOccurrence, page.NextHref = page.ProblemOccurrence[:count], "/app/rest/problemOccurrences?locator=next"
+		}
+		page.Count = len(page.ProblemOccurrence)
+		out = page
+
+	case path == "/changes":
+		out = map[string]interface{}{"change": tc.changes[locatorID(r.URL.Query().Get("locator"), "build")]}
+
+	case (path == "/investigations" || path == "/mutes") && r.Method == http.MethodPost:
+		var request map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if path == "/investigations" {
+			tc.investigations = append(tc.investigations, request)
+		} else {
+			tc.mutes = append(tc.mutes, request)
+		}
+		out = request
+
+	case path == "/server":
+		out = &tcServer{Version: "2023.11 (build 147412)", BuildNumber: "147412", WebURL: tc.URL}
+
+	case path == "/users/current":
+		out = &tcUser{ID: 1, Username: "admin", Name: "Administrator"}
+
+	case path == "/projects":
+		out = map[string]interface{}{"project": tc.projects}
+
+	case parts[0] == "projects" && len(parts) == 2:
+		for _, project := range tc.projects {
+			if project.ID == id {
+				out = project
+			}
+		}
+
+	case path == "/buildTypes":
+		var buildTypes []*tcBuildType
+		for _, buildType := range tc.buildTypes {
+			if tc.matchesProject(buildType, r.URL.Query().Get("locator")) {
+				buildTypes = append(buildTypes, buildType)
+			}
+		}
+		out = map[string]interface{}{"buildType": buildTypes}
+
+	case parts[0] == "buildTypes" && len(parts) == 2:
+		if buildType := tc.buildType(id); buildType != nil {
+			out = buildType
+		}
+
+	case parts[0] == "buildTypes" && len(parts) == 3 && parts[2] == "parameters" && tc.buildType(id) != nil:
+		out = map[string]interface{}{"property": tc.parameters[id]}
+
+	case parts[0] == "buildTypes" && len(parts) == 3 && parts[2] == "branches" && tc.buildType(id) != nil:
+		out = map[string]interface{}{"branch": []*tcBranch{{Name: "main", Default: true}, {Name: "feature/x"}}}
+
+	case path == "/builds":
+		out = map[string]interface{}{"build": tc.listBuilds(r.URL.Query().Get("locator"))}
+
+	case path == "/buildQueue" && r.Method == http.MethodPost:
+		out = tc.queueBuild(w, r)
+		if out == nil {
+			return
+		}
+
+	case path == "/buildQueue":
+		var queue []*tcBuild
+		locator := r.URL.Query().Get("locator")
+		buildType := strings.TrimPrefix(strings.Trim(locatorDimension(locator, "buildType"), "()"), "id:")
+		for _, buildID := range tc.queue {
+			if build := tc.builds[buildID]; tc.matchesProject(&build.BuildType, locator) && (buildType == "" || build.BuildTypeID == buildType) {
+				queue = append(queue, build)
+			}
+		}
+		out = map[string]interface{}{"build": queue}
+
+	case (parts[0] == "builds" || parts[0] == "buildQueue") && len(parts) >= 2:
+		buildID, _ := strconv.ParseInt(id, 10, 64)
+		build := tc.builds[buildID]
+		if build == nil {
+			break
+		}
+
+		switch {
+		case r.Method == http.MethodPost && len(parts) == 2:
+			tc.cancelBuild(build, r)
+			w.WriteHeader(http.StatusOK)
+			return
+		case r.Method == http.MethodPut && len(parts) == 3 && parts[2] == "pin":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "tags":
+			w.WriteHeader(http.StatusOK)
+			return
+		case r.Method == http.MethodGet && len(parts) == 2:
+			out = build
+		}
+
+	case path == "/agents":
+		out = map[string]interface{}{"agent": tc.agents}
+
+	case parts[0] == "agents" && len(parts) == 2:
+		for _, agent := range tc.agents {
+			if "id:"+strconv.FormatInt(agent.ID, 10) == parts[1] || "name:"+locatorValue(agent.Name) == parts[1] {
+				out = agent
+			}
+		}
+	}
+
+	if out == nil {
+		http.Error(w, "Not found: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// listBuilds returns the finished builds, and the running ones too with running:any, newest
+// first, limited by the count, affectedProject, buildType, status, sinceBuild and untilBuild
+// dimensions of a locator
+func (tc *fakeTeamCity) listBuilds(locator string) []*tcBuild {
+	buildType := strings.TrimPrefix(strings.Trim(locatorDimension(locator, "buildType"), "()"), "id:")
+	status := locatorDimension(locator, "status")
+	since, until := locatorID(locator, "sinceBuild"), locatorID(locator, "untilBuild")
+	running := locatorDimension(locator, "running") == "any"
+
+	var builds []*tcBuild
+	for _, build := range tc.builds {
+		if !(build.State == "finished" || running && build.State == "running") || !tc.matchesProject(&build.BuildType, locator) ||
+			(buildType != "" && build.BuildTypeID != buildType) || (status != "" && build.Status != status) ||
+			(since != 0 && build.ID <= since) || (until != 0 && build.ID > until) {
+			continue
+		}
+		builds = append(builds, build)
+	}
+
+	sort.Slice(builds, func(i, j int) bool { return builds[i].ID > builds[j].ID })
+
+	if count, err := strconv.Atoi(locatorDimension(locator, "count")); err == nil && count < len(builds) {
+		builds = builds[:count]
+	}
+
+	return builds
+}
+
+// matchesProject returns true if a build configuration is in the subtree of the project given by
+// the affectedProject dimension of a locator, or if the locator has none
+func (tc *fakeTeamCity) matchesProject(buildType *tcBuildType, locator string) bool {
+	affected := strings.TrimPrefix(strings.Trim(locatorDimension(locator, "affectedProject"), "()"), "id:")
+	if affected == "" {
+		return true
+	}
+
+	projectID := buildType.ProjectID
+	for projectID != "" {
+		if projectID == affected {
+			return true
+		}
+
+		parent := ""
+		for _, project := range tc.projects {
+			if project.ID == projectID {
+				parent = project.ParentProjectID
+			}
+		}
+		projectID = parent
+	}
+
+	return false
+}
+
+// locatorID returns the numeric ID of a dimension of a locator, e.g. 42 for build in
+// "build:(id:42),count:5", or 0 if it has none
+func locatorID(locator, name string) int64 {
+	id, _ := strconv.ParseInt(strings.TrimPrefix(strings.Trim(locatorDimension(locator, name), "()"), "id:"), 10, 64)
+	return id
+}
+
+// locatorDimension returns the value of a dimension of a TeamCity locator, e.g. "(id:X)" for
+// affectedProject in "affectedProject:(id:X),count:5"
+func locatorDimension(locator, name string) string {
+	var dimensions []string
+
+	depth, start := 0, 0
+	for i, c := range locator {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			dimensions = append(dimensions, locator[start:i])
+			start = i + 1
+		}
+	}
+	dimensions = append(dimensions, locator[start:])
+
+	for _, dimension := range dimensions {
+		if strings.HasPrefix(dimension, name+":") {
+			return strings.TrimPrefix(dimension, name+":")
+		}
+	}
+
+	return ""
+}
+
+func (tc *fakeTeamCity) queueBuild(w http.ResponseWriter, r *http.Request) *tcBuild {
+	var request struct {
+		BuildType struct {
+			ID string `json:"id"`
+		} `json:"buildType"`
+		BranchName string `json:"branchName"`
+		Comment    *struct {
+			Text string `json:"text"`
+		} `json:"comment"`
+		Properties *tcProperties `json:"properties"`
+		Agent      *struct {
+			ID int64 `json:"id"`
+		} `json:"agent"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	buildType := tc.buildType(request.BuildType.ID)
+	if buildType == nil {
+		http.Error(w, "No build type found by locator 'id:"+request.BuildType.ID+"'", http.StatusNotFound)
+		return nil
+	}
+
+	build := tc.addBuild("queued", "", "")
+	build.BuildTypeID = buildType.ID
+	build.BuildType = *buildType
+	build.BranchName = request.BranchName
+	tc.queue = append(tc.queue, build.ID)
+
+	options := &queueBuildOptions{Branch: request.BranchName, Parameters: map[string]string{}}
+	if request.Comment != nil {
+		options.Comment = request.Comment.Text
+	}
+	if request.Agent != nil {
+		options.AgentID = request.Agent.ID
+	}
+	if request.Properties != nil {
+		for _, property := range request.Properties.Property {
+			options.Parameters[property.Name] = property.Value
+		}
+	}
+	tc.queued[build.ID] = options
+
+	return build
+}
+
+func (tc *fakeTeamCity) cancelBuild(build *tcBuild, r *http.Request) {
+	var request struct {
+		Comment string `json:"comment"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&request)
+
+	tc.cancelled[build.ID] = request.Comment
+
+	for i, buildID := range tc.queue {
+		if buildID == build.ID {
+			tc.queue = append(tc.queue[:i], tc.queue[i+1:]...)
+			break
+		}
+	}
+
+	build.State = "finished"
+	build.Status = "UNKNOWN"
+	build.StatusText = "Canceled"
+	build.RunningInfo = nil
+}
+
+// allowLogs accepts log calls with up to six key value pairs
+func allowLogs(api *plugintest.API) {
+	for _, level := range []string{"LogDebug", "LogInfo", "LogWarn", "LogError"} {
+		args := []interface{}{mock.Anything}
+		for pairs := 0; pairs <= 6; pairs++ {
+			api.On(level, args...).Maybe().Return()
+			args = append(args, mock.Anything, mock.Anything)
+		}
+	}
+}
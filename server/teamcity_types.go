@@ -0,0 +1,222 @@
+package main
+
+import (
+	"time"
+)
+
+// Magic Date: Mon Jan 2 15:04:05 MST 2006
+const tcTimeFormat = "20060102T150405-0700"
+
+// tcTime is a date as returned by the TeamCity REST API, e.g. 20200127T153000+0000
+type tcTime string
+
+// Time parses the TeamCity date, returning the zero time if it is empty or invalid
+func (t tcTime) Time() time.Time {
+	parsed, err := time.Parse(tcTimeFormat, string(t))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return parsed
+}
+
+type tcBuildType struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ProjectID   string `json:"projectId"`
+	ProjectName string `json:"projectName"`
+	WebURL      string `json:"webUrl"`
+}
+
+// tcBranch is a branch of a build configuration known to TeamCity
+type tcBranch struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+}
+
+type tcProject struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	ParentProjectID string `json:"parentProjectId"`
+	WebURL          string `json:"webUrl"`
+}
+
+// tcServer describes the TeamCity server
+type tcServer struct {
+	Version     string `json:"version"`
+	BuildNumber string `json:"buildNumber"`
+	WebURL      string `json:"webUrl"`
+}
+
+type tcAgent struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	WebURL     string `json:"webUrl"`
+	Enabled    bool   `json:"enabled"`
+	Authorized bool   `json:"authorized"`
+	UpToDate   bool   `json:"uptodate"`
+	Connected  bool   `json:"connected"`
+	// Build is the build the agent is running, if any
+	Build *tcBuildRef `json:"build"`
+}
+
+// tcBuildRef refers to a build
+type tcBuildRef struct {
+	ID          int64  `json:"id"`
+	BuildTypeID string `json:"buildTypeId"`
+	Number      string `json:"number,omitempty"`
+	WebURL      string `json:"webUrl,omitempty"`
+}
+
+type tcUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+}
+
+type tcTriggered struct {
+	Type    string `json:"type"`
+	Details string `json:"details"`
+	User    tcUser `json:"user"`
+}
+
+// tcBuild is a build (queued, running or finished) as returned by the TeamCity REST API
+type tcBuild struct {
+	ID            int64       `json:"id"`
+	BuildTypeID   string      `json:"buildTypeId"`
+	Number        string      `json:"number"`
+	Status        string      `json:"status"`
+	State         string      `json:"state"`
+	StatusText    string      `json:"statusText"`
+	BranchName    string      `json:"branchName"`
+	DefaultBranch bool        `json:"defaultBranch"`
+	Personal      bool        `json:"personal"`
+	WebURL        string      `json:"webUrl"`
+	QueuedDate    tcTime      `json:"queuedDate"`
+	StartDate     tcTime      `json:"startDate"`
+	FinishDate    tcTime      `json:"finishDate"`
+	BuildType     tcBuildType `json:"buildType"`
+	Agent         tcAgent     `json:"agent"`
+	Triggered     tcTriggered `json:"triggered"`
+	// RunningInfo is only set while the build is running
+	RunningInfo *tcRunningInfo `json:"running-info"`
+}
+
+// tcRunningInfo is the progress of a running build
+type tcRunningInfo struct {
+	PercentageComplete    int    `json:"percentageComplete"`
+	CurrentStageText      string `json:"currentStageText"`
+	ElapsedSeconds        int64  `json:"elapsedSeconds"`
+	EstimatedTotalSeconds int64  `json:"estimatedTotalSeconds"`
+}
+
+// TriggeredBy returns a human readable description of what triggered the build
+func (b *tcBuild) TriggeredBy() string {
+	switch {
+	case b.Triggered.User.Name != "":
+		return b.Triggered.User.Name
+	case b.Triggered.User.Username != "":
+		return b.Triggered.User.Username
+	case b.Triggered.Details != "":
+		return b.Triggered.Details
+	}
+
+	return b.Triggered.Type
+}
+
+// tcTestOccurrence is a run of a test in a build
+type tcTestOccurrence struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Duration is in milliseconds
+	Duration   int64 `json:"duration"`
+	NewFailure bool  `json:"newFailure"`
+	Muted      bool  `json:"muted"`
+	// FirstFailed is the first run of the test in the current series of failures
+	FirstFailed *struct {
+		Build *tcBuildRef `json:"build"`
+	} `json:"firstFailed"`
+	// Test is the test across builds, which is muted or investigated
+	Test *tcTestRef `json:"test"`
+}
+
+// tcTestRef is a test across builds. TeamCity sends its ID as a string of a number.
+type tcTestRef struct {
+	ID flexibleID `json:"id"`
+}
+
+// tcTestOccurrences is a page of test runs. NextHref is set if there are more.
+type tcTestOccurrences struct {
+	Count          int                 `json:"count"`
+	NextHref       string              `json:"nextHref"`
+	TestOccurrence []*tcTestOccurrence `json:"testOccurrence"`
+}
+
+// tcProblemOccurrence is a problem that failed a build, e.g. a non-zero exit code or a failed
+// test, which has the type tcProblemFailedTests
+type tcProblemOccurrence struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Identity string `json:"identity"`
+	Details  string `json:"details"`
+	// Problem is the problem across builds, which is muted or investigated
+	Problem *tcProblemRef `json:"problem"`
+}
+
+// tcProblemRef is a build problem across builds
+type tcProblemRef struct {
+	ID flexibleID `json:"id"`
+}
+
+// tcProblemOccurrences is a page of build problems. NextHref is set if there are more.
+type tcProblemOccurrences struct {
+	Count             int                    `json:"count"`
+	NextHref          string                 `json:"nextHref"`
+	ProblemOccurrence []*tcProblemOccurrence `json:"problemOccurrence"`
+}
+
+// tcChange is a VCS change, e.g. a commit
+type tcChange struct {
+	ID      int64  `json:"id"`
+	Version string `json:"version"`
+	// Username is the VCS username of the author, e.g. "Jane Doe <jane@example.com>" for Git
+	Username string `json:"username"`
+	Date     tcTime `json:"date"`
+	Comment  string `json:"comment"`
+	WebURL   string `json:"webUrl"`
+	// User is the TeamCity user TeamCity matched the VCS username to, if any
+	User  *tcUser `json:"user"`
+	Files struct {
+		Count int `json:"count"`
+	} `json:"files"`
+}
+
+type tcProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type tcProperties struct {
+	Property []tcProperty `json:"property"`
+}
+
+// tcParameter is a build configuration parameter. Parameters declared with a specification
+// have a type, e.g. "select data_1='debug' data_2='release'".
+type tcParameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  *struct {
+		RawValue string `json:"rawValue"`
+	} `json:"type"`
+}
+
+// queueBuildOptions are the optional settings of a build added to the queue
+type queueBuildOptions struct {
+	Branch     string
+	Parameters map[string]string
+	Comment    string
+	AgentID    int64
+	QueueAtTop bool
+}
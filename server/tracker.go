@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	trackedBuildsKey = "tracked_builds"
+	trackerJobName   = "tracker"
+
+	// trackerInterval is how often the progress of running tracked builds is refreshed
+	trackerInterval = 20 * time.Second
+
+	// Builds still not finished after this long, e.g. because they were deleted, are forgotten
+	maxTrackedBuildAge = 24 * time.Hour
+)
+
+// trackedBuild is a build started from Mattermost whose post is kept up to date until the
+// build finishes
+type trackedBuild struct {
+	// Server is the name of the TeamCity server of the build
+	Server     string
+	BuildID    int64
+	PostID     string
+	Branch     string
+	Parameters map[string]string
+	TrackedAt  int64
+}
+
+type trackedBuilds struct {
+	Builds []*trackedBuild
+}
+
+func (b *trackedBuilds) find(server string, buildID int64) *trackedBuild {
+	for _, tracked := range b.Builds {
+		if tracked.BuildID == buildID && serverNameOrDefault(tracked.Server) == serverNameOrDefault(server) {
+			return tracked
+		}
+	}
+
+	return nil
+}
+
+// trackedBuildKey identifies a tracked build, as build IDs are only unique on one server
+func trackedBuildKey(server string, buildID int64) string {
+	return fmt.Sprintf("%s:%d", serverNameOrDefault(server), buildID)
+}
+
+// buildProgressMessage describes a build of a server started from Mattermost in its current
+// state
+func buildProgressMessage(server string, build *tcBuild, options *queueBuildOptions) string {
+	header := "**TEAMCITY BUILD STARTED**"
+	state := build.State
+
+	switch build.State {
+	case "running":
+		header = "**TEAMCITY BUILD RUNNING**"
+		if info := build.RunningInfo; info != nil {
+			state = fmt.Sprintf("running, %d%% complete", info.PercentageComplete)
+			if info.CurrentStageText != "" {
+				state += ": " + info.CurrentStageText
+			}
+		}
+	case "finished":
+		switch finishedEventKind(build.Status) {
+		case eventSucceeded:
+			header = "**TEAMCITY BUILD SUCCEEDED**"
+		case eventCancelled:
+			header = "**TEAMCITY BUILD CANCELLED**"
+		default:
+			header = "**TEAMCITY BUILD FAILED**"
+		}
+		if build.StatusText != "" {
+			state = build.StatusText
+		}
+	}
+
+	message := "%s\n\n" +
+		" - Build Type: [%s](%s)\n" +
+		" - [Build ID: %d](%s)\n" +
+		" - State: %s\n"
+
+	text := fmt.Sprintf(message, header, build.BuildType.Name, build.BuildType.WebURL, build.ID, build.WebURL, state)
+
+	if options.Branch != "" {
+		text += " - Branch: " + options.Branch + "\n"
+	}
+
+	if len(options.Parameters) > 0 {
+		names := make([]string, 0, len(options.Parameters))
+		for name := range options.Parameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		text += " - Parameters:\n"
+		for _, name := range names {
+			text += fmt.Sprintf("\t - `%s` = `%s`\n", name, options.Parameters[name])
+		}
+	}
+
+	if build.State != "finished" {
+		cancel := fmt.Sprintf("/teamcity build cancel %d", build.ID)
+		if server = serverNameOrDefault(server); server != defaultServerName {
+			cancel += " --server=" + server
+		}
+
+		text += "\n Stop this build with this slash command: `" + cancel + "`"
+	}
+
+	return text
+}
+
+// postStartedBuild posts a build of a server started from Mattermost on behalf of the user and
+// tracks it, so the post follows the build until it finishes
+func (p *Plugin) postStartedBuild(userID, channelID, rootID, server string, build *tcBuild, options *queueBuildOptions) (*model.Post, error) {
+	post := &model.Post{
+		UserId:    userID,
+		ChannelId: channelID,
+		RootId:    rootID,
+		Message:   buildProgressMessage(server, build, options),
+	}
+	model.ParseSlackAttachment(post, p.startedBuildAttachments(server, build))
+
+	post, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not create post")
+	}
+
+	tracked := &trackedBuild{
+		Server:     serverNameOrDefault(server),
+		BuildID:    build.ID,
+		PostID:     post.Id,
+		Branch:     options.Branch,
+		Parameters: options.Parameters,
+		TrackedAt:  model.GetMillis(),
+	}
+
+	if err := p.updateTrackedBuilds(func(builds *trackedBuilds) error {
+		builds.Builds = append(builds.Builds, tracked)
+		return nil
+	}); err != nil {
+		p.API.LogWarn("Could not track build", "build_id", build.ID, "error", err.Error())
+	}
+
+	return post, nil
+}
+
+func (p *Plugin) getTrackedBuilds() (*trackedBuilds, error) {
+	raw, appErr := p.API.KVGet(trackedBuildsKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not load tracked builds")
+	}
+
+	builds := &trackedBuilds{}
+	if raw != nil {
+		if err := json.Unmarshal(raw, builds); err != nil {
+			return nil, errors.Wrap(err, "could not decode tracked builds")
+		}
+	}
+
+	return builds, nil
+}
+
+// updateTrackedBuilds applies update to the tracked builds and saves them, retrying if another
+// node changed them concurrently
+func (p *Plugin) updateTrackedBuilds(update func(builds *trackedBuilds) error) error {
+	for attempt := 0; attempt < maxKVUpdateAttempts; attempt++ {
+		oldRaw, appErr := p.API.KVGet(trackedBuildsKey)
+		if appErr != nil {
+			return errors.Wrap(appErr, "could not load tracked builds")
+		}
+
+		builds := &trackedBuilds{}
+		if oldRaw != nil {
+			if err := json.Unmarshal(oldRaw, builds); err != nil {
+				return errors.Wrap(err, "could not decode tracked builds")
+			}
+		}
+
+		if err := update(builds); err != nil {
+			return err
+		}
+
+		newRaw, err := json.Marshal(builds)
+		if err != nil {
+			return errors.Wrap(err, "could not encode tracked builds")
+		}
+
+		saved, appErr := p.API.KVCompareAndSet(trackedBuildsKey, oldRaw, newRaw)
+		if appErr != nil {
+			return errors.Wrap(appErr, "could not save tracked builds")
+		}
+
+		if saved {
+			return nil
+		}
+	}
+
+	return errors.New("could not save tracked builds")
+}
+
+// untrackBuilds stops tracking the given builds, identified by trackedBuildKey
+func (p *Plugin) untrackBuilds(keys map[string]bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return p.updateTrackedBuilds(func(builds *trackedBuilds) error {
+		var kept []*trackedBuild
+		for _, tracked := range builds.Builds {
+			if !keys[trackedBuildKey(tracked.Server, tracked.BuildID)] {
+				kept = append(kept, tracked)
+			}
+		}
+		builds.Builds = kept
+		return nil
+	})
+}
+
+// refreshTrackedBuild updates the post of a tracked build with its current state, returning
+// true once the build does not need to be tracked anymore
+func (p *Plugin) refreshTrackedBuild(tracked *trackedBuild) (bool, error) {
+	client, err := p.serverClient(tracked.Server)
+	if err != nil {
+		// The server was removed
+		return true, nil
+	}
+
+	build, err := client.GetBuild(tracked.BuildID)
+	if errors.Cause(err) == errNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	post, appErr := p.API.GetPost(tracked.PostID)
+	if appErr != nil {
+		// The post was deleted
+		return true, nil
+	}
+
+	finished := build.State == "finished"
+
+	message := buildProgressMessage(tracked.Server, build, &queueBuildOptions{
+		Branch:     tracked.Branch,
+		Parameters: tracked.Parameters,
+	})
+	if message == post.Message && !finished {
+		return false, nil
+	}
+
+	// Finished builds cannot be cancelled anymore, and the log of failed ones may be shown
+	updated := post.Clone()
+	if finished {
+		updated = addBuildPostNote(post, "", buildActionCancel)
+		if build.Status == "FAILURE" {
+			updated = p.addBuildPostActions(updated, tracked.Server, build.ID, buildActionLog)
+		}
+	}
+	updated.Message = message
+
+	if _, appErr = p.API.UpdatePost(updated); appErr != nil {
+		return false, errors.Wrap(appErr, "could not update post")
+	}
+
+	return finished, nil
+}
+
+// refreshTrackedBuildByID refreshes the post of a build of a server if it is tracked, e.g. when
+// a webhook or the poller reports that it started or finished
+func (p *Plugin) refreshTrackedBuildByID(server string, buildID int64) {
+	builds, err := p.getTrackedBuilds()
+	if err != nil {
+		p.API.LogWarn("Could not load tracked builds", "error", err.Error())
+		return
+	}
+
+	tracked := builds.find(server, buildID)
+	if tracked == nil {
+		return
+	}
+
+	done, err := p.refreshTrackedBuild(tracked)
+	if err != nil {
+		p.API.LogWarn("Could not refresh tracked build", "build_id", buildID, "error", err.Error())
+		return
+	}
+
+	if done {
+		if err := p.untrackBuilds(map[string]bool{trackedBuildKey(server, buildID): true}); err != nil {
+			p.API.LogWarn("Could not untrack build", "build_id", buildID, "error", err.Error())
+		}
+	}
+}
+
+// startTracker starts the background job refreshing the posts of tracked builds, which shows
+// the progress of running builds and catches builds whose events were missed
+func (p *Plugin) startTracker() {
+	p.startJob(trackerJobName, func() time.Duration {
+		return trackerInterval
+	}, func() error {
+		if len(p.getConfiguration().GetServers()) == 0 {
+			return nil
+		}
+
+		return p.refreshTrackedBuilds()
+	})
+}
+
+func (p *Plugin) refreshTrackedBuilds() error {
+	builds, err := p.getTrackedBuilds()
+	if err != nil {
+		return err
+	}
+
+	expired := model.GetMillisForTime(time.Now().Add(-maxTrackedBuildAge))
+
+	done := map[string]bool{}
+	for _, tracked := range builds.Builds {
+		key := trackedBuildKey(tracked.Server, tracked.BuildID)
+
+		if tracked.TrackedAt < expired {
+			done[key] = true
+			continue
+		}
+
+		finished, err := p.refreshTrackedBuild(tracked)
+		if err != nil {
+			p.API.LogWarn("Could not refresh tracked build", "build_id", tracked.BuildID, "error", err.Error())
+			continue
+		}
+
+		if finished {
+			done[key] = true
+		}
+	}
+
+	return p.untrackBuilds(done)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+)
+
+func TestBuildProgressMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	build := &tcBuild{ID: 42, State: "queued", BuildType: tcBuildType{Name: "Build"}}
+	options := &queueBuildOptions{Branch: "feature/x", Parameters: map[string]string{"env.B": "2", "env.A": "1"}}
+
+	message := buildProgressMessage(defaultServerName, build, options)
+	assert.Contains(message, "TEAMCITY BUILD STARTED")
+	assert.Contains(message, " - Branch: feature/x\n")
+	assert.Contains(message, " - Parameters:\n\t - `env.A` = `1`\n\t - `env.B` = `2`\n")
+	assert.Contains(message, "`/teamcity build cancel 42`")
+	assert.Contains(buildProgressMessage("infra", build, options), "`/teamcity build cancel 42 --server=infra`")
+
+	build.State = "running"
+	build.RunningInfo = &tcRunningInfo{PercentageComplete: 40, CurrentStageText: "Compiling"}
+	message = buildProgressMessage(defaultServerName, build, options)
+	assert.Contains(message, "TEAMCITY BUILD RUNNING")
+	assert.Contains(message, " - State: running, 40% complete: Compiling\n")
+
+	build.State = "finished"
+	build.Status = "FAILURE"
+	build.StatusText = "Tests failed: 3"
+	message = buildProgressMessage(defaultServerName, build, options)
+	assert.Contains(message, "TEAMCITY BUILD FAILED")
+	assert.Contains(message, " - State: Tests failed: 3\n")
+	assert.NotContains(message, "/teamcity build cancel")
+}
+
+func TestRefreshTrackedBuilds(t *testing.T) {
+	assert := assert.New(t)
+
+	build := &tcBuild{ID: 42, State: "running", RunningInfo: &tcRunningInfo{PercentageComplete: 10}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/app/rest/builds/id:42", r.URL.Path)
+		_ = json.NewEncoder(w).Encode(build)
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{TeamCityURL: server.URL})
+
+	post := &model.Post{Id: "post"}
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(post, nil)
+	api.On("GetPost", "post").Return(func(string) *model.Post { return post.Clone() }, nil)
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(func(updated *model.Post) *model.Post {
+		post = updated
+		return updated
+	}, nil)
+
+	_, err := p.postStartedBuild("user", "channel", "", defaultServerName, &tcBuild{ID: 42, State: "queued"}, &queueBuildOptions{})
+	assert.Nil(err)
+
+	assert.Nil(p.refreshTrackedBuilds())
+	assert.Contains(post.Message, "10% complete")
+
+	tracked, err := p.getTrackedBuilds()
+	assert.Nil(err)
+	assert.Len(tracked.Builds, 1)
+
+	build.State = "finished"
+	build.Status = "SUCCESS"
+	build.RunningInfo = nil
+	p.refreshTrackedBuildByID(defaultServerName, 42)
+	assert.Contains(post.Message, "TEAMCITY BUILD SUCCEEDED")
+
+	tracked, err = p.getTrackedBuilds()
+	assert.Nil(err)
+	assert.Empty(tracked.Builds, "finished builds are not tracked anymore")
+}
+
+func TestRefreshFailedBuildTwice(t *testing.T) {
+	assert := assert.New(t)
+
+	build := &tcBuild{ID: 42, State: "finished", Status: "FAILURE"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(build)
+	}))
+	defer server.Close()
+
+	api := &plugintest.API{}
+	newTestKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{TeamCityURL: server.URL})
+
+	post := &model.Post{Id: "post"}
+	api.On("GetPost", "post").Return(func(string) *model.Post { return post.Clone() }, nil)
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(func(updated *model.Post) *model.Post {
+		post = updated
+		return updated
+	}, nil)
+
+	// A webhook and the tracker may both refresh the post before the build is untracked
+	tracked := &trackedBuild{Server: defaultServerName, BuildID: 42, PostID: "post"}
+	for i := 0; i < 2; i++ {
+		done, err := p.refreshTrackedBuild(tracked)
+		assert.Nil(err)
+		assert.True(done)
+	}
+
+	var logActions int
+	for _, action := range post.Attachments()[0].Actions {
+		if action.Integration.Context["action"] == buildActionLog {
+			logActions++
+		}
+	}
+	assert.Equal(1, logActions, "the log tail button is added once")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	userTokenKey = "token_"
+	// connectedUserKey maps connected TeamCity accounts back to their Mattermost users
+	connectedUserKey = "tcuser_"
+)
+
+// errNotConnected is returned when a user without a linked TeamCity account needs one
+var errNotConnected = errors.New("TeamCity account not connected")
+
+// userToken is the TeamCity access token of a Mattermost user. The token is stored encrypted.
+type userToken struct {
+	Token    string
+	Username string
+}
+
+// getUserToken returns the linked TeamCity account of a user on a server, with the token
+// decrypted, or nil if the user did not connect one
+func (p *Plugin) getUserToken(userID, server string) (*userToken, error) {
+	stored, err := p.getStoredUserToken(userID, server)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	if stored.Token, err = p.decryptSecret(stored.Token); err != nil {
+		return nil, errors.Wrap(err, "could not decrypt TeamCity token")
+	}
+
+	return stored, nil
+}
+
+// getStoredUserToken returns the linked TeamCity account of a user on a server as stored, with
+// the token still encrypted, or nil if the user did not connect one
+func (p *Plugin) getStoredUserToken(userID, server string) (*userToken, error) {
+	raw, appErr := p.API.KVGet(kvServerKey(userTokenKey, server, userID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not load TeamCity token")
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	var stored userToken
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, errors.Wrap(err, "could not decode TeamCity token")
+	}
+
+	return &stored, nil
+}
+
+// storeUserToken links a TeamCity account on a server to a user, encrypting the token
+func (p *Plugin) storeUserToken(userID, server string, token *userToken) error {
+	encrypted, err := p.encryptSecret(token.Token)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(&userToken{Token: encrypted, Username: token.Username})
+	if err != nil {
+		return errors.Wrap(err, "could not encode TeamCity token")
+	}
+
+	if appErr := p.API.KVSet(kvServerKey(userTokenKey, server, userID), raw); appErr != nil {
+		return errors.Wrap(appErr, "could not save TeamCity token")
+	}
+
+	if token.Username != "" {
+		if appErr := p.API.KVSet(kvServerKey(connectedUserKey, server, strings.ToLower(token.Username)), []byte(userID)); appErr != nil {
+			return errors.Wrap(appErr, "could not save TeamCity account")
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) deleteUserToken(userID, server string) error {
+	// The account is read without decrypting the token, which may not be readable anymore
+	if stored, err := p.getStoredUserToken(userID, server); err == nil && stored != nil && stored.Username != "" {
+		key := kvServerKey(connectedUserKey, server, strings.ToLower(stored.Username))
+		if raw, appErr := p.API.KVGet(key); appErr == nil && string(raw) == userID {
+			if appErr = p.API.KVDelete(key); appErr != nil {
+				return errors.Wrap(appErr, "could not delete TeamCity account")
+			}
+		}
+	}
+
+	if appErr := p.API.KVDelete(kvServerKey(userTokenKey, server, userID)); appErr != nil {
+		return errors.Wrap(appErr, "could not delete TeamCity token")
+	}
+
+	return nil
+}
+
+// connectedUser returns the ID of the Mattermost user who connected a TeamCity account on a
+// server, or "" if nobody did
+func (p *Plugin) connectedUser(server, teamCityUsername string) string {
+	if teamCityUsername == "" {
+		return ""
+	}
+
+	raw, appErr := p.API.KVGet(kvServerKey(connectedUserKey, server, strings.ToLower(teamCityUsername)))
+	if appErr != nil || raw == nil {
+		return ""
+	}
+
+	// The user may have connected another account since
+	userID := string(raw)
+	if token, err := p.getUserToken(userID, server); err != nil || token == nil || !strings.EqualFold(token.Username, teamCityUsername) {
+		return ""
+	}
+
+	return userID
+}
+
+// tokenFor returns the TeamCity token to act on behalf of a user. Actions changing anything in
+// TeamCity always use the user's own token, so TeamCity permissions and audit apply. Read-only
+// queries fall back to the system token of the server if the administrator allows it.
+func (p *Plugin) tokenFor(userID string, server *teamCityServer, write bool) (string, error) {
+	token, err := p.getUserToken(userID, server.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if token != nil {
+		return token.Token, nil
+	}
+
+	if !write && p.getConfiguration().AllowSystemTokenForReads {
+		return server.GetToken(), nil
+	}
+
+	return "", errNotConnected
+}
+
+// clientFor returns a client acting on behalf of a user on a server, see tokenFor
+func (p *Plugin) clientFor(userID string, server *teamCityServer, write bool) (TeamCityClient, error) {
+	token, err := p.tokenFor(userID, server, write)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.teamCityClient(server.URL, token), nil
+}
+
+// commandClient returns the client for a slash command and the server it talks to, see
+// commandServer, or the response to send if the user has no usable token
+func (p *Plugin) commandClient(args *model.CommandArgs, flags commandFlags, write bool) (TeamCityClient, *teamCityServer, *model.CommandResponse) {
+	server, errResponse := p.commandServer(args, flags)
+	if errResponse != nil {
+		return nil, nil, errResponse
+	}
+
+	token, err := p.tokenFor(args.UserId, server, write)
+	if err == errNotConnected {
+		return nil, nil, p.postEphemeral(errorNotConnected + p.connectServerHint(server.Name))
+	}
+	if err != nil {
+		return nil, nil, p.postEphemeral("Could not get your TeamCity token: `" + err.Error() + "`")
+	}
+
+	return p.teamCityClient(server.URL, token), server, nil
+}
+
+// connectServerHint tells users which server to connect their account to, when it is not the
+// only one
+func (p *Plugin) connectServerHint(server string) string {
+	if p.serverNote(server) != "" {
+		return " Use `/teamcity connect <token> --server=" + server + "` to connect to `" + server + "`."
+	}
+
+	return ""
+}
+
+func (p *Plugin) executeCommandTriggerConnect(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	server, errResponse := p.commandServer(args, input.Flags)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	token := input.Arg("token")
+
+	user, err := p.teamCityClient(server.URL, token).GetCurrentUser()
+	if err != nil {
+		return p.postEphemeral("Could not connect to TeamCity with this token: `" + err.Error() + "`")
+	}
+
+	if err = p.storeUserToken(args.UserId, server.Name, &userToken{Token: token, Username: user.Username}); err != nil {
+		return p.postEphemeral("Could not save your TeamCity token: `" + err.Error() + "`")
+	}
+
+	name := user.Username
+	if user.Name != "" {
+		name = user.Name + " (" + user.Username + ")"
+	}
+
+	return p.postEphemeral("Connected to TeamCity" + p.serverNote(server.Name) + " as **" + name + "**. Builds you start or cancel from Mattermost now use your TeamCity account.")
+}
+
+func (p *Plugin) executeCommandTriggerDisconnect(args *model.CommandArgs, input *commandInput) *model.CommandResponse {
+	server := p.commandServerName(args, input.Flags)
+
+	// Tokens that cannot be decrypted anymore can still be disconnected
+	token, err := p.getStoredUserToken(args.UserId, server)
+	if err != nil {
+		return p.postEphemeral("Could not get your TeamCity token: `" + err.Error() + "`")
+	}
+
+	if token == nil {
+		return p.postEphemeral("Your TeamCity account is not connected" + p.serverNote(server))
+	}
+
+	if err = p.deleteUserToken(args.UserId, server); err != nil {
+		return p.postEphemeral("Could not disconnect your TeamCity account: `" + err.Error() + "`")
+	}
+
+	return p.postEphemeral("Disconnected your TeamCity account **" + token.Username + "**. You may also want to revoke the access token in TeamCity.")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisconnect(t *testing.T) {
+	assert := assert.New(t)
+	plugin, _, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("disconnect")
+	response := plugin.executeCommandHooks(args)
+	assert.Equal("Disconnected your TeamCity account **admin**. You may also want to revoke the access token in TeamCity.", response.Text)
+
+	token, err := plugin.getUserToken(args.UserId, defaultServerName)
+	assert.Nil(err)
+	assert.Nil(token)
+	assert.Empty(plugin.connectedUser(defaultServerName, "admin"))
+
+	response = plugin.executeCommandHooks(args)
+	assert.Equal("Your TeamCity account is not connected", response.Text)
+}
+
+func TestDisconnectUndecryptableToken(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	args := generateArgs("disconnect")
+
+	// Losing the key makes the stored token unreadable
+	assert.Nil(api.KVDelete(encryptionKeyKey))
+	_, err := plugin.getUserToken(args.UserId, defaultServerName)
+	assert.NotNil(err)
+
+	response := plugin.executeCommandHooks(args)
+	assert.Equal("Disconnected your TeamCity account **admin**. You may also want to revoke the access token in TeamCity.", response.Text)
+
+	stored, err := plugin.getStoredUserToken(args.UserId, defaultServerName)
+	assert.Nil(err)
+	assert.Nil(stored)
+
+	raw, appErr := api.KVGet(kvServerKey(connectedUserKey, defaultServerName, "admin"))
+	assert.Nil(appErr)
+	assert.Nil(raw, "the account is unlinked too")
+}
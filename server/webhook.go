@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// flexibleID accepts IDs sent either as JSON numbers or as strings, as tcWebHooks does for
+// build IDs
+type flexibleID int64
+
+func (id *flexibleID) UnmarshalJSON(data []byte) error {
+	raw := strings.Trim(string(data), `"`)
+	if raw == "" || raw == "null" {
+		*id = 0
+		return nil
+	}
+
+	parsed, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid ID %s", data)
+	}
+
+	*id = flexibleID(parsed)
+	return nil
+}
+
+// tcWebHooksPayload is the "JSON" payload format of the tcWebHooks TeamCity plugin
+type tcWebHooksPayload struct {
+	Build *struct {
+		NotifyType          string     `json:"notifyType"`
+		BuildResult         string     `json:"buildResult"`
+		BuildResultPrevious string     `json:"buildResultPrevious"`
+		BuildResultDelta    string     `json:"buildResultDelta"`
+		BuildStatus         string     `json:"buildStatus"`
+		BuildName           string     `json:"buildName"`
+		BuildID             flexibleID `json:"buildId"`
+		BuildTypeID         string     `json:"buildTypeId"`
+		BuildExternalTypeID string     `json:"buildExternalTypeId"`
+		BuildStatusURL      string     `json:"buildStatusUrl"`
+		BuildNumber         string     `json:"buildNumber"`
+		ProjectName         string     `json:"projectName"`
+		ProjectID           string     `json:"projectId"`
+		ProjectExternalID   string     `json:"projectExternalId"`
+		AgentName           string     `json:"agentName"`
+		TriggeredBy         string     `json:"triggeredBy"`
+		BranchName          string     `json:"branchName"`
+		BranchDisplayName   string     `json:"branchDisplayName"`
+		BranchIsDefault     bool       `json:"branchIsDefault"`
+		BuildIsPersonal     bool       `json:"buildIsPersonal"`
+	} `json:"build"`
+}
+
+// tcNativePayload is the payload sent by the webhooks built into TeamCity 2023 and newer
+type tcNativePayload struct {
+	EventType string   `json:"eventType"`
+	Payload   *tcBuild `json:"payload"`
+}
+
+// parseWebhook converts a webhook request body into a build event. A nil event with a nil
+// error means the payload was valid but describes an event the plugin does not report.
+func parseWebhook(body []byte) (*buildEvent, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON payload")
+	}
+
+	if _, ok := probe["build"]; ok {
+		return parseTCWebHooks(body)
+	}
+
+	if _, ok := probe["eventType"]; ok {
+		return parseNativeWebhook(body)
+	}
+
+	return nil, errors.New("unrecognized webhook payload format")
+}
+
+func parseTCWebHooks(body []byte) (*buildEvent, error) {
+	var payload tcWebHooksPayload
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&payload); err != nil {
+		return nil, errors.Wrap(err, "invalid tcWebHooks payload")
+	}
+
+	b := payload.Build
+	if b == nil {
+		return nil, errors.New("tcWebHooks payload has no build")
+	}
+
+	event := &buildEvent{
+		BuildID:       int64(b.BuildID),
+		BuildNumber:   b.BuildNumber,
+		BuildTypeID:   b.BuildExternalTypeID,
+		BuildTypeName: b.BuildName,
+		ProjectID:     b.ProjectExternalID,
+		ProjectName:   b.ProjectName,
+		StatusText:    b.BuildStatus,
+		Branch:        b.BranchDisplayName,
+		DefaultBranch: b.BranchIsDefault,
+		Personal:      b.BuildIsPersonal,
+		AgentName:     b.AgentName,
+		TriggeredBy:   b.TriggeredBy,
+		WebURL:        b.BuildStatusURL,
+	}
+
+	if event.BuildTypeID == "" {
+		event.BuildTypeID = b.BuildTypeID
+	}
+	if event.ProjectID == "" {
+		event.ProjectID = b.ProjectID
+	}
+	if event.Branch == "" {
+		event.Branch = b.BranchName
+	}
+
+	switch b.NotifyType {
+	case "buildAddedToQueue":
+		event.Kind = eventQueued
+	case "buildStarted":
+		event.Kind = eventStarted
+	case "buildInterrupted":
+		event.Kind = eventCancelled
+	case "buildFinished", "buildSuccessful", "buildFailed", "buildFixed", "buildBroken":
+		event.Kind = eventFailed
+		event.Status = "FAILURE"
+		if strings.EqualFold(b.BuildResult, "success") {
+			event.Kind = eventSucceeded
+			event.Status = "SUCCESS"
+		}
+
+		switch {
+		case b.NotifyType == "buildFixed" || strings.EqualFold(b.BuildResultDelta, "fixed"):
+			event.Delta = deltaFixed
+		case b.NotifyType == "buildBroken" || strings.EqualFold(b.BuildResultDelta, "broken"):
+			event.Delta = deltaBroken
+		}
+	default:
+		return nil, nil
+	}
+
+	return event, nil
+}
+
+func parseNativeWebhook(body []byte) (*buildEvent, error) {
+	var payload tcNativePayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Wrap(err, "invalid TeamCity webhook payload")
+	}
+
+	if payload.Payload == nil {
+		return nil, errors.New("TeamCity webhook payload has no build")
+	}
+
+	var kind string
+	switch payload.EventType {
+	case "BUILD_ADDED_TO_QUEUE":
+		kind = eventQueued
+	case "BUILD_STARTED":
+		kind = eventStarted
+	case "BUILD_INTERRUPTED":
+		kind = eventCancelled
+	case "BUILD_FINISHED":
+		kind = finishedEventKind(payload.Payload.Status)
+	default:
+		return nil, nil
+	}
+
+	event := eventFromBuild(payload.Payload)
+	event.Kind = kind
+
+	return event, nil
+}
+
+// finishedEventKind returns the event kind of a finished build with the given TeamCity status
+func finishedEventKind(status string) string {
+	switch status {
+	case "SUCCESS":
+		return eventSucceeded
+	case "UNKNOWN":
+		return eventCancelled
+	}
+
+	return eventFailed
+}
+
+// eventFromBuild fills a build event from a build returned by the TeamCity REST API. The
+// caller is responsible for setting the event kind.
+func eventFromBuild(build *tcBuild) *buildEvent {
+	buildTypeID := build.BuildTypeID
+	if buildTypeID == "" {
+		buildTypeID = build.BuildType.ID
+	}
+
+	return &buildEvent{
+		BuildID:       build.ID,
+		BuildNumber:   build.Number,
+		BuildTypeID:   buildTypeID,
+		BuildTypeName: build.BuildType.Name,
+		ProjectID:     build.BuildType.ProjectID,
+		ProjectName:   build.BuildType.ProjectName,
+		Status:        build.Status,
+		StatusText:    build.StatusText,
+		Branch:        build.BranchName,
+		DefaultBranch: build.DefaultBranch,
+		Personal:      build.Personal,
+		AgentName:     build.Agent.Name,
+		TriggeredBy:   build.TriggeredBy(),
+		WebURL:        build.WebURL,
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const tcWebHooksFailedPayload = `{
+	"build": {
+		"notifyType": "buildFailed",
+		"buildResult": "failure",
+		"buildResultPrevious": "success",
+		"buildResultDelta": "broken",
+		"buildStatus": "Tests failed: 2, passed: 40",
+		"buildName": "Integration Tests",
+		"buildId": "1234",
+		"buildTypeId": "bt12",
+		"buildExternalTypeId": "Backend_IntegrationTests",
+		"buildStatusUrl": "http://teamcity:8111/viewLog.html?buildId=1234",
+		"buildNumber": "42",
+		"projectName": "Backend",
+		"projectId": "project3",
+		"projectExternalId": "Backend",
+		"agentName": "agent-1",
+		"triggeredBy": "Jane Doe",
+		"branchName": "refs/heads/main",
+		"branchDisplayName": "main",
+		"branchIsDefault": true,
+		"buildIsPersonal": false
+	}
+}`
+
+const tcNativeStartedPayload = `{
+	"eventType": "BUILD_STARTED",
+	"payload": {
+		"id": 1235,
+		"buildTypeId": "Backend_IntegrationTests",
+		"number": "43",
+		"status": "SUCCESS",
+		"state": "running",
+		"branchName": "feature/x",
+		"webUrl": "http://teamcity:8111/buildConfiguration/Backend_IntegrationTests/1235",
+		"buildType": {
+			"id": "Backend_IntegrationTests",
+			"name": "Integration Tests",
+			"projectId": "Backend",
+			"projectName": "Backend"
+		},
+		"agent": {"id": 1, "name": "agent-2"},
+		"triggered": {"type": "user", "user": {"username": "jdoe", "name": "Jane Doe"}}
+	}
+}`
+
+func TestParseTCWebHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	event, err := parseWebhook([]byte(tcWebHooksFailedPayload))
+
+	assert.Nil(err)
+	assert.Equal(eventFailed, event.Kind)
+	assert.Equal(deltaBroken, event.Delta)
+	assert.Equal(int64(1234), event.BuildID)
+	assert.Equal("Backend_IntegrationTests", event.BuildTypeID)
+	assert.Equal("Backend", event.ProjectID)
+	assert.Equal("main", event.Branch)
+	assert.True(event.DefaultBranch)
+	assert.Equal("Backend / Integration Tests #42", event.Title())
+}
+
+func TestParseNativeWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	event, err := parseWebhook([]byte(tcNativeStartedPayload))
+
+	assert.Nil(err)
+	assert.Equal(eventStarted, event.Kind)
+	assert.Equal(int64(1235), event.BuildID)
+	assert.Equal("Backend_IntegrationTests", event.BuildTypeID)
+	assert.Equal("Backend", event.ProjectID)
+	assert.Equal("agent-2", event.AgentName)
+	assert.Equal("Jane Doe", event.TriggeredBy)
+}
+
+func TestParseWebhookIgnoredEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	event, err := parseWebhook([]byte(`{"build": {"notifyType": "changesLoaded", "buildId": 1}}`))
+
+	assert.Nil(err)
+	assert.Nil(event)
+}
+
+func TestParseWebhookInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := parseWebhook([]byte(`{"foo": "bar"}`))
+	assert.NotNil(err)
+
+	_, err = parseWebhook([]byte(`not json`))
+	assert.NotNil(err)
+}
+
+func TestWebhookRespondsBeforeDispatching(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	plugin.startWebhookWorker()
+	defer plugin.stopJobs()
+
+	configuration := plugin.getConfiguration().Clone()
+	configuration.WebhookSecret = "secret"
+	plugin.setConfiguration(configuration)
+
+	plugin.botUserID = "bot"
+	api.On("GetDirectChannel", testUsers[0].Id, "bot").Return(&model.Channel{Id: "dm"}, nil)
+	api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team"}, nil)
+
+	// Posting blocks until the webhook has been answered
+	release := make(chan struct{})
+	posted := make(chan string, 2)
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		<-release
+		posted <- post.ChannelId
+		return post
+	}, nil)
+
+	assert.Nil(plugin.addSubscription(&subscription{
+		ChannelID:  "channel",
+		Server:     defaultServerName,
+		TargetID:   "MattermostTeamcityPlugin_TestBuild",
+		TargetType: subscriptionTargetBuildType,
+		Filter:     subscriptionFilter{Events: []string{eventFailed}},
+	}))
+
+	// The build configuration succeeded before, so the failure notifies its committers
+	succeeded := eventFromBuild(teamCity.builds[1])
+	succeeded.Kind = eventSucceeded
+	assert.Nil(plugin.dispatchBuildEvent(succeeded))
+
+	body := `{"eventType": "BUILD_FINISHED", "payload": {"id": 2, "buildTypeId": "MattermostTeamcityPlugin_TestBuild", "number": "2", "status": "FAILURE", "state": "finished",
+		"buildType": {"id": "MattermostTeamcityPlugin_TestBuild", "name": "Test Build", "projectId": "MattermostTeamcityPlugin", "projectName": "Mattermost TeamCity Plugin"}}}`
+	r := httptest.NewRequest(http.MethodPost, "/webhook?secret=secret", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	answered := make(chan struct{})
+	go func() {
+		plugin.ServeHTTP(nil, w, r)
+		close(answered)
+	}()
+
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("the webhook was not answered before the build event was posted")
+	}
+	assert.Equal(http.StatusOK, w.Code)
+
+	close(release)
+
+	var channels []string
+	for len(channels) < 2 {
+		select {
+		case channelID := <-posted:
+			channels = append(channels, channelID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the build event was not dispatched, posted to %v", channels)
+		}
+	}
+	assert.ElementsMatch([]string{"dm", "channel"}, channels, "the committer and the subscribed channel are notified")
+}
+
+func TestWebhookWorker(t *testing.T) {
+	assert := assert.New(t)
+	plugin, api, teamCity := installTestPlugin(t)
+	defer teamCity.Close()
+
+	api.On("GetChannel", "channel").Return(&model.Channel{Id: "channel", TeamId: "team"}, nil)
+
+	var posted int
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		posted++
+		return post
+	}, nil)
+
+	assert.Nil(plugin.addSubscription(&subscription{
+		ChannelID:  "channel",
+		Server:     defaultServerName,
+		TargetID:   "MattermostTeamcityPlugin_TestBuild",
+		TargetType: subscriptionTargetBuildType,
+	}))
+
+	event := func(buildID int64) *buildEvent {
+		event := eventFromBuild(teamCity.builds[buildID])
+		event.Kind = eventSucceeded
+		return event
+	}
+
+	assert.False(plugin.queueWebhookEvent(event(1)), "events are refused while the plugin is not active")
+
+	plugin.startWebhookWorker()
+	assert.True(plugin.queueWebhookEvent(event(1)))
+
+	// Stopping waits for the queued events to be dispatched
+	plugin.stopJobs()
+	assert.Equal(1, posted)
+	assert.False(plugin.queueWebhookEvent(event(2)))
+
+	// Reactivating the plugin starts a new worker
+	plugin.startWebhookWorker()
+	assert.True(plugin.queueWebhookEvent(event(2)))
+	plugin.stopJobs()
+	assert.Equal(2, posted)
+}
@@ -0,0 +1,27 @@
+import React from 'react';
+
+// encryptedPrefix marks tokens the plugin has encrypted, see server/crypto.go
+const encryptedPrefix = 'encrypted:';
+
+// TokenSetting replaces the text input of the TeamCity access token in the System Console with a
+// password input. The stored token is never shown; typing a token replaces it.
+export default function TokenSetting(props) {
+    const stored = Boolean(props.value);
+    const value = stored && props.value.startsWith(encryptedPrefix) ? '' : props.value;
+
+    return (
+        <div>
+            <input
+                id={props.id}
+                className='form-control'
+                type='password'
+                autoComplete='off'
+                placeholder={stored ? 'Encrypted token saved, enter a new token to replace it' : 'Access token'}
+                value={value || ''}
+                disabled={props.disabled || props.setByEnv}
+                onChange={(e) => props.onChange(props.id, e.target.value)}
+            />
+            <div className='help-text'>{props.helpText}</div>
+        </div>
+    );
+}
@@ -1,9 +1,12 @@
 import manifest from './manifest';
 
+import TokenSetting from './components/token_setting';
+
 export default class Plugin {
     // eslint-disable-next-line no-unused-vars
     initialize(registry, store) {
         // @see https://developers.mattermost.com/extend/plugins/webapp/reference/
+        registry.registerAdminConsoleCustomSetting('TeamCityToken', TokenSetting, {showTitle: true});
     }
 }
 
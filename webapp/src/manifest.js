@@ -6,7 +6,7 @@ const manifest = JSON.parse(`
     "name": "Mattermost TeamCity Plugin",
     "description": "This plugin integrates Mattermost with TeamCity",
     "version": "1.0.1",
-    "min_server_version": "5.18.0",
+    "min_server_version": "5.24.0",
     "server": {
         "executables": {
             "linux-amd64": "server/dist/plugin-linux-amd64",
@@ -33,9 +33,9 @@ const manifest = JSON.parse(`
             {
                 "key": "TeamCityToken",
                 "display_name": "TeamCity Access Token",
-                "type": "text",
-                "help_text": "The access token to use. [See documentation for more information](https://www.jetbrains.com/help/teamcity/managing-your-user-account.html#ManagingyourUserAccount-ManagingAccessTokens)",
-                "placeholder": "eyJ0eXAiOiAiVENWMiJ9.d21QeUw2akYwclFBQTVtUGlxY2xOWWV4TVNz.MDViNmM0Y2EtNzc5YS00MDU5LWE0NTgtYmVmNzg4YzhjMGVl",
+                "type": "custom",
+                "help_text": "The access token to use. It is encrypted when saved and never shown again. [See documentation for more information](https://www.jetbrains.com/help/teamcity/managing-your-user-account.html#ManagingyourUserAccount-ManagingAccessTokens)",
+                "placeholder": "",
                 "default": ""
             },
             {
@@ -45,6 +45,71 @@ const manifest = JSON.parse(`
                 "help_text": "Number of builds returned when listing builds",
                 "placeholder": "5",
                 "default": "5"
+            },
+            {
+                "key": "WebhookSecret",
+                "display_name": "Webhook Secret",
+                "type": "generated",
+                "help_text": "The secret TeamCity must send to the plugin webhook endpoint. See the plugin README for how to configure TeamCity webhooks.",
+                "regenerate_help_text": "Regenerating the secret invalidates the webhook URLs configured in TeamCity",
+                "placeholder": "",
+                "default": null
+            },
+            {
+                "key": "EnablePolling",
+                "display_name": "Poll TeamCity for Builds",
+                "type": "bool",
+                "help_text": "When true, the plugin periodically queries TeamCity for started and finished builds. Use this when TeamCity cannot send webhooks to Mattermost.",
+                "placeholder": "",
+                "default": false
+            },
+            {
+                "key": "PollingInterval",
+                "display_name": "Polling Interval (seconds)",
+                "type": "text",
+                "help_text": "How often to query TeamCity for builds. The minimum is 10 seconds.",
+                "placeholder": "60",
+                "default": "60"
+            },
+            {
+                "key": "PollingScope",
+                "display_name": "Polling Scope",
+                "type": "text",
+                "help_text": "Comma separated project and build configuration IDs to poll. Prefix IDs of named servers with the server name, for example infra:Terraform. Leave empty to poll everything channels are subscribed to.",
+                "placeholder": "MyProject, OtherProject_Build",
+                "default": ""
+            },
+            {
+                "key": "FailureSummaryCount",
+                "display_name": "Failed Tests Shown",
+                "type": "text",
+                "help_text": "Maximum number of failed tests and build problems listed in failure notifications and by /teamcity build tests, followed by a link to the full list. Set to 0 to leave them out of failure notifications.",
+                "placeholder": "10",
+                "default": "10"
+            },
+            {
+                "key": "AllowSystemTokenForReads",
+                "display_name": "Allow Read-Only Commands Without a Connected Account",
+                "type": "bool",
+                "help_text": "When true, users who have not connected their TeamCity account with /teamcity connect can list projects, builds and statistics using the TeamCity Access Token above. Starting and cancelling builds always requires a connected account.",
+                "placeholder": "",
+                "default": false
+            },
+            {
+                "key": "Permissions",
+                "display_name": "Build Permissions",
+                "type": "longtext",
+                "help_text": "Who may start and cancel builds from Mattermost, one rule per line: start or cancel, a project ID, build configuration ID or * for everything, prefixed with \u003cserver\u003e: for servers other than the default one, then comma separated users (username), groups (group:name) or roles (role:channel_admin, role:team_admin, role:system_admin). A rule on a project also covers its subprojects. Builds without a matching rule can be started and cancelled by everyone. System administrators are always allowed.",
+                "placeholder": "start Production alice, group:release-managers",
+                "default": ""
+            },
+            {
+                "key": "MatchChangeAuthorsByUsername",
+                "display_name": "Match Change Authors by Username",
+                "type": "bool",
+                "help_text": "When true, the authors of VCS changes who did not connect their TeamCity account and whose email address matches no Mattermost user are matched by username, to @mention them in build notifications and send them direct messages about builds they broke. Only enable this if VCS author names are trusted, as anyone who can push a commit chooses its author name.",
+                "placeholder": "",
+                "default": false
             }
         ]
     }